@@ -0,0 +1,282 @@
+package yxlib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+type adminConnInfo struct {
+	Id           uint64 `json:"id"`
+	RemoteAddr   string `json:"remote_addr"`
+	PeerEnd      uint8  `json:"peer_end"`
+	PeerNo       uint16 `json:"peer_no"`
+	Principal    string `json:"principal"`
+	AgeSec       int64  `json:"age_sec"`
+	RespQuePacks int    `json:"resp_que_packs"`
+	RespQueBytes int    `json:"resp_que_bytes"`
+	RecvBytes    uint64 `json:"recv_bytes"`
+	SentBytes    uint64 `json:"sent_bytes"`
+}
+
+type adminServiceInfo struct {
+	Mod         uint16 `json:"mod"`
+	Service     string `json:"service"`
+	Middlewares int    `json:"middlewares"`
+}
+
+type adminCmdRange struct {
+	Min uint16 `json:"min"`
+	Max uint16 `json:"max"`
+	Mod uint16 `json:"mod"`
+}
+
+type adminServices struct {
+	Services          []adminServiceInfo `json:"services"`
+	CmdRanges         []adminCmdRange    `json:"cmd_ranges"`
+	GlobalMiddlewares int                `json:"global_middlewares"`
+	HasCmdMapper      bool               `json:"has_cmd_mapper"`
+}
+
+// StartAdmin serve the admin endpoint over http, see AdminHandler.
+// It should listen on a private address only
+func (s *Server) StartAdmin(address string, token string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	admin := &http.Server{
+		Handler: s.AdminHandler(token),
+	}
+
+	s.admin = admin
+	go func() {
+		err := admin.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			s.mgr.GetLogger().E(LOG_TAG_SERV, "admin serve error: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// AdminHandler get the handler of the admin endpoint:
+//
+//	/conns                      list the conns
+//	POST /kick?id=N&reason=R    close a conn, the reason is sent to the peer
+//	/loglevel                   show the logger level and the tag levels
+//	POST /loglevel?level=L      change the logger level,
+//	                            tag=P sets the level of the tag pattern, remove=P removes it
+//	/goroutines                 dump the goroutine stacks
+//	/logs[?sink=S]              show the lines kept by a ring sink, "ring" by default
+//	/services                   show the services and the cmd routes
+//	/metrics                    the metrics in the prometheus text format
+//
+// Every request must carry "Authorization: Bearer <token>" if the token is not empty.
+// The state can only be changed with a token, so an empty token makes the endpoint read only
+func (s *Server) AdminHandler(token string) http.Handler {
+	s.adminToken = token
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conns", s.handleAdminConns)
+	mux.HandleFunc("/kick", s.handleAdminKick)
+	mux.HandleFunc("/loglevel", s.handleAdminLogLevel)
+	mux.HandleFunc("/goroutines", s.handleAdminGoroutines)
+	mux.HandleFunc("/logs", s.handleAdminLogs)
+	mux.HandleFunc("/services", s.handleAdminServices)
+	mux.Handle("/metrics", s.MetricsHandler())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if token != "" && subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// checkAdminChange return true if the request may change the state,
+// it must be a POST to an endpoint protected by a token
+func (s *Server) checkAdminChange(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	// the token itself is checked by the handler before
+	if s.adminToken == "" {
+		http.Error(w, "no admin token", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// StopAdmin close the admin endpoint, it is called by Stop and Shutdown
+func (s *Server) StopAdmin() {
+	if s.admin != nil {
+		s.admin.Close()
+		s.admin = nil
+	}
+}
+
+func (s *Server) handleAdminConns(w http.ResponseWriter, r *http.Request) {
+	now := s.GetClock().Now()
+	infos := s.mgr.GetConnInfos()
+	conns := make([]adminConnInfo, 0, len(infos))
+	for _, info := range infos {
+		conns = append(conns, adminConnInfo{
+			Id:           info.Id,
+			RemoteAddr:   info.RemoteAddr,
+			PeerEnd:      info.PeerEnd,
+			PeerNo:       info.PeerNo,
+			Principal:    info.Principal,
+			AgeSec:       int64(now.Sub(info.CreateTime).Seconds()),
+			RespQuePacks: info.RespQuePacks,
+			RespQueBytes: info.RespQueBytes,
+			RecvBytes:    info.RecvBytes,
+			SentBytes:    info.SentBytes,
+		})
+	}
+
+	writeAdminJson(w, conns)
+}
+
+func (s *Server) handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminChange(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = "kicked by admin"
+	}
+
+	err = s.mgr.KickConn(id, reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) handleAdminLogLevel(w http.ResponseWriter, r *http.Request) {
+	change := r.FormValue("remove") != "" || r.FormValue("level") != ""
+	if change && !s.checkAdminChange(w, r) {
+		return
+	}
+
+	remove := r.FormValue("remove")
+	if remove != "" {
+		util.Logger.RemoveTagLevel(remove)
+	}
+
+	name := r.FormValue("level")
+	if name != "" {
+		lv, err := util.ParseLogLv(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tag := r.FormValue("tag")
+		if tag != "" {
+			err = util.Logger.SetTagLevel(tag, lv)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			util.Logger.SetLevel(lv)
+		}
+	}
+
+	fmt.Fprintln(w, util.Logger.GetLevel())
+
+	levels := util.Logger.GetTagLevels()
+	for _, pattern := range util.Logger.GetTagPatterns() {
+		fmt.Fprintln(w, pattern, levels[pattern])
+	}
+}
+
+func (s *Server) handleAdminGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+func (s *Server) handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("sink")
+	if name == "" {
+		name = util.LOG_SINK_RING
+	}
+
+	ring, ok := util.Logger.GetSink(name).(*util.RingSink)
+	if !ok {
+		http.Error(w, "no ring sink: "+name, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range ring.Lines() {
+		io.WriteString(w, line)
+	}
+}
+
+func (s *Server) handleAdminServices(w http.ResponseWriter, r *http.Request) {
+	s.lckServ.RLock()
+	info := adminServices{
+		Services:          make([]adminServiceInfo, 0, len(s.mapMod2Serv)),
+		CmdRanges:         make([]adminCmdRange, 0, len(s.cmdRanges)),
+		GlobalMiddlewares: len(s.middlewares),
+		HasCmdMapper:      s.cmdMapper != nil,
+	}
+
+	for mod, serv := range s.mapMod2Serv {
+		info.Services = append(info.Services, adminServiceInfo{
+			Mod:         mod,
+			Service:     reflect.TypeOf(serv).String(),
+			Middlewares: len(s.mapMod2Mw[mod]),
+		})
+	}
+
+	for _, r := range s.cmdRanges {
+		info.CmdRanges = append(info.CmdRanges, adminCmdRange{
+			Min: r.min,
+			Max: r.max,
+			Mod: r.mod,
+		})
+	}
+	s.lckServ.RUnlock()
+
+	sort.Slice(info.Services, func(i, j int) bool {
+		return info.Services[i].Mod < info.Services[j].Mod
+	})
+
+	writeAdminJson(w, info)
+}
+
+func writeAdminJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,262 @@
+package yxlib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/sock"
+)
+
+const (
+	SERV_CMD_UNAUTHORIZED uint16 = 0xFFFD
+	AUTH_NONCE_LEN               = 16
+)
+
+var (
+	ErrAuthFailed error = errors.New("authenticate failed")
+)
+
+// Authenticator check the login packs of a conn.
+// A non-nil principal means the conn is authenticated, the respone is sent back if not nil
+type Authenticator interface {
+	Authenticate(p *sock.SockPack, c net.Conn) (interface{}, *sock.SockPack, error)
+}
+
+// AuthChallenger is an optional interface of Authenticator,
+// the challenge pack is sent as soon as the conn is opened, the conn is closed if it fails
+type AuthChallenger interface {
+	Challenge(c net.Conn) (*sock.SockPack, error)
+	Release(c net.Conn)
+}
+
+// AuthFunc adapt a function to Authenticator
+type AuthFunc func(p *sock.SockPack, c net.Conn) (interface{}, *sock.SockPack, error)
+
+func (f AuthFunc) Authenticate(p *sock.SockPack, c net.Conn) (interface{}, *sock.SockPack, error) {
+	return f(p, c)
+}
+
+// NewTokenAuthenticator take the data of the login pack as a token,
+// verify return the principal of a valid token
+func NewTokenAuthenticator(verify func(token string) (interface{}, error)) Authenticator {
+	return AuthFunc(func(p *sock.SockPack, c net.Conn) (interface{}, *sock.SockPack, error) {
+		principal, err := verify(string(p.Data))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return principal, sock.GetRespSockPack(p), nil
+	})
+}
+
+// HmacAuthenticator send a random nonce when the conn opens,
+// the login pack data is HMAC-SHA256(key, nonce + identity) followed by the identity,
+// and the identity string becomes the principal
+type HmacAuthenticator struct {
+	key          []byte
+	challengeCmd uint16
+	lckNonce     sync.Mutex
+	mapNonce     map[net.Conn][]byte
+}
+
+func NewHmacAuthenticator(key []byte, challengeCmd uint16) *HmacAuthenticator {
+	return &HmacAuthenticator{
+		key:          key,
+		challengeCmd: challengeCmd,
+		mapNonce:     make(map[net.Conn][]byte),
+	}
+}
+
+func (a *HmacAuthenticator) Challenge(c net.Conn) (*sock.SockPack, error) {
+	nonce := make([]byte, AUTH_NONCE_LEN)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	a.lckNonce.Lock()
+	a.mapNonce[c] = nonce
+	a.lckNonce.Unlock()
+
+	p := sock.NewReqSockPack(a.challengeCmd, 0, 0, 0, 0)
+	p.Data = nonce
+	p.DataLen = uint16(len(nonce))
+	return p, nil
+}
+
+func (a *HmacAuthenticator) Release(c net.Conn) {
+	a.lckNonce.Lock()
+	defer a.lckNonce.Unlock()
+
+	delete(a.mapNonce, c)
+}
+
+func (a *HmacAuthenticator) Authenticate(p *sock.SockPack, c net.Conn) (interface{}, *sock.SockPack, error) {
+	a.lckNonce.Lock()
+	nonce := a.mapNonce[c]
+	a.lckNonce.Unlock()
+
+	if nonce == nil || len(p.Data) < sha256.Size {
+		return nil, nil, ErrAuthFailed
+	}
+
+	sum := p.Data[:sha256.Size]
+	identity := p.Data[sha256.Size:]
+	if len(identity) == 0 {
+		return nil, nil, ErrAuthFailed
+	}
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(nonce)
+	mac.Write(identity)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, nil, ErrAuthFailed
+	}
+
+	a.Release(c)
+	return string(identity), sock.GetRespSockPack(p), nil
+}
+
+// SetAuthenticator only deliver the login cmds to the authenticator until the conn is authenticated,
+// the other packs are rejected, and the conn is closed if not authenticated within the timeout.
+// The authenticator runs on the manager loop before the packs are dispatched, so it should not block
+func (s *Server) SetAuthenticator(a Authenticator, timeout time.Duration, loginCmds ...uint16) {
+	s.lckAuth.Lock()
+	defer s.lckAuth.Unlock()
+
+	s.auth = a
+	s.authTimeout = timeout
+	s.mapLoginCmd = make(map[uint16]bool)
+	for _, cmd := range loginCmds {
+		s.mapLoginCmd[cmd] = true
+	}
+}
+
+// GetPrincipal get the principal stored by the authenticator, nil if not authenticated
+func (s *Server) GetPrincipal(c net.Conn) interface{} {
+	return s.mgr.GetPrincipal(c)
+}
+
+func (s *Server) getAuthenticator() Authenticator {
+	s.lckAuth.Lock()
+	defer s.lckAuth.Unlock()
+
+	return s.auth
+}
+
+func (s *Server) startAuth(c net.Conn) {
+	s.lckAuth.Lock()
+	a := s.auth
+	timeout := s.authTimeout
+	s.lckAuth.Unlock()
+
+	if a == nil {
+		return
+	}
+
+	if challenger, ok := a.(AuthChallenger); ok {
+		p, err := challenger.Challenge(c)
+		if err != nil {
+			s.mgr.GetConnLogger(c).E(LOG_TAG_SERV, "challenge error: ", err)
+			s.CloseConn(c)
+			return
+		}
+
+		s.Send(p, c)
+	}
+
+	if timeout <= 0 {
+		return
+	}
+
+	t := s.mgr.GetClock().AfterFunc(timeout, func() {
+		if s.GetPrincipal(c) == nil {
+			s.mgr.GetConnLogger(c).W(LOG_TAG_SERV, "authenticate timeout")
+			s.CloseConn(c)
+		}
+	})
+
+	s.lckAuth.Lock()
+	s.mapConn2AuthTimer[c] = t
+	s.lckAuth.Unlock()
+}
+
+func (s *Server) stopAuth(c net.Conn) {
+	s.lckAuth.Lock()
+	t := s.mapConn2AuthTimer[c]
+	delete(s.mapConn2AuthTimer, c)
+	a := s.auth
+	s.lckAuth.Unlock()
+
+	if t != nil {
+		t.Stop()
+	}
+
+	if challenger, ok := a.(AuthChallenger); ok {
+		challenger.Release(c)
+	}
+}
+
+// checkAuth return true if the pack may go on to the services
+func (s *Server) checkAuth(p *sock.SockPack, c net.Conn) bool {
+	a := s.getAuthenticator()
+	if a == nil || s.GetPrincipal(c) != nil {
+		return true
+	}
+
+	s.lckAuth.Lock()
+	isLogin := s.mapLoginCmd[p.Cmd]
+	s.lckAuth.Unlock()
+
+	if !isLogin {
+		s.sendUnauthorized(p, c)
+		return false
+	}
+
+	principal, resp, err := a.Authenticate(p, c)
+	if err == nil && principal == nil {
+		err = ErrAuthFailed
+	}
+
+	if err != nil {
+		s.mgr.GetConnLogger(c).W(LOG_TAG_SERV, "authenticate failed: ", err)
+		if resp != nil {
+			s.Send(resp, c)
+		} else {
+			s.sendUnauthorized(p, c)
+		}
+
+		return false
+	}
+
+	s.mgr.SetPrincipal(c, principal)
+	s.lckAuth.Lock()
+	t := s.mapConn2AuthTimer[c]
+	delete(s.mapConn2AuthTimer, c)
+	s.lckAuth.Unlock()
+
+	if t != nil {
+		t.Stop()
+	}
+
+	if resp != nil {
+		s.Send(resp, c)
+	}
+
+	return false
+}
+
+func (s *Server) sendUnauthorized(p *sock.SockPack, c net.Conn) {
+	resp := sock.GetRespSockPack(p)
+	resp.Cmd = SERV_CMD_UNAUTHORIZED
+	resp.Data = make([]byte, 2)
+	binary.BigEndian.PutUint16(resp.Data, p.Cmd)
+	resp.DataLen = uint16(len(resp.Data))
+	s.Send(resp, c)
+}
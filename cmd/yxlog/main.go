@@ -0,0 +1,218 @@
+// yxlog reads the log files written by util.Logger, in the text or the json format.
+//
+//	yxlog [flags] file...
+//
+// Every file is read with its rotated files (name_YYYYMMDD_HHMMSS.ext[.gz]) in time order,
+// and several files are merged by the time of the lines. With -f the live file is
+// followed across rotations.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+var (
+	flagFollow  = flag.Bool("f", false, "follow the live file after reading it, only one file is allowed")
+	flagSince   = flag.String("since", "", "skip the lines before the time, \"2006-01-02 15:04:05\" or a duration ago such as 1h")
+	flagUntil   = flag.String("until", "", "skip the lines after the time, same format as -since")
+	flagLevel   = flag.String("level", "", "skip the lines below the level: debug, info, warn or error")
+	flagTag     = flag.String("tag", "", "only the tags matching one of the comma separated glob patterns, such as Sock*")
+	flagRotated = flag.Bool("rotated", true, "read the rotated files of the file too")
+	flagSummary = flag.Bool("summary", false, "print the number of lines per tag and level instead of the lines")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: yxlog [flags] file...")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	filter, err := newLogFilter()
+	if err != nil {
+		fail(err)
+	}
+
+	if *flagFollow && (flag.NArg() != 1 || *flagSummary) {
+		fail(fmt.Errorf("-f needs exactly one file and no -summary"))
+	}
+
+	streams := make([]*logStream, 0, flag.NArg())
+	for _, file := range flag.Args() {
+		files := []string{file}
+		if *flagRotated {
+			files, err = getFileWithRotated(file)
+			if err != nil {
+				fail(err)
+			}
+		}
+
+		streams = append(streams, newLogStream(files))
+	}
+
+	out := newLogOutput(filter, *flagSummary)
+	err = mergeStreams(streams, out.writeEntry)
+	if err != nil {
+		fail(err)
+	}
+
+	if *flagSummary {
+		out.printSummary()
+		return
+	}
+
+	if *flagFollow {
+		offset, isLive := streams[0].getLiveOffset(flag.Arg(0))
+		if !isLive {
+			offset = 0
+		}
+
+		err = follow(flag.Arg(0), offset, out, nil)
+		if err != nil {
+			fail(err)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "yxlog:", err)
+	os.Exit(1)
+}
+
+// getFileWithRotated get the rotated files from the oldest, then the file itself
+func getFileWithRotated(file string) ([]string, error) {
+	files, err := util.GetDumpFiles(file)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(file)
+	if err == nil {
+		files = append(files, file)
+	} else if len(files) == 0 {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+type logFilter struct {
+	since    time.Time
+	until    time.Time
+	level    util.LogLv
+	patterns []string
+}
+
+func newLogFilter() (*logFilter, error) {
+	f := &logFilter{
+		level:    util.LOG_LV_DEBUG,
+		patterns: nil,
+	}
+
+	var err error = nil
+	if *flagSince != "" {
+		f.since, err = parseFlagTime(*flagSince)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *flagUntil != "" {
+		f.until, err = parseFlagTime(*flagUntil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *flagLevel != "" {
+		f.level, err = util.ParseLogLv(*flagLevel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *flagTag != "" {
+		for _, pattern := range strings.Split(*flagTag, ",") {
+			_, err = path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("bad tag pattern %s: %v", pattern, err)
+			}
+
+			f.patterns = append(f.patterns, pattern)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *logFilter) match(r *util.LogRecord) bool {
+	if r.Level < f.level {
+		return false
+	}
+
+	if !f.since.IsZero() && r.Time.Before(f.since) {
+		return false
+	}
+
+	if !f.until.IsZero() && r.Time.After(f.until) {
+		return false
+	}
+
+	if len(f.patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.patterns {
+		ok, _ := path.Match(pattern, r.Tag)
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+var flagTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseFlagTime parse a local time, a RFC3339 time or a duration ago
+func parseFlagTime(s string) (time.Time, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		if d > 0 {
+			d = -d
+		}
+
+		return time.Now().Add(d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+
+	for _, layout := range flagTimeLayouts {
+		t, err = time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("bad time: %s", s)
+}
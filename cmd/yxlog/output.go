@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+type tagSummary struct {
+	tag    string
+	counts [4]int
+}
+
+// logOutput print the matched lines, or count them for the summary
+type logOutput struct {
+	w           io.Writer
+	filter      *logFilter
+	summary     bool
+	lastMatched bool
+	mapTag2Sum  map[string]*tagSummary
+	total       int
+	firstTime   time.Time
+	lastTime    time.Time
+}
+
+func newLogOutput(filter *logFilter, summary bool) *logOutput {
+	return &logOutput{
+		w:           os.Stdout,
+		filter:      filter,
+		summary:     summary,
+		lastMatched: false,
+		mapTag2Sum:  make(map[string]*tagSummary),
+		total:       0,
+	}
+}
+
+func (o *logOutput) writeEntry(e *logEntry) {
+	if !o.filter.match(e.rec) {
+		return
+	}
+
+	if o.summary {
+		o.count(e.rec)
+		return
+	}
+
+	for _, line := range e.lines {
+		fmt.Fprintln(o.w, line)
+	}
+}
+
+// writeLine handle a line of the followed file, a line which is not a log
+// goes with the last log
+func (o *logOutput) writeLine(line string) {
+	r, err := util.DecodeLogLine(line)
+	if err == nil {
+		o.lastMatched = o.filter.match(r)
+	}
+
+	if o.lastMatched {
+		fmt.Fprintln(o.w, line)
+	}
+}
+
+func (o *logOutput) count(r *util.LogRecord) {
+	sum, ok := o.mapTag2Sum[r.Tag]
+	if !ok {
+		sum = &tagSummary{tag: r.Tag}
+		o.mapTag2Sum[r.Tag] = sum
+	}
+
+	if r.Level >= util.LOG_LV_DEBUG && r.Level <= util.LOG_LV_ERROR {
+		sum.counts[r.Level]++
+	}
+
+	if o.total == 0 || r.Time.Before(o.firstTime) {
+		o.firstTime = r.Time
+	}
+
+	if o.total == 0 || r.Time.After(o.lastTime) {
+		o.lastTime = r.Time
+	}
+
+	o.total++
+}
+
+// printSummary print the counts per tag, the tags with more errors first
+func (o *logOutput) printSummary() {
+	sums := make([]*tagSummary, 0, len(o.mapTag2Sum))
+	for _, sum := range o.mapTag2Sum {
+		sums = append(sums, sum)
+	}
+
+	sort.Slice(sums, func(i, j int) bool {
+		for lv := util.LOG_LV_ERROR; lv >= util.LOG_LV_DEBUG; lv-- {
+			if sums[i].counts[lv] != sums[j].counts[lv] {
+				return sums[i].counts[lv] > sums[j].counts[lv]
+			}
+		}
+
+		return sums[i].tag < sums[j].tag
+	})
+
+	w := o.w
+	if o.total == 0 {
+		fmt.Fprintln(w, "no logs")
+		return
+	}
+
+	fmt.Fprintf(w, "%d logs from %s to %s\n\n", o.total, o.firstTime.Format(util.LOG_TEXT_TIME_LAYOUT), o.lastTime.Format(util.LOG_TEXT_TIME_LAYOUT))
+	fmt.Fprintf(w, "%-24s %8s %8s %8s %8s\n", "TAG", "ERROR", "WARN", "INFO", "DEBUG")
+	for _, sum := range sums {
+		fmt.Fprintf(w, "%-24s %8d %8d %8d %8d\n", sum.tag, sum.counts[util.LOG_LV_ERROR], sum.counts[util.LOG_LV_WARN], sum.counts[util.LOG_LV_INFO], sum.counts[util.LOG_LV_DEBUG])
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	FOLLOW_POLL_INTV = 250 * time.Millisecond
+)
+
+// logEntry is a log line with the lines following it that are not logs, such as a stack
+type logEntry struct {
+	rec   *util.LogRecord
+	lines []string
+}
+
+// logStream read the entries of the files one by one
+type logStream struct {
+	files   []string
+	idx     int
+	f       *os.File
+	reader  *bufio.Reader
+	closer  io.Closer
+	offset  int64
+	pending *logEntry
+	next    *logEntry
+}
+
+func newLogStream(files []string) *logStream {
+	return &logStream{
+		files:   files,
+		idx:     -1,
+		f:       nil,
+		reader:  nil,
+		closer:  nil,
+		offset:  0,
+		pending: nil,
+		next:    nil,
+	}
+}
+
+// peek get the next entry without taking it, nil at the end
+func (s *logStream) peek() (*logEntry, error) {
+	if s.next != nil {
+		return s.next, nil
+	}
+
+	for {
+		line, err := s.readLine()
+		if err == io.EOF {
+			s.next = s.pending
+			s.pending = nil
+			return s.next, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := util.DecodeLogLine(line)
+		if err != nil {
+			// the lines before the first log are dropped
+			if s.pending != nil {
+				s.pending.lines = append(s.pending.lines, line)
+			}
+
+			continue
+		}
+
+		e := s.pending
+		s.pending = &logEntry{rec: r, lines: []string{line}}
+		if e != nil {
+			s.next = e
+			return e, nil
+		}
+	}
+}
+
+func (s *logStream) take() {
+	s.next = nil
+}
+
+// getLiveOffset get how much of the live file is read, if it is the last file read
+func (s *logStream) getLiveOffset(file string) (int64, bool) {
+	if s.f == nil || s.idx != len(s.files)-1 || s.files[s.idx] != file {
+		return 0, false
+	}
+
+	return s.offset, true
+}
+
+func (s *logStream) readLine() (string, error) {
+	for {
+		if s.reader == nil {
+			err := s.openNext()
+			if err != nil {
+				return "", err
+			}
+		}
+
+		line, err := s.reader.ReadString('\n')
+		s.offset += int64(len(line))
+		if err == nil || (err == io.EOF && line != "") {
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+
+		if err != io.EOF {
+			return "", err
+		}
+
+		s.reader = nil
+	}
+}
+
+// close close the file being read
+func (s *logStream) close() {
+	if s.closer != nil {
+		s.closer.Close()
+		s.closer = nil
+	}
+}
+
+func (s *logStream) openNext() error {
+	s.close()
+
+	if s.idx+1 >= len(s.files) {
+		return io.EOF
+	}
+
+	s.idx++
+	f, err := os.Open(s.files[s.idx])
+	if err != nil {
+		return err
+	}
+
+	s.f = f
+	s.closer = f
+	s.offset = 0
+	s.reader = bufio.NewReader(f)
+	if strings.HasSuffix(s.files[s.idx], ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+
+		s.reader = bufio.NewReader(gz)
+	}
+
+	return nil
+}
+
+// mergeStreams write the entries of all the streams in time order
+func mergeStreams(streams []*logStream, write func(e *logEntry)) error {
+	for {
+		var first *logStream = nil
+		var firstEntry *logEntry = nil
+		for _, s := range streams {
+			e, err := s.peek()
+			if err != nil {
+				return err
+			}
+
+			if e != nil && (firstEntry == nil || e.rec.Time.Before(firstEntry.rec.Time)) {
+				first = s
+				firstEntry = e
+			}
+		}
+
+		if first == nil {
+			return nil
+		}
+
+		first.take()
+		write(firstEntry)
+	}
+}
+
+// follow read the lines appended to the file from the offset, and reopen the file
+// when it is rotated or truncated. It returns when stopEvt is closed, nil stopEvt follows forever
+func follow(file string, offset int64, out *logOutput, stopEvt <-chan bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	// f is replaced when the file rotates, the last one is closed on return
+	defer func() {
+		f.Close()
+	}()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if offset > fi.Size() {
+		offset = 0
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	partial := ""
+	for {
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		partial += line
+		if err == nil {
+			out.writeLine(strings.TrimRight(partial, "\r\n"))
+			partial = ""
+			continue
+		}
+
+		if err != io.EOF {
+			return err
+		}
+
+		newFi, err := os.Stat(file)
+		if err != nil || !os.SameFile(fi, newFi) {
+			// rotated, the old file is read to the end
+			if partial != "" {
+				out.writeLine(partial)
+				partial = ""
+			}
+
+			// the file may be rotated more than once since the last poll
+			fi, err = readRotatedAfter(file, fi, offset, out)
+			if err != nil {
+				return err
+			}
+
+			newF, err := os.Open(file)
+			if err == nil {
+				f.Close()
+				f = newF
+				fi, _ = f.Stat()
+				offset = 0
+				reader.Reset(f)
+				continue
+			}
+		} else if newFi.Size() < offset {
+			// truncated
+			f.Seek(0, io.SeekStart)
+			offset = 0
+			partial = ""
+			reader.Reset(f)
+			continue
+		}
+
+		select {
+		case <-stopEvt:
+			return nil
+
+		case <-time.After(FOLLOW_POLL_INTV):
+		}
+	}
+}
+
+// readRotatedAfter read the rotated files newer than the one read last, size is how much of it was read.
+// Return the info of the last file read
+func readRotatedAfter(file string, last os.FileInfo, size int64, out *logOutput) (os.FileInfo, error) {
+	files, err := util.GetDumpFiles(file)
+	if err != nil {
+		return last, err
+	}
+
+	start := findRotated(files, last, size)
+	for _, f := range files[start:] {
+		s := newLogStream([]string{f})
+		for {
+			line, err := s.readLine()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				s.close()
+				return last, err
+			}
+
+			out.writeLine(line)
+		}
+
+		s.close()
+		fi, err := os.Stat(f)
+		if err == nil {
+			last = fi
+		}
+	}
+
+	return last, nil
+}
+
+// findRotated get the index after the rotated name of the file read last.
+// The file keeps its identity when renamed, but not when it is compressed,
+// then it is the first .gz rotated after its last write with the same uncompressed size.
+// If none matches, the files rotated after its last write are all newer
+func findRotated(files []string, last os.FileInfo, size int64) int {
+	for i, f := range files {
+		fi, err := os.Stat(f)
+		if err == nil && os.SameFile(fi, last) {
+			return i + 1
+		}
+	}
+
+	lastTime := util.FormatFullTime(last.ModTime(), "%s%s%s_%s%s%s")
+	for i, f := range files {
+		if strings.HasSuffix(f, ".gz") && getRotateTime(f) >= lastTime && getGzipSize(f) == uint32(size) {
+			return i + 1
+		}
+	}
+
+	for i, f := range files {
+		if getRotateTime(f) > lastTime {
+			return i
+		}
+	}
+
+	return len(files)
+}
+
+var rotateTimeRegexp = regexp.MustCompile(`_(\d{8}_\d{6})(?:_\d+)?(?:\.[^._]*)?(?:\.gz)?$`)
+
+// getRotateTime get the YYYYMMDD_HHMMSS in the name of a rotated file
+func getRotateTime(file string) string {
+	m := rotateTimeRegexp.FindStringSubmatch(path.Base(file))
+	if m == nil {
+		return ""
+	}
+
+	return m[1]
+}
+
+// getGzipSize get the uncompressed size mod 2^32 kept in the gzip trailer
+func getGzipSize(file string) uint32 {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	buff := make([]byte, 4)
+	fi, err := f.Stat()
+	if err != nil || fi.Size() < 4 {
+		return 0
+	}
+
+	_, err = f.ReadAt(buff, fi.Size()-4)
+	if err != nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(buff)
+}
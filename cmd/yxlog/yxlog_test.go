@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+var testBaseTime = time.Date(2021, 3, 4, 5, 6, 0, 0, time.Local)
+
+// testWriter is a buffer written by the follow goroutine and read by the test
+type testWriter struct {
+	lck  sync.Mutex
+	buff bytes.Buffer
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	return w.buff.Write(p)
+}
+
+func (w *testWriter) String() string {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	return w.buff.String()
+}
+
+func testLogLine(sec int, msg string) string {
+	r := &util.LogRecord{
+		Time:  testBaseTime.Add(time.Duration(sec) * time.Second),
+		Level: util.LOG_LV_INFO,
+		Tag:   "test",
+		Msg:   msg,
+	}
+
+	return strings.TrimRight(string((&util.TextEncoder{}).Encode(r)), "\n") + "\n"
+}
+
+func writeTestFile(t *testing.T, file string, lines ...string) {
+	t.Helper()
+
+	err := ioutil.WriteFile(file, []byte(strings.Join(lines, "")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestOutput(t *testing.T) (*logOutput, *testWriter) {
+	t.Helper()
+
+	filter, err := newLogFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{}
+	out := newLogOutput(filter, false)
+	out.w = w
+	return out, w
+}
+
+// expectMsgs check the msgs appear in order, and nothing else of the form "msg N"
+func expectMsgs(t *testing.T, output string, msgs ...string) {
+	t.Helper()
+
+	got := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if i := strings.Index(line, "msg "); i >= 0 {
+			got = append(got, strings.Fields(line[i:])[0]+" "+strings.Fields(line[i:])[1])
+		} else if strings.HasPrefix(line, "\t") {
+			got = append(got, strings.TrimSpace(line))
+		}
+	}
+
+	if strings.Join(got, ",") != strings.Join(msgs, ",") {
+		t.Fatal("wrong lines:", got, "expect", msgs)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	a := path.Join(dir, "a.log")
+	writeTestFile(t, path.Join(dir, "a_20210304_050600.log"), testLogLine(0, "msg 0"), testLogLine(2, "msg 2"))
+	writeTestFile(t, path.Join(dir, "a_20210304_050610.log"), testLogLine(4, "msg 4"))
+	if err := util.GzipFile(path.Join(dir, "a_20210304_050610.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, a, testLogLine(6, "msg 6"))
+
+	// the sibling log is not a rotated file of a.log
+	writeTestFile(t, path.Join(dir, "a_access.log"), testLogLine(1, "msg access"))
+
+	// the stack line goes with the log before it
+	b := path.Join(dir, "b.log")
+	writeTestFile(t, b, testLogLine(1, "msg 1"), testLogLine(3, "msg 3"), "\tstack\n", testLogLine(5, "msg 5"))
+
+	streams := make([]*logStream, 0)
+	for _, file := range []string{a, b} {
+		files, err := getFileWithRotated(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		streams = append(streams, newLogStream(files))
+	}
+
+	out, w := newTestOutput(t)
+	if err := mergeStreams(streams, out.writeEntry); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMsgs(t, w.String(), "msg 0", "msg 1", "msg 2", "msg 3", "stack", "msg 4", "msg 5", "msg 6")
+	if offset, ok := streams[0].getLiveOffset(a); !ok || offset != int64(len(testLogLine(6, "msg 6"))) {
+		t.Fatal("wrong live offset:", offset, ok)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "f.log")
+	line0 := testLogLine(0, "msg 0")
+	writeTestFile(t, file, line0)
+
+	out, w := newTestOutput(t)
+	stopEvt := make(chan bool)
+	errEvt := make(chan error, 1)
+	go func() {
+		errEvt <- follow(file, int64(len(line0)), out, stopEvt)
+	}()
+
+	waitMsgs := func(msgs ...string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(w.String(), msgs[len(msgs)-1]) {
+			if time.Now().After(deadline) {
+				t.Fatal("lines not followed:", w.String())
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		expectMsgs(t, w.String(), msgs...)
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString(testLogLine(1, "msg 1"))
+	f.Close()
+	waitMsgs("msg 1")
+
+	// rotated twice between two polls, and the first rotated file is compressed
+	rotated := path.Join(dir, "f"+util.FormatFullTime(time.Now(), "_%s%s%s_%s%s%s"))
+	if err := os.Rename(file, rotated+".log"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := util.GzipFile(rotated + ".log"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, file, testLogLine(2, "msg 2"))
+	if err := os.Rename(file, rotated+"_1.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, file, testLogLine(3, "msg 3"))
+	waitMsgs("msg 1", "msg 2", "msg 3")
+
+	close(stopEvt)
+	if err := <-errEvt; err != nil {
+		t.Fatal("follow error:", err)
+	}
+}
@@ -0,0 +1,192 @@
+package yxlib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/wuyiyinxia/yxlib/sock"
+)
+
+const (
+	ID_SEG_MOD            uint16 = 0xFE   // the mod of the service
+	ID_SEG_CLIENT_MOD     uint16 = 0xFD   // the mod of the client getting the respones
+	ID_SEG_CMD_LEASE      uint16 = 0xFE01 // reqId(4) + tagLen(1) + tag
+	ID_SEG_CMD_LEASE_RESP uint16 = 0xFE02 // reqId(4) + code(1) + start(8) + end(8), the ids are in [start, end)
+	ID_SEG_DEFAULT_STEP   uint64 = 1000
+)
+
+const (
+	ID_SEG_CODE_OK       uint8 = 0
+	ID_SEG_CODE_BAD_REQ  uint8 = 1
+	ID_SEG_CODE_OVERFLOW uint8 = 2
+	ID_SEG_CODE_SAVE     uint8 = 3
+)
+
+var (
+	ErrIdSegBadPack  error = errors.New("bad id segment pack")
+	ErrIdSegOverflow error = errors.New("id segment overflow")
+)
+
+// IdSegService lease the segments of ids to the clients by tag.
+// The next id of every tag is saved to the file before a segment is sent,
+// so the ids are never leased twice even if the host restarts
+type IdSegService struct {
+	serv        *Server
+	file        string
+	lck         sync.Mutex
+	defaultStep uint64
+	mapTag2Step map[string]uint64
+	mapTag2Next map[string]uint64
+}
+
+// NewIdSegService load the saved next ids from the file, a missing file means a new service
+func NewIdSegService(serv *Server, file string, defaultStep uint64) (*IdSegService, error) {
+	if defaultStep == 0 {
+		defaultStep = ID_SEG_DEFAULT_STEP
+	}
+
+	s := &IdSegService{
+		serv:        serv,
+		file:        file,
+		defaultStep: defaultStep,
+		mapTag2Step: make(map[string]uint64),
+		mapTag2Next: make(map[string]uint64),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		err = json.Unmarshal(data, &s.mapTag2Next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Register route the lease cmd to the service on its server
+func (s *IdSegService) Register() error {
+	s.serv.AddCmdRange(ID_SEG_CMD_LEASE, ID_SEG_CMD_LEASE, ID_SEG_MOD)
+	return s.serv.AddService(ID_SEG_MOD, s)
+}
+
+// SetStep set the size of the segments of the tag
+func (s *IdSegService) SetStep(tag string, step uint64) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.mapTag2Step[tag] = step
+}
+
+// Lease get the next segment [start, end) of the tag, the ids begin with 1
+func (s *IdSegService) Lease(tag string) (uint64, uint64, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	step, ok := s.mapTag2Step[tag]
+	if !ok || step == 0 {
+		step = s.defaultStep
+	}
+
+	start, ok := s.mapTag2Next[tag]
+	if !ok {
+		start = 1
+	}
+
+	end := start + step
+	if end < start {
+		return 0, 0, ErrIdSegOverflow
+	}
+
+	s.mapTag2Next[tag] = end
+	err := s.save()
+	if err != nil {
+		s.mapTag2Next[tag] = start
+		return 0, 0, err
+	}
+
+	return start, end, nil
+}
+
+func (s *IdSegService) OnHandlePack(p *sock.SockPack, c net.Conn) error {
+	if p.Cmd != ID_SEG_CMD_LEASE {
+		return ErrCmdNotFound
+	}
+
+	if len(p.Data) < 4 {
+		return ErrIdSegBadPack
+	}
+
+	reqId := binary.BigEndian.Uint32(p.Data)
+	if len(p.Data) < 5 || len(p.Data) < 5+int(p.Data[4]) {
+		s.sendLeaseResp(p, c, reqId, ID_SEG_CODE_BAD_REQ, 0, 0)
+		return ErrIdSegBadPack
+	}
+
+	tag := string(p.Data[5 : 5+int(p.Data[4])])
+	code := ID_SEG_CODE_OK
+	start, end, err := s.Lease(tag)
+	if err == ErrIdSegOverflow {
+		code = ID_SEG_CODE_OVERFLOW
+	} else if err != nil {
+		code = ID_SEG_CODE_SAVE
+	}
+
+	sendErr := s.sendLeaseResp(p, c, reqId, code, start, end)
+	if err != nil {
+		return err
+	}
+
+	return sendErr
+}
+
+func (s *IdSegService) sendLeaseResp(p *sock.SockPack, c net.Conn, reqId uint32, code uint8, start uint64, end uint64) error {
+	resp := sock.GetRespSockPack(p)
+	resp.Cmd = ID_SEG_CMD_LEASE_RESP
+	resp.Data = make([]byte, 21)
+	binary.BigEndian.PutUint32(resp.Data, reqId)
+	resp.Data[4] = code
+	binary.BigEndian.PutUint64(resp.Data[5:], start)
+	binary.BigEndian.PutUint64(resp.Data[13:], end)
+	return s.serv.Send(resp, c)
+}
+
+// save write to a temp file then rename it, so the file is never half written
+func (s *IdSegService) save() error {
+	data, err := json.Marshal(s.mapTag2Next)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, s.file)
+}
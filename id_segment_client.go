@@ -0,0 +1,259 @@
+package yxlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/sock"
+)
+
+const (
+	LOG_TAG_ID_SEG = "IdSegClient"
+)
+
+const (
+	ID_SEG_LEASE_TIMEOUT    = 3 * time.Second
+	ID_SEG_PREFETCH_PERCENT = 20
+)
+
+var (
+	ErrIdSegTimeout  error = errors.New("lease id segment timeout")
+	ErrIdSegRejected error = errors.New("lease id segment rejected")
+	ErrIdSegTagLen   error = errors.New("id segment tag too long")
+)
+
+type idSegment struct {
+	next uint64
+	end  uint64
+}
+
+func (seg *idSegment) remain() uint64 {
+	if seg.next >= seg.end {
+		return 0
+	}
+
+	return seg.end - seg.next
+}
+
+type idSegLeaseResult struct {
+	seg idSegment
+	err error
+}
+
+// idSegBuffer hold the segment in use and the one fetched ahead
+type idSegBuffer struct {
+	cur      idSegment
+	next     idSegment
+	step     uint64
+	loading  bool
+	loadDone chan bool // closed when the loading ends
+	loadErr  error
+}
+
+// IdSegClient get the ids from an IdSegService on another endpoint.
+// It keeps two segments per tag: when the current one is used up to the prefetch line,
+// the next one is fetched in the background, so NextId seldom waits for the network
+type IdSegClient struct {
+	serv       *Server
+	conn       net.Conn
+	dstEnd     uint8
+	dstNo      uint16
+	timeout    time.Duration
+	lastReqId  uint32
+	lckReq     sync.Mutex
+	mapReq     map[uint32]chan *idSegLeaseResult
+	lckBuff    sync.Mutex
+	mapTag2Buf map[string]*idSegBuffer
+}
+
+func NewIdSegClient(serv *Server, conn net.Conn, dstEnd uint8, dstNo uint16) *IdSegClient {
+	return &IdSegClient{
+		serv:       serv,
+		conn:       conn,
+		dstEnd:     dstEnd,
+		dstNo:      dstNo,
+		timeout:    ID_SEG_LEASE_TIMEOUT,
+		lastReqId:  0,
+		mapReq:     make(map[uint32]chan *idSegLeaseResult),
+		mapTag2Buf: make(map[string]*idSegBuffer),
+	}
+}
+
+// Register route the lease respones to the client on its server
+func (c *IdSegClient) Register() error {
+	c.serv.AddCmdRange(ID_SEG_CMD_LEASE_RESP, ID_SEG_CMD_LEASE_RESP, ID_SEG_CLIENT_MOD)
+	return c.serv.AddService(ID_SEG_CLIENT_MOD, c)
+}
+
+// SetTimeout set how long a lease waits for the respone
+func (c *IdSegClient) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// NextId get the next id of the tag.
+// It waits for the network when no segment is left, and the respone is handled on
+// the manager loop if the server has no dispatcher. So without a dispatcher it must not
+// be called from a handler or a timer on the loop, the loop would be blocked until the timeout
+func (c *IdSegClient) NextId(tag string) (uint64, error) {
+	if len(tag) > 0xFF {
+		return 0, ErrIdSegTagLen
+	}
+
+	c.lckBuff.Lock()
+	defer c.lckBuff.Unlock()
+
+	buf, ok := c.mapTag2Buf[tag]
+	if !ok {
+		buf = &idSegBuffer{}
+		c.mapTag2Buf[tag] = buf
+	}
+
+	for buf.cur.remain() == 0 {
+		if buf.next.remain() > 0 {
+			buf.cur = buf.next
+			buf.next = idSegment{}
+			break
+		}
+
+		if !buf.loading {
+			c.startLoad(tag, buf)
+		}
+
+		// wait for the loading without holding the lock
+		done := buf.loadDone
+		c.lckBuff.Unlock()
+		<-done
+		c.lckBuff.Lock()
+
+		if buf.next.remain() == 0 && buf.cur.remain() == 0 && buf.loadErr != nil {
+			return 0, buf.loadErr
+		}
+	}
+
+	id := buf.cur.next
+	buf.cur.next++
+
+	if !buf.loading && buf.next.remain() == 0 && buf.cur.remain()*100 <= buf.step*ID_SEG_PREFETCH_PERCENT {
+		c.startLoad(tag, buf)
+	}
+
+	return id, nil
+}
+
+// startLoad fetch a segment into the next slot in the background, the lock must be held
+func (c *IdSegClient) startLoad(tag string, buf *idSegBuffer) {
+	buf.loading = true
+	buf.loadDone = make(chan bool)
+	buf.loadErr = nil
+
+	go func(done chan bool) {
+		seg, err := c.lease(tag)
+
+		c.lckBuff.Lock()
+		if err == nil {
+			buf.next = seg
+			buf.step = seg.end - seg.next
+		}
+
+		buf.loadErr = err
+		buf.loading = false
+		c.lckBuff.Unlock()
+
+		close(done)
+	}(buf.loadDone)
+}
+
+func (c *IdSegClient) lease(tag string) (idSegment, error) {
+	reqId := atomic.AddUint32(&c.lastReqId, 1)
+	ch := make(chan *idSegLeaseResult, 1)
+
+	c.lckReq.Lock()
+	c.mapReq[reqId] = ch
+	c.lckReq.Unlock()
+
+	defer func() {
+		c.lckReq.Lock()
+		delete(c.mapReq, reqId)
+		c.lckReq.Unlock()
+	}()
+
+	p := sock.NewReqSockPack(ID_SEG_CMD_LEASE, c.serv.endType, c.serv.endNo, c.dstEnd, c.dstNo)
+	p.Data = make([]byte, 5+len(tag))
+	binary.BigEndian.PutUint32(p.Data, reqId)
+	p.Data[4] = uint8(len(tag))
+	copy(p.Data[5:], tag)
+
+	err := c.serv.Send(p, c.conn)
+	if err != nil {
+		return idSegment{}, err
+	}
+
+	t := c.serv.GetClock().NewTimer(c.timeout)
+	defer t.Stop()
+
+	select {
+	case r := <-ch:
+		return r.seg, r.err
+
+	case <-t.C():
+	}
+
+	// the respone may come between the timeout and the removal
+	c.lckReq.Lock()
+	delete(c.mapReq, reqId)
+	c.lckReq.Unlock()
+
+	select {
+	case r := <-ch:
+		return r.seg, r.err
+
+	default:
+		return idSegment{}, ErrIdSegTimeout
+	}
+}
+
+func (c *IdSegClient) OnHandlePack(p *sock.SockPack, conn net.Conn) error {
+	if p.Cmd != ID_SEG_CMD_LEASE_RESP {
+		return ErrCmdNotFound
+	}
+
+	if len(p.Data) < 21 {
+		return ErrIdSegBadPack
+	}
+
+	reqId := binary.BigEndian.Uint32(p.Data)
+	r := &idSegLeaseResult{
+		seg: idSegment{
+			next: binary.BigEndian.Uint64(p.Data[5:]),
+			end:  binary.BigEndian.Uint64(p.Data[13:]),
+		},
+		err: nil,
+	}
+
+	if p.Data[4] != ID_SEG_CODE_OK {
+		r.err = ErrIdSegRejected
+	}
+
+	c.lckReq.Lock()
+	ch := c.mapReq[reqId]
+	if ch != nil {
+		// a duplicate respone is dropped
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+
+	c.lckReq.Unlock()
+
+	// the lease is timeout already, the segment is saved by the service and never leased again
+	if ch == nil && r.err == nil {
+		c.serv.GetLogger().W(LOG_TAG_ID_SEG, "id segment lost after the lease timeout: [", r.seg.next, ", ", r.seg.end, ")")
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TEXT_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// WriteText write the metrics in the prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.Snapshot() {
+		bw.WriteString("# HELP " + f.Name + " " + escapeHelp(f.Help) + "\n")
+		bw.WriteString("# TYPE " + f.Name + " " + f.Type + "\n")
+
+		for _, s := range f.Samples {
+			if f.Type != METRIC_TYPE_HISTOGRAM {
+				writeLine(bw, f.Name, s.Labels, "", "", s.Value)
+				continue
+			}
+
+			for _, b := range s.Buckets {
+				writeLine(bw, f.Name+"_bucket", s.Labels, "le", formatFloat(b.UpperBound), float64(b.Count))
+			}
+
+			writeLine(bw, f.Name+"_sum", s.Labels, "", "", s.Sum)
+			writeLine(bw, f.Name+"_count", s.Labels, "", "", float64(s.Count))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Handler serve the metrics of the registry
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", TEXT_CONTENT_TYPE)
+		r.WriteText(w)
+	})
+}
+
+func writeLine(w *bufio.Writer, name string, labels map[string]string, extraName string, extraValue string, value float64) {
+	w.WriteString(name)
+
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names)+1)
+	for _, k := range names {
+		pairs = append(pairs, k+"=\""+escapeLabel(labels[k])+"\"")
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+escapeLabel(extraValue)+"\"")
+	}
+
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	return strings.ReplaceAll(s, "\n", "\\n")
+}
+
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	return strings.ReplaceAll(s, "\n", "\\n")
+}
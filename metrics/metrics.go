@@ -0,0 +1,306 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	METRIC_TYPE_COUNTER   = "counter"
+	METRIC_TYPE_GAUGE     = "gauge"
+	METRIC_TYPE_HISTOGRAM = "histogram"
+)
+
+const labelSep = "\xff"
+
+var (
+	DefBuckets   = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	BytesBuckets = []float64{16, 64, 256, 1024, 4096, 16384, 65536}
+)
+
+type Bucket struct {
+	UpperBound float64
+	Count      uint64 // cumulative
+}
+
+// Sample is one labeled value of a metric,
+// Count, Sum and Buckets are only used by histograms
+type Sample struct {
+	Labels  map[string]string
+	Value   float64
+	Count   uint64
+	Sum     float64
+	Buckets []Bucket
+}
+
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+type Collector interface {
+	GetName() string
+	Collect() Family
+}
+
+//===============================
+//           value
+//===============================
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		val := math.Float64frombits(old) + v
+		if atomic.CompareAndSwapUint64(&f.bits, old, math.Float64bits(val)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+type Counter struct {
+	val atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.val.Add(1)
+}
+
+// Add increase the counter, a negative value is ignored
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+
+	c.val.Add(v)
+}
+
+func (c *Counter) Get() float64 {
+	return c.val.Get()
+}
+
+type Gauge struct {
+	val atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.val.Set(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.val.Add(v)
+}
+
+func (g *Gauge) Inc() {
+	g.val.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.val.Add(-1)
+}
+
+func (g *Gauge) Get() float64 {
+	return g.val.Get()
+}
+
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64 // not cumulative, the last one is +Inf
+	count       uint64
+	sum         atomicFloat
+}
+
+func newHistogram(upperBounds []float64) *Histogram {
+	return &Histogram{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	h.sum.Add(v)
+}
+
+func (h *Histogram) fill(s *Sample) {
+	s.Count = atomic.LoadUint64(&h.count)
+	s.Sum = h.sum.Get()
+	s.Buckets = make([]Bucket, 0, len(h.counts))
+	var total uint64 = 0
+	for i, bound := range h.upperBounds {
+		total += atomic.LoadUint64(&h.counts[i])
+		s.Buckets = append(s.Buckets, Bucket{UpperBound: bound, Count: total})
+	}
+
+	total += atomic.LoadUint64(&h.counts[len(h.upperBounds)])
+	s.Buckets = append(s.Buckets, Bucket{UpperBound: math.Inf(1), Count: total})
+}
+
+//===============================
+//           vec
+//===============================
+type vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	lck        sync.RWMutex
+	mapChild   map[string]interface{}
+	newChild   func() interface{}
+}
+
+func newVec(name string, help string, typ string, labelNames []string, newChild func() interface{}) *vec {
+	return &vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		mapChild:   make(map[string]interface{}),
+		newChild:   newChild,
+	}
+}
+
+// with get the child of the label values, the missing values are empty
+func (v *vec) with(labelValues []string) interface{} {
+	key := strings.Join(labelValues, labelSep)
+	v.lck.RLock()
+	child := v.mapChild[key]
+	v.lck.RUnlock()
+
+	if child != nil {
+		return child
+	}
+
+	v.lck.Lock()
+	defer v.lck.Unlock()
+
+	child = v.mapChild[key]
+	if child == nil {
+		child = v.newChild()
+		v.mapChild[key] = child
+	}
+
+	return child
+}
+
+func (v *vec) GetName() string {
+	return v.name
+}
+
+func (v *vec) Collect() Family {
+	f := Family{
+		Name:    v.name,
+		Help:    v.help,
+		Type:    v.typ,
+		Samples: make([]Sample, 0),
+	}
+
+	v.lck.RLock()
+	keys := make([]string, 0, len(v.mapChild))
+	for key := range v.mapChild {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := Sample{
+			Labels: v.makeLabels(key),
+		}
+
+		switch child := v.mapChild[key].(type) {
+		case *Counter:
+			s.Value = child.Get()
+		case *Gauge:
+			s.Value = child.Get()
+		case *Histogram:
+			child.fill(&s)
+		}
+
+		f.Samples = append(f.Samples, s)
+	}
+	v.lck.RUnlock()
+
+	return f
+}
+
+func (v *vec) makeLabels(key string) map[string]string {
+	labels := make(map[string]string)
+	if len(v.labelNames) == 0 {
+		return labels
+	}
+
+	values := strings.Split(key, labelSep)
+	for i, name := range v.labelNames {
+		if i < len(values) {
+			labels[name] = values[i]
+		} else {
+			labels[name] = ""
+		}
+	}
+
+	return labels
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.with(labelValues).(*Counter)
+}
+
+type GaugeVec struct {
+	*vec
+}
+
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return v.with(labelValues).(*Gauge)
+}
+
+type HistogramVec struct {
+	*vec
+}
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.with(labelValues).(*Histogram)
+}
+
+// ValueFunc get its value when collected
+type ValueFunc struct {
+	name string
+	help string
+	typ  string
+	f    func() float64
+}
+
+func (v *ValueFunc) GetName() string {
+	return v.name
+}
+
+func (v *ValueFunc) Collect() Family {
+	return Family{
+		Name: v.name,
+		Help: v.help,
+		Type: v.typ,
+		Samples: []Sample{
+			{Labels: map[string]string{}, Value: v.f()},
+		},
+	}
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestText(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_packs_total", "packs", "cmd").With("1").Add(3)
+	r.NewGaugeFunc("test_depth", "depth", func() float64 { return 7 })
+	h := r.NewHistogram("test_seconds", "cost", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buff bytes.Buffer
+	r.WriteText(&buff)
+	text := buff.String()
+
+	expects := []string{
+		"# TYPE test_packs_total counter\ntest_packs_total{cmd=\"1\"} 3\n",
+		"test_depth 7\n",
+		"test_seconds_bucket{le=\"0.1\"} 1\n",
+		"test_seconds_bucket{le=\"1\"} 2\n",
+		"test_seconds_bucket{le=\"+Inf\"} 3\n",
+		"test_seconds_sum 5.55\n",
+		"test_seconds_count 3\n",
+	}
+
+	for _, expect := range expects {
+		if !strings.Contains(text, expect) {
+			t.Fatal("missing:", expect, "\n", text)
+		}
+	}
+}
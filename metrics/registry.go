@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+type Registry struct {
+	lck          sync.RWMutex
+	mapCollector map[string]Collector
+}
+
+// DefaultRegistry holds the metrics of the library
+var DefaultRegistry *Registry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mapCollector: make(map[string]Collector),
+	}
+}
+
+// Register add the collector, the one with the same name is replaced
+func (r *Registry) Register(c Collector) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	r.mapCollector[c.GetName()] = c
+}
+
+func (r *Registry) Unregister(name string) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	delete(r.mapCollector, name)
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{newVec(name, help, METRIC_TYPE_COUNTER, labelNames, func() interface{} {
+		return &Counter{}
+	})}
+
+	r.Register(v)
+	return v
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	v := &GaugeVec{newVec(name, help, METRIC_TYPE_GAUGE, labelNames, func() interface{} {
+		return &Gauge{}
+	})}
+
+	r.Register(v)
+	return v
+}
+
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// NewHistogramVec create a histogram, a nil upperBounds uses DefBuckets
+func (r *Registry) NewHistogramVec(name string, help string, upperBounds []float64, labelNames ...string) *HistogramVec {
+	if upperBounds == nil {
+		upperBounds = DefBuckets
+	}
+
+	bounds := make([]float64, len(upperBounds))
+	copy(bounds, upperBounds)
+	sort.Float64s(bounds)
+
+	v := &HistogramVec{newVec(name, help, METRIC_TYPE_HISTOGRAM, labelNames, func() interface{} {
+		return newHistogram(bounds)
+	})}
+
+	r.Register(v)
+	return v
+}
+
+func (r *Registry) NewHistogram(name string, help string, upperBounds []float64) *Histogram {
+	return r.NewHistogramVec(name, help, upperBounds).With()
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, f func() float64) *ValueFunc {
+	return r.newValueFunc(name, help, METRIC_TYPE_GAUGE, f)
+}
+
+// NewCounterFunc expose a counter kept elsewhere, f must never decrease
+func (r *Registry) NewCounterFunc(name string, help string, f func() float64) *ValueFunc {
+	return r.newValueFunc(name, help, METRIC_TYPE_COUNTER, f)
+}
+
+func (r *Registry) newValueFunc(name string, help string, typ string, f func() float64) *ValueFunc {
+	v := &ValueFunc{
+		name: name,
+		help: help,
+		typ:  typ,
+		f:    f,
+	}
+
+	r.Register(v)
+	return v
+}
+
+// Snapshot collect all the metrics, sorted by name
+func (r *Registry) Snapshot() []Family {
+	r.lck.RLock()
+	collectors := make([]Collector, 0, len(r.mapCollector))
+	for _, c := range r.mapCollector {
+		collectors = append(collectors, c)
+	}
+	r.lck.RUnlock()
+
+	families := make([]Family, 0, len(collectors))
+	for _, c := range collectors {
+		families = append(families, c.Collect())
+	}
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+
+	return families
+}
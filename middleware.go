@@ -0,0 +1,59 @@
+package yxlib
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+
+	"github.com/wuyiyinxia/yxlib/sock"
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	LOG_TAG_MW = "Middleware"
+)
+
+// PackHandler handle a pack of a mod
+type PackHandler func(p *sock.SockPack, c net.Conn) error
+
+// Middleware wrap the handler of a mod.
+// It may inspect or modify the pack before calling next, skip next to short-circuit
+// (sending its own respone with Server.Send), and observe the error returned by next
+type Middleware func(mod uint16, next PackHandler) PackHandler
+
+// RecoverMiddleware turn a panic of the handler into an error, and log it to the conn logger.
+// Use it as s.Use(s.RecoverMiddleware)
+func (s *Server) RecoverMiddleware(mod uint16, next PackHandler) PackHandler {
+	return func(p *sock.SockPack, c net.Conn) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				s.getPackLogger(p, c).E(LOG_TAG_MW, "handler panic, mod: ", mod, ", cmd: ", p.Cmd, ", ", r, "\n", string(debug.Stack()))
+				err = fmt.Errorf("handler panic: %v", r)
+			}
+		}()
+
+		return next(p, c)
+	}
+}
+
+// LogMiddleware log the cost and the error of every pack to the conn logger.
+// Use it as s.Use(s.LogMiddleware)
+func (s *Server) LogMiddleware(mod uint16, next PackHandler) PackHandler {
+	return func(p *sock.SockPack, c net.Conn) error {
+		start := s.GetClock().Now()
+		err := next(p, c)
+		cost := s.GetClock().Since(start)
+		if err != nil {
+			s.getPackLogger(p, c).W(LOG_TAG_MW, "mod: ", mod, ", cmd: ", p.Cmd, ", cost: ", cost, ", error: ", err)
+		} else {
+			s.getPackLogger(p, c).D(LOG_TAG_MW, "mod: ", mod, ", cmd: ", p.Cmd, ", cost: ", cost)
+		}
+
+		return err
+	}
+}
+
+// getPackLogger get the conn logger carrying the trace of the pack
+func (s *Server) getPackLogger(p *sock.SockPack, c net.Conn) util.ILogger {
+	return s.mgr.GetPackLogger(p, c)
+}
@@ -0,0 +1,136 @@
+package yxlib
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/wuyiyinxia/yxlib/sock"
+)
+
+const (
+	SERV_CMD_NOT_FOUND uint16 = 0xFFFF
+)
+
+// CmdMapper map a cmd to the mod of its service
+type CmdMapper func(cmd uint16) (uint16, bool)
+
+// CmdHighByteMapper use the high byte of the cmd as the mod
+func CmdHighByteMapper(cmd uint16) (uint16, bool) {
+	return cmd >> 8, true
+}
+
+type cmdRange struct {
+	min uint16
+	max uint16
+	mod uint16
+}
+
+// SetCmdMapper set the mapper used when no cmd range matches,
+// CmdHighByteMapper by default, nil routes only the cmds in the ranges
+func (s *Server) SetCmdMapper(mapper CmdMapper) {
+	s.lckServ.Lock()
+	defer s.lckServ.Unlock()
+
+	s.cmdMapper = mapper
+}
+
+// AddCmdRange route the cmds in [min, max] to the mod,
+// the ranges are checked in the adding order before the cmd mapper
+func (s *Server) AddCmdRange(min uint16, max uint16, mod uint16) {
+	s.lckServ.Lock()
+	defer s.lckServ.Unlock()
+
+	s.cmdRanges = append(s.cmdRanges, cmdRange{
+		min: min,
+		max: max,
+		mod: mod,
+	})
+}
+
+// SetNotFoundHandler replace the default handler of the unknown cmds,
+// which responds a SERV_CMD_NOT_FOUND pack carrying the unknown cmd
+func (s *Server) SetNotFoundHandler(h PackHandler) {
+	s.lckServ.Lock()
+	defer s.lckServ.Unlock()
+
+	s.notFoundHandler = h
+}
+
+// GetCmdMod get the mod a cmd is routed to
+func (s *Server) GetCmdMod(cmd uint16) (uint16, bool) {
+	s.lckServ.RLock()
+	defer s.lckServ.RUnlock()
+
+	for _, r := range s.cmdRanges {
+		if cmd >= r.min && cmd <= r.max {
+			return r.mod, true
+		}
+	}
+
+	if s.cmdMapper != nil {
+		return s.cmdMapper(cmd)
+	}
+
+	return 0, false
+}
+
+// isKnownCmd return true if the cmd is routed to a service which can handle it,
+// only these cmds get their own label in the inbound metrics
+func (s *Server) isKnownCmd(cmd uint16) bool {
+	mod, ok := s.GetCmdMod(cmd)
+	if !ok {
+		return false
+	}
+
+	s.lckServ.RLock()
+	serv := s.mapMod2Serv[mod]
+	s.lckServ.RUnlock()
+
+	if cmdServ, ok := serv.(*CmdService); ok {
+		return cmdServ.HasHandler(cmd)
+	}
+
+	return serv != nil
+}
+
+// Dispatch route the pack to the service by its cmd.
+// The unknown cmds are passed to the not found handler and ErrCmdNotFound is returned
+func (s *Server) Dispatch(p *sock.SockPack, c net.Conn) error {
+	mod, ok := s.GetCmdMod(p.Cmd)
+	if !ok || !s.hasService(mod) {
+		s.handleNotFound(p, c)
+		return ErrCmdNotFound
+	}
+
+	err := s.HandlePack(p, c, mod)
+	if err == ErrCmdNotFound {
+		s.handleNotFound(p, c)
+	}
+
+	return err
+}
+
+func (s *Server) hasService(mod uint16) bool {
+	s.lckServ.RLock()
+	defer s.lckServ.RUnlock()
+
+	return s.mapMod2Serv[mod] != nil
+}
+
+func (s *Server) handleNotFound(p *sock.SockPack, c net.Conn) {
+	s.lckServ.RLock()
+	h := s.notFoundHandler
+	s.lckServ.RUnlock()
+
+	if h != nil {
+		h(p, c)
+		return
+	}
+
+	resp := sock.GetRespSockPack(p)
+	resp.Cmd = SERV_CMD_NOT_FOUND
+	resp.Data = make([]byte, 2)
+	binary.BigEndian.PutUint16(resp.Data, p.Cmd)
+	resp.DataLen = uint16(len(resp.Data))
+	s.Send(resp, c)
+}
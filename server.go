@@ -1,47 +1,342 @@
 package yxlib
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/wuyiyinxia/yxlib/metrics"
 	"github.com/wuyiyinxia/yxlib/sock"
+	"github.com/wuyiyinxia/yxlib/trace"
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	LOG_TAG_SERV = "Server"
 )
 
 type Server struct {
-	mgr         *sock.SockMgr
-	serv        *sock.SockServ
-	client      *sock.SockClient
-	mapMod2Serv map[uint16]Service
+	endType           uint8
+	endNo             uint16
+	mgr               *sock.SockMgr
+	serv              *sock.SockServ
+	client            *sock.SockClient
+	lckServ           sync.RWMutex
+	mapMod2Serv       map[uint16]Service
+	middlewares       []Middleware
+	mapMod2Mw         map[uint16][]Middleware
+	mapMod2Handler    map[uint16]PackHandler
+	cmdMapper         CmdMapper
+	cmdRanges         []cmdRange
+	notFoundHandler   PackHandler
+	listener          sock.SockListener
+	lckAuth           sync.Mutex
+	auth              Authenticator
+	authTimeout       time.Duration
+	mapLoginCmd       map[uint16]bool
+	mapConn2AuthTimer map[net.Conn]util.ClockTimer
+	admin             *http.Server
+	adminToken        string
+	spanExporter      trace.SpanExporter
+	wheel             *util.TimingWheel
+	lckSnowflake      sync.Mutex
+	snowflakeLayout   util.SnowflakeLayout
+	snowflake         *util.Snowflake
+	stopped           int32 // 1 after Stop or Shutdown
 }
 
+var (
+	ErrNoService     error = errors.New("no service for this mod")
+	ErrServerStopped error = errors.New("server stopped")
+	ErrSnowflakeMade error = errors.New("snowflake already made")
+)
+
 var CurServ *Server = nil
 
 func NewServer(endType uint8, endNo uint16) *Server {
 	s := &Server{
-		mgr:         nil,
-		serv:        nil,
-		client:      nil,
-		mapMod2Serv: make(map[uint16]Service),
+		endType:           endType,
+		endNo:             endNo,
+		mgr:               nil,
+		serv:              nil,
+		client:            nil,
+		mapMod2Serv:       make(map[uint16]Service),
+		middlewares:       make([]Middleware, 0),
+		mapMod2Mw:         make(map[uint16][]Middleware),
+		mapMod2Handler:    make(map[uint16]PackHandler),
+		cmdMapper:         CmdHighByteMapper,
+		cmdRanges:         make([]cmdRange, 0),
+		notFoundHandler:   nil,
+		listener:          nil,
+		auth:              nil,
+		authTimeout:       0,
+		mapLoginCmd:       make(map[uint16]bool),
+		mapConn2AuthTimer: make(map[net.Conn]util.ClockTimer),
+		admin:             nil,
+		adminToken:        "",
+		spanExporter:      nil,
+		wheel:             util.NewTimingWheel(SERV_TIMER_TICK),
+		snowflakeLayout:   util.GetDefaultSnowflakeLayout(),
+		snowflake:         nil,
+		stopped:           0,
 	}
 
 	s.mgr = sock.NewSockMgr(endType, endNo)
+	s.mgr.SetListener(s)
+	s.mgr.SetMetricCmdFilter(s.isKnownCmd)
+	s.mgr.RegisterMetrics(metrics.DefaultRegistry)
 	s.serv = sock.NewSockServ(s.mgr)
 	s.client = sock.NewSockClient(s.mgr)
 	CurServ = s
 	return s
 }
 
+// SetLogger write the logs of the server, the sock manager and the conns to l,
+// util.Logger by default. It should be set before Start
+func (s *Server) SetLogger(l util.ILogger) {
+	s.mgr.SetLogger(l)
+}
+
+func (s *Server) GetLogger() util.ILogger {
+	return s.mgr.GetLogger()
+}
+
+// SetClock set the clock of the sock manager, the timers and the auth timeout,
+// it must be set before Start
+func (s *Server) SetClock(c util.Clock) {
+	s.mgr.SetClock(c)
+	s.wheel.SetClock(c)
+}
+
+// SetCrashHandler write a crash file when a panic happens on the manager loop,
+// the dispatcher workers or the timer goroutine. It must be set before Start
+func (s *Server) SetCrashHandler(h *util.CrashHandler) {
+	s.mgr.SetCrashHandler(h)
+	s.wheel.SetCrashHandler(h)
+}
+
+func (s *Server) GetClock() util.Clock {
+	return s.mgr.GetClock()
+}
+
+// SetSnowflakeLayout set the layout of the ids made by the server, util.GetDefaultSnowflakeLayout by default,
+// which only fits the end types below 16 and the end nos below 256.
+// The servers of a cluster must share the layout, it must be set before the first GetSnowflake
+func (s *Server) SetSnowflakeLayout(layout util.SnowflakeLayout) error {
+	// check the end type and the end no fit now instead of on the first id
+	_, err := util.NewSnowflakeWithLayout(layout, s.endType, s.endNo)
+	if err != nil {
+		return err
+	}
+
+	s.lckSnowflake.Lock()
+	defer s.lckSnowflake.Unlock()
+
+	if s.snowflake != nil {
+		return ErrSnowflakeMade
+	}
+
+	s.snowflakeLayout = layout
+	return nil
+}
+
+// GetSnowflake get the id maker of the server, the ids carry the end type and the end no
+// of the server, so the servers of a cluster never make the same id.
+// It is made on the first call with the clock of the server,
+// the end types from 16 and the end nos from 256 need a wider layout set by SetSnowflakeLayout
+func (s *Server) GetSnowflake() (*util.Snowflake, error) {
+	s.lckSnowflake.Lock()
+	defer s.lckSnowflake.Unlock()
+
+	if s.snowflake != nil {
+		return s.snowflake, nil
+	}
+
+	sf, err := util.NewSnowflakeWithLayout(s.snowflakeLayout, s.endType, s.endNo)
+	if err != nil {
+		return nil, err
+	}
+
+	sf.SetClock(s.GetClock())
+	s.snowflake = sf
+	return sf, nil
+}
+
+// NextId get a new unique id from the snowflake of the server
+func (s *Server) NextId() (uint64, error) {
+	sf, err := s.GetSnowflake()
+	if err != nil {
+		return 0, err
+	}
+
+	return sf.NextId()
+}
+
 func (s *Server) AddService(mod uint16, serv Service) error {
 	if serv == nil {
 		return errors.New("service is nil")
 	}
 
+	s.lckServ.Lock()
+	defer s.lckServ.Unlock()
+
 	s.mapMod2Serv[mod] = serv
+	s.buildHandler(mod)
 	return nil
 }
 
+// Use register middlewares for all the mods, the first one is the outermost
+func (s *Server) Use(mw ...Middleware) {
+	s.lckServ.Lock()
+	defer s.lckServ.Unlock()
+
+	s.middlewares = append(s.middlewares, mw...)
+	for mod := range s.mapMod2Serv {
+		s.buildHandler(mod)
+	}
+}
+
+// UseMod register middlewares for one mod, they run inside the ones registered by Use
+func (s *Server) UseMod(mod uint16, mw ...Middleware) {
+	s.lckServ.Lock()
+	defer s.lckServ.Unlock()
+
+	s.mapMod2Mw[mod] = append(s.mapMod2Mw[mod], mw...)
+	s.buildHandler(mod)
+}
+
+func (s *Server) buildHandler(mod uint16) {
+	serv := s.mapMod2Serv[mod]
+	if serv == nil {
+		return
+	}
+
+	var h PackHandler = serv.OnHandlePack
+	modMws := s.mapMod2Mw[mod]
+	for i := len(modMws) - 1; i >= 0; i-- {
+		h = modMws[i](mod, h)
+	}
+
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](mod, h)
+	}
+
+	s.mapMod2Handler[mod] = h
+}
+
+// SetSockListener set the listener receiving the sock events.
+// When it is set, the packs go to its OnHandlePack instead of Dispatch
 func (s *Server) SetSockListener(l sock.SockListener) {
-	s.mgr.SetListener(l)
+	s.listener = l
+}
+
+func (s *Server) OnSockOpen(c net.Conn) {
+	s.startAuth(c)
+	if s.listener != nil {
+		s.listener.OnSockOpen(c)
+	}
+}
+
+func (s *Server) OnSockClose(c net.Conn) {
+	s.stopAuth(c)
+	if s.listener != nil {
+		s.listener.OnSockClose(c)
+	}
+}
+
+func (s *Server) OnSockError(c net.Conn) {
+	if s.listener != nil {
+		s.listener.OnSockError(c)
+	}
+}
+
+func (s *Server) OnSockReject(c net.Conn, reason error) {
+	s.mgr.GetLogger().W(LOG_TAG_SERV, "reject conn: ", c.RemoteAddr(), ", ", reason)
+	if l, ok := s.listener.(sock.SockRejectListener); ok {
+		l.OnSockReject(c, reason)
+	}
+}
+
+// FilterPack check the auth on the manager loop,
+// so a pack sent right after the login sees the conn authenticated whichever worker runs it
+func (s *Server) FilterPack(p *sock.SockPack, c net.Conn) bool {
+	return s.checkAuth(p, c)
+}
+
+func (s *Server) OnHandlePack(p *sock.SockPack, c net.Conn) {
+	if s.listener != nil {
+		s.listener.OnHandlePack(p, c)
+		return
+	}
+
+	err := s.Dispatch(p, c)
+	if err != nil && err != ErrCmdNotFound {
+		s.mgr.GetPackLogger(p, c).E(LOG_TAG_SERV, "handle pack error, cmd: ", p.Cmd, ", ", err)
+	}
+}
+
+// SetDispatcher run the pack handlers on a pool of workers,
+// packs with the same key keep their order, a nil keyFunc keys by conn.
+// Every key queues at most queSize packs, the packs beyond are dropped and counted as rejected,
+// so a slow key never holds up the others. It must be called before Start
+func (s *Server) SetDispatcher(workers int, queSize int, keyFunc sock.SockDispatchKeyFunc) {
+	s.mgr.SetDispatcher(sock.NewSockDispatcher(workers, queSize, keyFunc))
+}
+
+// GetDispatcherStats get the queue depth and the rejected count of the dispatcher
+func (s *Server) GetDispatcherStats() (sock.SockDispatcherStats, error) {
+	d := s.mgr.GetDispatcher()
+	if d == nil {
+		return sock.SockDispatcherStats{}, errors.New("no dispatcher")
+	}
+
+	return d.GetStats(), nil
+}
+
+// SetAdmission check the accepted sockets with the admission control,
+// the rules of the admission can be changed at runtime
+func (s *Server) SetAdmission(a *sock.SockAdmission) {
+	s.mgr.SetAdmission(a)
+}
+
+// SetRateLimiter check the inbound packs with the limiter, it must be called before Start
+func (s *Server) SetRateLimiter(l *sock.SockLimiter) {
+	s.mgr.SetLimiter(l)
+}
+
+// SetSpanExporter record a span for every traced pack handled by a service,
+// see sock.SetTraceEnable
+func (s *Server) SetSpanExporter(e trace.SpanExporter) {
+	s.spanExporter = e
+}
+
+func (s *Server) exportSpan(p *sock.SockPack, mod uint16, start time.Time, cost time.Duration, err error) {
+	if s.spanExporter == nil || p.TraceId == 0 {
+		return
+	}
+
+	span := &trace.Span{
+		TraceId:  p.TraceId,
+		SpanId:   p.SpanId,
+		ParentId: p.ParentSpanId,
+		Name:     fmt.Sprintf("%d/%d", mod, p.Cmd),
+		EndType:  s.endType,
+		EndNo:    s.endNo,
+		Start:    start,
+		Duration: cost,
+		Error:    "",
+	}
+
+	if err != nil {
+		span.Error = err.Error()
+	}
+
+	s.spanExporter.Export(span)
 }
 
 func (s *Server) Start(network string, address string) error {
@@ -55,32 +350,113 @@ func (s *Server) Start(network string, address string) error {
 	return nil
 }
 
+// StartWithListener serve the conns accepted by l, like Start without listening on an address
+func (s *Server) StartWithListener(l net.Listener) {
+	s.serv.ListenOn(l)
+	go s.serv.Start()
+	s.mgr.Start()
+}
+
+// SetDialer set the dialer of Connect, nil restores net.DialTimeout
+func (s *Server) SetDialer(d sock.SockDialer) {
+	s.client.SetDialer(d)
+}
+
 func (s *Server) Connect(network string, address string, timeoutSec int64) (net.Conn, error) {
 	return s.client.Connect(network, address, timeoutSec)
 }
 
+// GetConnLogger get the logger of the conn, it carries the trace of the pack being handled
+func (s *Server) GetConnLogger(c net.Conn) util.ILogger {
+	return s.mgr.GetConnLogger(c)
+}
+
+// SetConnTraceMark send the trace context to a peer known to understand the trace mark,
+// before it sends a pack with the mark. See sock.SetTraceEnable
+func (s *Server) SetConnTraceMark(c net.Conn, enable bool) error {
+	return s.mgr.SetConnTraceMark(c, enable)
+}
+
 func (s *Server) CloseConn(c net.Conn) {
 	s.mgr.CloseConn(c)
 }
 
+// GetConnCount get the number of the conns in the manager, including the closed ones not removed yet
+func (s *Server) GetConnCount() int {
+	return s.mgr.GetConnCount()
+}
+
 func (s *Server) SetHeaderProcessor(headerProcessor sock.SockHeaderProcessor, c net.Conn) {
 	s.mgr.SetHeaderProcessor(headerProcessor, c)
 }
 
 func (s *Server) HandlePack(p *sock.SockPack, c net.Conn, mod uint16) error {
-	serv := s.mapMod2Serv[mod]
-	if nil == serv {
-		return errors.New("no service for this mod")
+	s.lckServ.RLock()
+	h := s.mapMod2Handler[mod]
+	s.lckServ.RUnlock()
+
+	if nil == h {
+		return ErrNoService
 	}
 
-	return serv.OnHandlePack(p, c)
+	clock := s.GetClock()
+	start := clock.Now()
+	err := h(p, c)
+	cost := clock.Since(start)
+	observeHandler(mod, p.Cmd, cost, err)
+	s.exportSpan(p, mod, start, cost, err)
+	return err
+}
+
+// Send push the pack to the respone queue of the conn without blocking,
+// when the queue is full the send policy decides the result.
+// A pack without a trace sent to the conn being handled joins the trace of the handled pack,
+// a request to another conn joins it with sock.NewFollowSockPack
+func (s *Server) Send(p *sock.SockPack, c net.Conn) error {
+	return s.mgr.Send(p, c)
+}
+
+// SetSendPolicy set the default full queue policy and queue limits for new conns,
+// a limit <= 0 means unlimited
+func (s *Server) SetSendPolicy(policy sock.SockSendPolicy, maxPacks int, maxBytes int) {
+	s.mgr.SetSendPolicy(policy, maxPacks, maxBytes)
+}
+
+// SetConnSendPolicy override the full queue policy and queue limits of one conn
+func (s *Server) SetConnSendPolicy(c net.Conn, policy sock.SockSendPolicy, maxPacks int, maxBytes int) error {
+	return s.mgr.SetConnSendPolicy(c, policy, maxPacks, maxBytes)
 }
 
-func (s *Server) Send(p *sock.SockPack, c net.Conn) {
-	s.mgr.Send(p, c)
+// SetGoodbyePack set the pack sent to every conn when Shutdown begins
+func (s *Server) SetGoodbyePack(p *sock.SockPack) {
+	s.mgr.SetGoodbyePack(p)
 }
 
+// Shutdown stop accepting, let the packs already read be handled, flush the respone queues,
+// and force close the remaining conns when ctx expires.
+// The returned summary tells what was dropped, the error is ctx.Err() if the deadline was hit.
+// ErrServerStopped is returned if the server is already stopped or shutting down
+func (s *Server) Shutdown(ctx context.Context) (*sock.SockShutdownSummary, error) {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return nil, ErrServerStopped
+	}
+
+	s.StopAdmin()
+	s.serv.Stop()
+	summary, err := s.mgr.Shutdown(ctx)
+	s.wheel.Stop()
+	return summary, err
+}
+
+// Stop close the server at once, it waits for the timer goroutine to exit,
+// so the timer callbacks run on that goroutine must not call it
 func (s *Server) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return
+	}
+
+	s.StopAdmin()
 	s.serv.Stop()
 	s.mgr.Stop()
+	s.wheel.Stop()
 }
@@ -0,0 +1,37 @@
+package yxlib
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/metrics"
+	"github.com/wuyiyinxia/yxlib/sock"
+)
+
+var (
+	metricHandlerSeconds = metrics.DefaultRegistry.NewHistogramVec("yxlib_handler_seconds", "Cost of the service handlers.", nil, "mod", "cmd")
+	metricHandlerErrors  = metrics.DefaultRegistry.NewCounterVec("yxlib_handler_errors_total", "Errors returned by the service handlers.", "mod", "cmd")
+)
+
+func observeHandler(mod uint16, cmd uint16, cost time.Duration, err error) {
+	modStr := strconv.Itoa(int(mod))
+	cmdStr := strconv.Itoa(int(cmd))
+	if err == ErrCmdNotFound {
+		cmdStr = sock.SOCK_METRIC_CMD_OTHER
+	}
+	metricHandlerSeconds.With(modStr, cmdStr).Observe(cost.Seconds())
+	if err != nil {
+		metricHandlerErrors.With(modStr, cmdStr).Inc()
+	}
+}
+
+// MetricsHandler serve the metrics of the library in the prometheus text format
+func (s *Server) MetricsHandler() http.Handler {
+	return metrics.Handler(metrics.DefaultRegistry)
+}
+
+// GetMetrics get a snapshot of the metrics of the library
+func (s *Server) GetMetrics() []metrics.Family {
+	return metrics.DefaultRegistry.Snapshot()
+}
@@ -0,0 +1,788 @@
+package yxlib_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib"
+	"github.com/wuyiyinxia/yxlib/sock"
+	"github.com/wuyiyinxia/yxlib/socktest"
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+// testLogger keep the lines written to it
+type testLogger struct {
+	lck   sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) log(lv string, tag string, a ...interface{}) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	l.lines = append(l.lines, lv+" "+tag+" "+fmt.Sprint(a...))
+}
+
+func (l *testLogger) D(tag string, a ...interface{}) { l.log("D", tag, a...) }
+func (l *testLogger) I(tag string, a ...interface{}) { l.log("I", tag, a...) }
+func (l *testLogger) W(tag string, a ...interface{}) { l.log("W", tag, a...) }
+func (l *testLogger) E(tag string, a ...interface{}) { l.log("E", tag, a...) }
+
+func (l *testLogger) contains(sub string) bool {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	for _, line := range l.lines {
+		if strings.Contains(line, sub) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type funcService func(p *sock.SockPack, c net.Conn) error
+
+func (f funcService) OnHandlePack(p *sock.SockPack, c net.Conn) error {
+	return f(p, c)
+}
+
+func TestMiddleware(t *testing.T) {
+	s := yxlib.NewServer(1, 1)
+	logger := &testLogger{}
+	s.SetLogger(logger)
+
+	steps := make([]string, 0)
+	record := func(name string) yxlib.Middleware {
+		return func(mod uint16, next yxlib.PackHandler) yxlib.PackHandler {
+			return func(p *sock.SockPack, c net.Conn) error {
+				steps = append(steps, name)
+				return next(p, c)
+			}
+		}
+	}
+
+	errHandler := errors.New("handler error")
+	s.AddService(1, funcService(func(p *sock.SockPack, c net.Conn) error {
+		steps = append(steps, "handler")
+		if p.Cmd == 2 {
+			panic("boom")
+		}
+
+		return errHandler
+	}))
+
+	// the mod middlewares are registered first, but run inside the global ones
+	s.UseMod(1, record("mod1"), record("mod2"))
+	s.Use(record("global1"), record("global2"))
+
+	err := s.HandlePack(sock.NewReqSockPack(1, 0, 0, 0, 0), nil, 1)
+	if err != errHandler || strings.Join(steps, ",") != "global1,global2,mod1,mod2,handler" {
+		t.Fatal("wrong chain:", steps, err)
+	}
+
+	// a middleware not calling next stops the chain
+	errDenied := errors.New("denied")
+	s.UseMod(1, func(mod uint16, next yxlib.PackHandler) yxlib.PackHandler {
+		return func(p *sock.SockPack, c net.Conn) error {
+			if p.Cmd == 3 {
+				return errDenied
+			}
+
+			return next(p, c)
+		}
+	})
+
+	steps = steps[:0]
+	err = s.HandlePack(sock.NewReqSockPack(3, 0, 0, 0, 0), nil, 1)
+	if err != errDenied || strings.Join(steps, ",") != "global1,global2,mod1,mod2" {
+		t.Fatal("chain not stopped:", steps, err)
+	}
+
+	// the panic becomes an error, and the errors pass through the log middleware
+	s.Use(s.LogMiddleware, s.RecoverMiddleware)
+	err = s.HandlePack(sock.NewReqSockPack(2, 0, 0, 0, 0), nil, 1)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatal("panic not recovered:", err)
+	}
+
+	if !logger.contains("handler panic") || !logger.contains("error: handler panic: boom") {
+		t.Fatal("panic not logged:", logger.lines)
+	}
+
+	err = s.HandlePack(sock.NewReqSockPack(1, 0, 0, 0, 0), nil, 1)
+	if err != errHandler || !logger.contains("error: handler error") {
+		t.Fatal("error not passed through:", err)
+	}
+
+	if s.HandlePack(sock.NewReqSockPack(1, 0, 0, 0, 0), nil, 9) != yxlib.ErrNoService {
+		t.Fatal("expect ErrNoService")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	h := socktest.New(t)
+	s := h.NewServer(1, 1)
+
+	cmdServ := yxlib.NewCmdService()
+	cmdServ.AddHandler(0x0101, func(p *sock.SockPack, c net.Conn) error {
+		resp := sock.GetRespSockPack(p)
+		resp.Cmd = 0x0102
+		return s.Serv.Send(resp, c)
+	})
+
+	s.Serv.AddService(0x01, cmdServ)
+	s.Serv.AddService(0x20, funcService(func(p *sock.SockPack, c net.Conn) error {
+		resp := sock.GetRespSockPack(p)
+		resp.Cmd = p.Cmd + 1
+		return s.Serv.Send(resp, c)
+	}))
+
+	// the range wins over the high byte
+	s.Serv.AddCmdRange(0x0150, 0x015F, 0x20)
+	s.Start()
+
+	c := s.Connect(2, 1)
+	c.Request(0x0101, nil)
+	c.ExpectPack(0x0102, time.Second)
+
+	c.Request(0x0150, nil)
+	c.ExpectPack(0x0151, time.Second)
+
+	// no handler in the service, and no service of the mod
+	for _, cmd := range []uint16{0x0199, 0x3001} {
+		c.Request(cmd, nil)
+		p := c.ExpectPack(yxlib.SERV_CMD_NOT_FOUND, time.Second)
+		if binary.BigEndian.Uint16(p.Data) != cmd {
+			t.Fatal("wrong not found cmd:", p.Data)
+		}
+	}
+
+	// a custom mapper replaces the high byte one
+	s.Serv.SetCmdMapper(func(cmd uint16) (uint16, bool) {
+		return 0x20, cmd >= 0x7000
+	})
+
+	if mod, ok := s.Serv.GetCmdMod(0x0152); !ok || mod != 0x20 {
+		t.Fatal("wrong range mod:", mod, ok)
+	}
+
+	c.Request(0x7001, nil)
+	c.ExpectPack(0x7002, time.Second)
+
+	c.Request(0x0101, nil)
+	c.ExpectPack(yxlib.SERV_CMD_NOT_FOUND, time.Second)
+}
+
+const (
+	TEST_CMD_CHALLENGE uint16 = 0x0A01
+	TEST_CMD_LOGIN     uint16 = 0x0A02
+	TEST_CMD_WHOAMI    uint16 = 0x0101
+	TEST_CMD_WHOAMI_RE uint16 = 0x0102
+)
+
+// newAuthServer create a server whose whoami cmd responds the principal of the conn
+func newAuthServer(h *socktest.Harness, a yxlib.Authenticator, timeout time.Duration) (*socktest.TestServer, *int32) {
+	s := h.NewServer(1, 1)
+	handled := new(int32)
+	s.Serv.AddService(0x01, funcService(func(p *sock.SockPack, c net.Conn) error {
+		atomic.AddInt32(handled, 1)
+		resp := sock.GetRespSockPack(p)
+		resp.Cmd = TEST_CMD_WHOAMI_RE
+		resp.Data = []byte(fmt.Sprint(s.Serv.GetPrincipal(c)))
+		return s.Serv.Send(resp, c)
+	}))
+
+	s.Serv.SetAuthenticator(a, timeout, TEST_CMD_LOGIN)
+	return s, handled
+}
+
+func startAuthServer(h *socktest.Harness, a yxlib.Authenticator, timeout time.Duration) (*socktest.TestServer, *int32) {
+	s, handled := newAuthServer(h, a, timeout)
+	s.Start()
+	return s, handled
+}
+
+func expectUnauthorized(t *testing.T, c *socktest.Client, cmd uint16) {
+	t.Helper()
+
+	p := c.ExpectPack(yxlib.SERV_CMD_UNAUTHORIZED, time.Second)
+	if binary.BigEndian.Uint16(p.Data) != cmd {
+		t.Fatal("wrong unauthorized cmd:", p.Data)
+	}
+}
+
+func TestAuthHmac(t *testing.T) {
+	key := []byte("secret key")
+	h := socktest.New(t)
+	s, handled := startAuthServer(h, yxlib.NewHmacAuthenticator(key, TEST_CMD_CHALLENGE), 0)
+
+	c := s.Connect(2, 1)
+	nonce := c.ExpectPack(TEST_CMD_CHALLENGE, time.Second).Data
+
+	// only the login cmd is delivered before the auth
+	c.Request(TEST_CMD_WHOAMI, nil)
+	expectUnauthorized(t, c, TEST_CMD_WHOAMI)
+
+	login := func(key []byte, identity string) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(nonce)
+		mac.Write([]byte(identity))
+		c.Request(TEST_CMD_LOGIN, append(mac.Sum(nil), identity...))
+	}
+
+	login([]byte("wrong key"), "alice")
+	expectUnauthorized(t, c, TEST_CMD_LOGIN)
+
+	// a valid mac of no identity is no principal
+	login(key, "")
+	expectUnauthorized(t, c, TEST_CMD_LOGIN)
+
+	login(key, "alice")
+	c.ExpectPack(TEST_CMD_LOGIN, time.Second)
+
+	c.Request(TEST_CMD_WHOAMI, nil)
+	if p := c.ExpectPack(TEST_CMD_WHOAMI_RE, time.Second); string(p.Data) != "alice" {
+		t.Fatal("wrong principal:", string(p.Data))
+	}
+
+	if atomic.LoadInt32(handled) != 1 {
+		t.Fatal("unauthorized packs reached the service")
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	h := socktest.New(t)
+	a := yxlib.NewTokenAuthenticator(func(token string) (interface{}, error) {
+		if token != "token-bob" {
+			return nil, yxlib.ErrAuthFailed
+		}
+
+		return "bob", nil
+	})
+
+	s, _ := startAuthServer(h, a, 30*time.Second)
+
+	idle := s.Connect(2, 1)
+	c := s.Connect(2, 2)
+	c.Request(TEST_CMD_LOGIN, []byte("token-eve"))
+	expectUnauthorized(t, c, TEST_CMD_LOGIN)
+
+	c.Request(TEST_CMD_LOGIN, []byte("token-bob"))
+	c.ExpectPack(TEST_CMD_LOGIN, time.Second)
+
+	// the conn not authenticated is closed after the timeout, the other one stays
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				h.Advance(10 * time.Second)
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}()
+
+	idle.ExpectClosed(time.Second)
+
+	c.Request(TEST_CMD_WHOAMI, nil)
+	if p := c.ExpectPack(TEST_CMD_WHOAMI_RE, time.Second); string(p.Data) != "bob" {
+		t.Fatal("wrong principal:", string(p.Data))
+	}
+}
+
+func TestAuthDispatchByCmd(t *testing.T) {
+	h := socktest.New(t)
+	a := yxlib.NewTokenAuthenticator(func(token string) (interface{}, error) {
+		// a slow login, the whoami behind it must still see the conn authenticated
+		time.Sleep(50 * time.Millisecond)
+		return token, nil
+	})
+
+	s, _ := newAuthServer(h, a, 0)
+	s.Serv.SetDispatcher(2, 8, func(w *sock.SockPackWrap) uint64 {
+		return uint64(w.Pack.Cmd)
+	})
+
+	s.Start()
+
+	c := s.Connect(2, 1)
+	c.Request(TEST_CMD_LOGIN, []byte("carol"))
+	c.Request(TEST_CMD_WHOAMI, nil)
+	c.ExpectPack(TEST_CMD_LOGIN, time.Second)
+	if p := c.ExpectPack(TEST_CMD_WHOAMI_RE, time.Second); string(p.Data) != "carol" {
+		t.Fatal("wrong principal:", string(p.Data))
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	h := socktest.New(t)
+	s := h.NewServer(1, 1)
+	s.Serv.AddService(0x01, yxlib.NewCmdService())
+	s.Start()
+
+	c := s.Connect(2, 1)
+	if !s.WaitConnCount(1, time.Second) {
+		t.Fatal("conn not added")
+	}
+
+	admin := s.Serv.AdminHandler("tok")
+	do := func(method string, target string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("GET", "/conns", ""); w.Code != http.StatusUnauthorized {
+		t.Fatal("expect unauthorized without the token, got", w.Code)
+	}
+
+	if w := do("GET", "/conns", "bad"); w.Code != http.StatusUnauthorized {
+		t.Fatal("expect unauthorized with a wrong token, got", w.Code)
+	}
+
+	w := do("GET", "/conns", "tok")
+	conns := make([]map[string]interface{}, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &conns); err != nil || len(conns) != 1 {
+		t.Fatal("wrong conns:", w.Body.String(), err)
+	}
+
+	w = do("GET", "/services", "tok")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "*yxlib.CmdService") {
+		t.Fatal("wrong services:", w.Body.String())
+	}
+
+	// the state is only changed by POST
+	kick := fmt.Sprintf("/kick?id=%v&reason=bye", conns[0]["id"])
+	if w := do("GET", kick, "tok"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("expect method not allowed, got", w.Code)
+	}
+
+	if w := do("POST", kick, "tok"); w.Code != http.StatusOK {
+		t.Fatal("kick error:", w.Code, w.Body.String())
+	}
+
+	if p := c.ExpectPack(sock.SOCK_CMD_KICKED, time.Second); string(p.Data) != "bye" {
+		t.Fatal("wrong kick reason:", string(p.Data))
+	}
+
+	c.ExpectClosed(time.Second)
+
+	// a reason too long for a pack is cut
+	s.Sweep()
+	if !s.WaitConnCount(0, time.Second) {
+		t.Fatal("kicked conn not removed")
+	}
+
+	c = s.Connect(2, 2)
+	if !s.WaitConnCount(1, time.Second) {
+		t.Fatal("conn not added")
+	}
+
+	conns = conns[:0]
+	json.Unmarshal(do("GET", "/conns", "tok").Body.Bytes(), &conns)
+	kick = fmt.Sprintf("/kick?id=%v&reason=%s", conns[0]["id"], strings.Repeat("x", 70000))
+	if w := do("POST", kick, "tok"); w.Code != http.StatusOK {
+		t.Fatal("kick error:", w.Code, w.Body.String())
+	}
+
+	if p := c.ExpectPack(sock.SOCK_CMD_KICKED, time.Second); len(p.Data) != sock.SOCK_PACK_MAX_DATA {
+		t.Fatal("wrong kick reason len:", len(p.Data))
+	}
+
+	c.ExpectClosed(time.Second)
+	if w := do("POST", "/kick?id=12345", "tok"); w.Code != http.StatusNotFound {
+		t.Fatal("expect not found, got", w.Code)
+	}
+
+	lv := util.Logger.GetLevel()
+	defer util.Logger.SetLevel(lv)
+
+	if w := do("GET", "/loglevel?level=error", "tok"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("expect method not allowed, got", w.Code)
+	}
+
+	if w := do("POST", "/loglevel?level=error", "tok"); w.Code != http.StatusOK || util.Logger.GetLevel() != util.LOG_LV_ERROR {
+		t.Fatal("level not changed:", w.Code, w.Body.String())
+	}
+
+	if w := do("GET", "/loglevel", "tok"); w.Code != http.StatusOK {
+		t.Fatal("show level error:", w.Code)
+	}
+
+	// no change can be made without a token
+	admin = s.Serv.AdminHandler("")
+	if w := do("POST", "/loglevel?level=debug", ""); w.Code != http.StatusForbidden || util.Logger.GetLevel() != util.LOG_LV_ERROR {
+		t.Fatal("expect forbidden, got", w.Code)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	sock.SetTraceEnable(true)
+	defer sock.SetTraceEnable(false)
+
+	h := socktest.New(t)
+	s := h.NewServer(1, 1)
+	logger := &testLogger{}
+	s.Serv.SetLogger(logger)
+	traceLeaked := new(int32)
+	s.Serv.AddService(0x01, funcService(func(p *sock.SockPack, c net.Conn) error {
+		s.Serv.GetConnLogger(c).I("test", "handle ", p.Cmd)
+		push := sock.NewReqSockPack(0x0103, 1, 1, p.SrcEnd, p.SrcNo)
+		err := s.Serv.Send(push, c)
+
+		// the caller's pack may be sent to other conns, it keeps no trace
+		if push.TraceId != 0 {
+			atomic.StoreInt32(traceLeaked, 1)
+		}
+
+		return err
+	}))
+
+	s.Start()
+
+	// an old peer gets the plain packs
+	old := s.Connect(2, 1)
+	old.Request(0x0101, nil)
+	if p := old.ExpectPack(0x0103, time.Second); binary.BigEndian.Uint16(p.RawBuff) != sock.GetPackMark() {
+		t.Fatal("expect the plain mark")
+	}
+
+	// a peer sending the trace mark gets the trace back, and the push joins its trace
+	c := s.Connect(2, 2)
+	c.Conn.SetTraceMark(true)
+	req := sock.NewReqSockPack(0x0101, 2, 2, 1, 1)
+	req.TraceId = 42
+	req.SpanId = 7
+	c.Send(req)
+
+	p := c.ExpectPack(0x0103, time.Second)
+	if binary.BigEndian.Uint16(p.RawBuff) != sock.GetPackTraceMark() || p.TraceId != 42 {
+		t.Fatal("trace not propagated:", p.TraceId)
+	}
+
+	if !logger.contains("conn=2 addr=pipe:2 trace=000000000000002a") {
+		t.Fatal("trace not logged:", logger.lines)
+	}
+
+	if atomic.LoadInt32(traceLeaked) != 0 {
+		t.Fatal("trace set on the caller's pack")
+	}
+}
+
+func TestSnowflake(t *testing.T) {
+	s := yxlib.NewServer(3, 7)
+	clock := util.NewFakeClock(time.Date(2022, 5, 6, 7, 8, 9, 0, time.UTC))
+	s.SetClock(clock)
+
+	sf, err := s.GetSnowflake()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sf2, _ := s.GetSnowflake(); sf2 != sf {
+		t.Fatal("snowflake made twice")
+	}
+
+	id, err := s.NextId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := sf.Decode(id)
+	if parts.EndType != 3 || parts.EndNo != 7 || !parts.Time.Equal(clock.Now()) {
+		t.Fatal("unexpect id parts:", parts)
+	}
+
+	if err := s.SetSnowflakeLayout(util.GetDefaultSnowflakeLayout()); err != yxlib.ErrSnowflakeMade {
+		t.Fatal("expect the layout fixed after the first id:", err)
+	}
+
+	// every end type and end no fit a layout with the full widths, whose time needs a recent epoch
+	wide := util.GetDefaultSnowflakeLayout()
+	wide.Epoch = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	wide.EndTypeBits = 8
+	wide.EndNoBits = 16
+	wide.SeqBits = 4
+	big := yxlib.NewServer(255, 65535)
+	big.SetClock(clock)
+	if err := big.SetSnowflakeLayout(wide); err != nil {
+		t.Fatal("set layout error:", err)
+	}
+
+	id, err = big.NextId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf, _ = big.GetSnowflake()
+	if parts := sf.Decode(id); parts.EndType != 255 || parts.EndNo != 65535 || !parts.Time.Equal(clock.Now()) {
+		t.Fatal("unexpect id parts:", parts)
+	}
+}
+
+func leaseData(reqId uint32, tag string) []byte {
+	data := make([]byte, 5+len(tag))
+	binary.BigEndian.PutUint32(data, reqId)
+	data[4] = uint8(len(tag))
+	copy(data[5:], tag)
+	return data
+}
+
+func TestIdSegService(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "ids.json")
+	svc, err := yxlib.NewIdSegService(nil, file, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range []uint64{1, 11} {
+		start, end, err := svc.Lease("a")
+		if err != nil || start != expect || end != expect+10 {
+			t.Fatal("wrong segment:", start, end, err)
+		}
+	}
+
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp file left:", err)
+	}
+
+	// a restarted service goes on from the saved next id
+	svc, err = yxlib.NewIdSegService(nil, file, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if start, _, err := svc.Lease("a"); err != nil || start != 21 {
+		t.Fatal("next id not reloaded:", start, err)
+	}
+
+	h := socktest.New(t)
+	s := h.NewServer(1, 1)
+	svc, _ = yxlib.NewIdSegService(s.Serv, path.Join(dir, "missing", "ids.json"), 10)
+	svc.SetStep("big", math.MaxUint64)
+	svc.Register()
+	s.Start()
+
+	c := s.Connect(2, 1)
+	for _, tc := range []struct {
+		tag  string
+		code uint8
+	}{{"big", yxlib.ID_SEG_CODE_OVERFLOW}, {"a", yxlib.ID_SEG_CODE_SAVE}} {
+		c.Request(yxlib.ID_SEG_CMD_LEASE, leaseData(7, tc.tag))
+		p := c.ExpectPack(yxlib.ID_SEG_CMD_LEASE_RESP, time.Second)
+		if binary.BigEndian.Uint32(p.Data) != 7 || p.Data[4] != tc.code {
+			t.Fatal("wrong respone of", tc.tag, p.Data)
+		}
+	}
+
+	c.Request(yxlib.ID_SEG_CMD_LEASE, []byte{0, 0, 0, 8, 5, 'a'})
+	if p := c.ExpectPack(yxlib.ID_SEG_CMD_LEASE_RESP, time.Second); p.Data[4] != yxlib.ID_SEG_CODE_BAD_REQ {
+		t.Fatal("bad request accepted:", p.Data)
+	}
+}
+
+func TestIdSegClient(t *testing.T) {
+	h := socktest.New(t)
+	s := h.NewServer(1, 1)
+	var leased int32
+	s.Serv.Use(func(mod uint16, next yxlib.PackHandler) yxlib.PackHandler {
+		return func(p *sock.SockPack, c net.Conn) error {
+			atomic.AddInt32(&leased, 1)
+			return next(p, c)
+		}
+	})
+
+	// the leases of "slow" are answered by the test
+	svc, _ := yxlib.NewIdSegService(s.Serv, path.Join(t.TempDir(), "ids.json"), 10)
+	slowEvt := make(chan *sock.SockPackWrap, 1)
+	s.Serv.AddCmdRange(yxlib.ID_SEG_CMD_LEASE, yxlib.ID_SEG_CMD_LEASE, yxlib.ID_SEG_MOD)
+	s.Serv.AddService(yxlib.ID_SEG_MOD, funcService(func(p *sock.SockPack, c net.Conn) error {
+		if string(p.Data[5:]) == "slow" {
+			slowEvt <- sock.NewSockPackWrap(p, c)
+			return nil
+		}
+
+		return svc.OnHandlePack(p, c)
+	}))
+
+	s.Start()
+
+	cs := h.NewServer(2, 1)
+	logger := &testLogger{}
+	cs.Serv.SetLogger(logger)
+	cs.Start()
+	conn, err := cs.Serv.Connect("pipe", s.GetAddr(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := yxlib.NewIdSegClient(cs.Serv, conn, 1, 1)
+	client.Register()
+	client.SetTimeout(100 * time.Millisecond)
+
+	nextId := func(expect uint64) {
+		t.Helper()
+
+		id, err := client.NextId("a")
+		if err != nil || id != expect {
+			t.Fatal("wrong id:", id, err, "expect", expect)
+		}
+	}
+
+	// the next segment is fetched when 20% of the current one is left
+	for id := uint64(1); id <= 7; id++ {
+		nextId(id)
+	}
+
+	if atomic.LoadInt32(&leased) != 1 {
+		t.Fatal("fetched before the prefetch line:", leased)
+	}
+
+	nextId(8)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&leased) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("next segment not fetched")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	for id := uint64(9); id <= 17; id++ {
+		nextId(id)
+	}
+
+	if atomic.LoadInt32(&leased) != 2 {
+		t.Fatal("fetched more than the next segment:", leased)
+	}
+
+	// the segment leased after the timeout is logged as lost, the lease times out on the server clock
+	slowErrEvt := make(chan error, 1)
+	go func() {
+		_, err := client.NextId("slow")
+		slowErrEvt <- err
+	}()
+
+	slow := <-slowEvt
+	var slowErr error
+	for waiting := true; waiting; {
+		select {
+		case slowErr = <-slowErrEvt:
+			waiting = false
+
+		default:
+			h.Advance(100 * time.Millisecond)
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if slowErr != yxlib.ErrIdSegTimeout {
+		t.Fatal("expect timeout:", slowErr)
+	}
+	resp := sock.GetRespSockPack(slow.Pack)
+	resp.Cmd = yxlib.ID_SEG_CMD_LEASE_RESP
+	resp.Data = make([]byte, 21)
+	copy(resp.Data, slow.Pack.Data[:4])
+	binary.BigEndian.PutUint64(resp.Data[5:], 100)
+	binary.BigEndian.PutUint64(resp.Data[13:], 110)
+	if err := s.Serv.Send(resp, slow.Conn); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline = time.Now().Add(time.Second)
+	for !logger.contains("id segment lost after the lease timeout: [100, 110)") {
+		if time.Now().After(deadline) {
+			t.Fatal("lost segment not logged:", logger.lines)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	h := socktest.New(t)
+	s := h.NewServer(1, 1)
+	s.Start()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminAddr := l.Addr().String()
+	l.Close()
+	if err := s.Serv.StartAdmin(adminAddr, "tok"); err != nil {
+		t.Fatal("start admin error:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := s.Serv.Shutdown(ctx); err != nil {
+		t.Fatal("shutdown error:", err)
+	}
+
+	// the admin endpoint goes with the server
+	if resp, err := http.Get("http://" + adminAddr + "/conns"); err == nil {
+		resp.Body.Close()
+		t.Fatal("expect the admin endpoint closed")
+	}
+
+	if _, err := s.Serv.Shutdown(ctx); err != yxlib.ErrServerStopped {
+		t.Fatal("expect ErrServerStopped:", err)
+	}
+}
+
+func TestDispatchBusy(t *testing.T) {
+	h := socktest.New(t)
+	s := h.NewServer(1, 1)
+	s.Serv.SetDispatcher(1, 1, nil)
+	block := make(chan bool)
+	s.Serv.AddService(0x01, funcService(func(p *sock.SockPack, c net.Conn) error {
+		<-block
+		return nil
+	}))
+
+	s.Start()
+	defer close(block)
+
+	// the first pack blocks the key, the later ones fill the queue and are rejected
+	c := s.Connect(2, 1)
+	for cmd := uint16(0x0101); cmd <= 0x0103; cmd++ {
+		c.Request(cmd, nil)
+	}
+
+	p := c.ExpectPack(sock.SOCK_CMD_BUSY, time.Second)
+	if cmd := binary.BigEndian.Uint16(p.Data); cmd != 0x0102 && cmd != 0x0103 {
+		t.Fatal("wrong busy cmd:", cmd)
+	}
+
+	if stats, _ := s.Serv.GetDispatcherStats(); stats.Rejected == 0 {
+		t.Fatal("reject not counted")
+	}
+}
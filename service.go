@@ -1,11 +1,62 @@
 package yxlib
 
 import (
+	"errors"
 	"net"
+	"sync"
 
 	"github.com/wuyiyinxia/yxlib/sock"
 )
 
+var (
+	ErrCmdNotFound error = errors.New("cmd not found")
+)
+
 type Service interface {
 	OnHandlePack(p *sock.SockPack, c net.Conn) error
 }
+
+// CmdService is a Service dispatching the packs to the handlers registered by cmd
+type CmdService struct {
+	lckHandler     sync.RWMutex
+	mapCmd2Handler map[uint16]PackHandler
+}
+
+func NewCmdService() *CmdService {
+	return &CmdService{
+		mapCmd2Handler: make(map[uint16]PackHandler),
+	}
+}
+
+func (s *CmdService) AddHandler(cmd uint16, h PackHandler) {
+	s.lckHandler.Lock()
+	defer s.lckHandler.Unlock()
+
+	s.mapCmd2Handler[cmd] = h
+}
+
+func (s *CmdService) RemoveHandler(cmd uint16) {
+	s.lckHandler.Lock()
+	defer s.lckHandler.Unlock()
+
+	delete(s.mapCmd2Handler, cmd)
+}
+
+func (s *CmdService) HasHandler(cmd uint16) bool {
+	s.lckHandler.RLock()
+	defer s.lckHandler.RUnlock()
+
+	return s.mapCmd2Handler[cmd] != nil
+}
+
+func (s *CmdService) OnHandlePack(p *sock.SockPack, c net.Conn) error {
+	s.lckHandler.RLock()
+	h := s.mapCmd2Handler[p.Cmd]
+	s.lckHandler.RUnlock()
+
+	if h == nil {
+		return ErrCmdNotFound
+	}
+
+	return h(p, c)
+}
@@ -0,0 +1,212 @@
+package sock
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+var (
+	ErrRejectMaxConn      error = errors.New("too many conns")
+	ErrRejectMaxConnPerIp error = errors.New("too many conns from the ip")
+	ErrRejectDenied       error = errors.New("ip denied")
+	ErrRejectBanned       error = errors.New("ip banned")
+)
+
+// SockRejectListener is an optional interface of SockListener,
+// it is told about the accepted sockets closed by the admission control.
+// It is called on the accepting goroutine
+type SockRejectListener interface {
+	OnSockReject(c net.Conn, reason error)
+}
+
+// SockAdmission decide whether an accepted socket can be added.
+// A limit <= 0 means unlimited, an empty allow list allows every ip
+type SockAdmission struct {
+	lck          sync.Mutex
+	maxConn      int
+	maxConnPerIp int
+	allows       []*net.IPNet
+	denies       []*net.IPNet
+	mapBan       map[string]time.Time
+	connCnt      int
+	mapIpCnt     map[string]int
+	clock        util.Clock
+}
+
+func NewSockAdmission(maxConn int, maxConnPerIp int) *SockAdmission {
+	return &SockAdmission{
+		maxConn:      maxConn,
+		maxConnPerIp: maxConnPerIp,
+		allows:       make([]*net.IPNet, 0),
+		denies:       make([]*net.IPNet, 0),
+		mapBan:       make(map[string]time.Time),
+		connCnt:      0,
+		mapIpCnt:     make(map[string]int),
+		clock:        util.RealClock,
+	}
+}
+
+func (a *SockAdmission) SetMaxConn(maxConn int, maxConnPerIp int) {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	a.maxConn = maxConn
+	a.maxConnPerIp = maxConnPerIp
+}
+
+// SetRules replace the allow and deny lists, the items are CIDRs or single ips.
+// Nothing is changed if any item is invalid
+func (a *SockAdmission) SetRules(allows []string, denies []string) error {
+	allowNets, err := parseIpNets(allows)
+	if err != nil {
+		return err
+	}
+
+	denyNets, err := parseIpNets(denies)
+	if err != nil {
+		return err
+	}
+
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	a.allows = allowNets
+	a.denies = denyNets
+	return nil
+}
+
+// SetClock set the clock of the bans, the sock manager sets its clock
+func (a *SockAdmission) SetClock(c util.Clock) {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	a.clock = c
+}
+
+// Ban reject the ip until the duration passes
+func (a *SockAdmission) Ban(ip string, d time.Duration) {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	a.mapBan[ip] = a.clock.Now().Add(d)
+}
+
+func (a *SockAdmission) Unban(ip string) {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	delete(a.mapBan, ip)
+}
+
+// Clean remove the expired bans
+func (a *SockAdmission) Clean() {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	now := a.clock.Now()
+	for ip, expire := range a.mapBan {
+		if now.After(expire) {
+			delete(a.mapBan, ip)
+		}
+	}
+}
+
+func (a *SockAdmission) GetConnCount() int {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	return a.connCnt
+}
+
+// admit check the ip and count the conn in, return the reject reason
+func (a *SockAdmission) admit(ip string) error {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	expire, ok := a.mapBan[ip]
+	if ok {
+		if a.clock.Now().Before(expire) {
+			return ErrRejectBanned
+		}
+
+		delete(a.mapBan, ip)
+	}
+
+	ipObj := net.ParseIP(ip)
+	if matchIpNets(a.denies, ipObj) {
+		return ErrRejectDenied
+	}
+
+	if len(a.allows) > 0 && !matchIpNets(a.allows, ipObj) {
+		return ErrRejectDenied
+	}
+
+	if a.maxConn > 0 && a.connCnt >= a.maxConn {
+		return ErrRejectMaxConn
+	}
+
+	if a.maxConnPerIp > 0 && a.mapIpCnt[ip] >= a.maxConnPerIp {
+		return ErrRejectMaxConnPerIp
+	}
+
+	a.connCnt++
+	a.mapIpCnt[ip]++
+	return nil
+}
+
+func (a *SockAdmission) release(ip string) {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	a.connCnt--
+	a.mapIpCnt[ip]--
+	if a.mapIpCnt[ip] <= 0 {
+		delete(a.mapIpCnt, ip)
+	}
+}
+
+func parseIpNets(items []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("invalid ip: " + item)
+			}
+
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func matchIpNets(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
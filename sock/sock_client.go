@@ -11,30 +11,52 @@ const (
 	LOG_TAG_SC = "SockClient"
 )
 
+// SockDialer open a conn to the address, net.DialTimeout by default
+type SockDialer func(network string, address string, timeout time.Duration) (net.Conn, error)
+
 type SockClient struct {
-	mgr *SockMgr
+	mgr    *SockMgr
+	dialer SockDialer
 }
 
 func NewSockClient(mgr *SockMgr) *SockClient {
 	return &SockClient{
-		mgr: mgr,
+		mgr:    mgr,
+		dialer: net.DialTimeout,
 	}
 }
 
+// SetDialer replace the dialer, nil restores net.DialTimeout
+func (c *SockClient) SetDialer(d SockDialer) {
+	if d == nil {
+		d = net.DialTimeout
+	}
+
+	c.dialer = d
+}
+
 func (c *SockClient) Connect(network string, address string, timeoutSec int64) (net.Conn, error) {
-	conn, err := net.DialTimeout(network, address, time.Second*time.Duration(timeoutSec))
+	conn, err := c.dialer(network, address, time.Second*time.Duration(timeoutSec))
 	if err != nil {
-		util.Logger.E(LOG_TAG_SC, "dial error:", err)
+		c.getLogger().E(LOG_TAG_SC, "dial error: ", err)
 		return nil, err
 	}
 
 	if c.mgr != nil {
-		err = c.mgr.addConn(conn)
+		_, err = c.mgr.addConn(conn, false)
 		if err != nil {
-			util.Logger.E(LOG_TAG_SC, "add conn error:", err)
+			c.getLogger().E(LOG_TAG_SC, "add conn error: ", err)
 			return nil, err
 		}
 	}
 
 	return conn, nil
 }
+
+func (c *SockClient) getLogger() util.ILogger {
+	if c.mgr != nil {
+		return c.mgr.logger
+	}
+
+	return util.Logger
+}
@@ -7,40 +7,127 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	LOG_TAG_CONN = "SockConn"
 )
 
 const (
 	SOCK_READ_DEAD_LINE  = 8
 	SOCK_WRITE_DEAD_LINE = 8
-	SOCK_MAX_RESP_QUE    = 10
+	SOCK_MAX_RESP_QUE    = 1024
+	SOCK_MAX_RESP_BYTES  = 4 * 1024 * 1024
+)
+
+// sockWakeTime a deadline in the past for any clock, it wakes the blocking read at once
+var sockWakeTime = time.Unix(1, 0)
+
+// SockSendPolicy decides what happens to a pack pushed into a full respone queue
+type SockSendPolicy int
+
+const (
+	SOCK_SEND_POLICY_ERROR       SockSendPolicy = 0 // reject the new pack and return ErrQueueFull
+	SOCK_SEND_POLICY_DROP_NEWEST SockSendPolicy = 1 // silently drop the new pack
+	SOCK_SEND_POLICY_DROP_OLDEST SockSendPolicy = 2 // drop queued packs from the head until the new one fits
+	SOCK_SEND_POLICY_DISCONNECT  SockSendPolicy = 3 // close the slow consumer
 )
 
 var (
 	ErrStopSockWrite error = errors.New("stop write")
+	ErrQueueFull     error = errors.New("respone queue full")
+	ErrSlowConsumer  error = errors.New("slow consumer disconnected")
 )
 
+type SockConnInfo struct {
+	Id           uint64
+	RemoteAddr   string
+	PeerEnd      uint8 // the endpoint identity from the first inbound pack
+	PeerNo       uint16
+	Principal    string
+	CreateTime   time.Time
+	RespQuePacks int
+	RespQueBytes int
+	RecvBytes    uint64
+	SentBytes    uint64
+}
+
 type SockConn struct {
+	id              uint64
 	conn            net.Conn
 	headerBuff      []byte
 	requestQue      chan *SockPackWrap
-	responeQue      chan *SockPack
+	lckResp         sync.Mutex
+	responeQue      []*SockPack
+	responeBytes    int
+	responeEvt      chan bool
+	sendPolicy      SockSendPolicy
+	maxRespPacks    int
+	maxRespBytes    int
 	closeReadEvt    chan bool
+	stopOnce        sync.Once
 	closeWriteEvt   chan bool
 	exitEvt         chan bool
+	holdWrite       int32 // keep writing after the read end, until CloseWrite
+	readExit        int32
+	lckAttr         sync.Mutex
+	principal       interface{}
+	curTraceId      uint64 // the trace of the pack being handled, guarded by lckAttr
+	curSpanId       uint64
+	traceMark       int32 // 1 if the packs sent to the peer may carry the trace mark
+	admitted        bool  // counted by the admission control
+	releaseOnce     sync.Once
+	exitHook        func() // called on the write goroutine when the conn exits
+	createTime      time.Time
+	clock           util.Clock
+	readTimer       util.ClockTimer // wakes the read when the clock is not the real one
+	recvBytes       uint64
+	sentBytes       uint64
+	peerEnd         uint32 // the source of the first inbound pack, 0 before any pack
+	peerNo          uint32
 	headerProcessor SockHeaderProcessor
+	metricCmdFilter SockMetricCmdFilter
+	logger          util.ILogger
 }
 
 func NewSockConn(conn net.Conn, requestQue chan *SockPackWrap) *SockConn {
 	c := &SockConn{
+		id:              0,
 		conn:            conn,
 		headerBuff:      make([]byte, SOCK_PACK_HEADER_LEN),
 		requestQue:      requestQue,
-		responeQue:      make(chan *SockPack, SOCK_MAX_RESP_QUE),
+		responeQue:      make([]*SockPack, 0),
+		responeBytes:    0,
+		responeEvt:      make(chan bool, 1),
+		sendPolicy:      SOCK_SEND_POLICY_ERROR,
+		maxRespPacks:    SOCK_MAX_RESP_QUE,
+		maxRespBytes:    SOCK_MAX_RESP_BYTES,
 		closeReadEvt:    make(chan bool, 1),
 		closeWriteEvt:   make(chan bool, 1),
 		exitEvt:         make(chan bool, 1),
+		holdWrite:       0,
+		readExit:        0,
+		principal:       nil,
+		curTraceId:      0,
+		curSpanId:       0,
+		traceMark:       0,
+		admitted:        false,
+		exitHook:        nil,
+		createTime:      util.GetClock().Now(),
+		clock:           util.GetClock(),
+		readTimer:       nil,
+		recvBytes:       0,
+		sentBytes:       0,
+		peerEnd:         0,
+		peerNo:          0,
 		headerProcessor: nil,
+		metricCmdFilter: nil,
+		logger:          util.Logger,
 	}
 
 	return c
@@ -51,10 +138,142 @@ func (c *SockConn) Start() {
 	go c.write()
 }
 
+// Stop stop reading, it is safe to call from any goroutine and more than once
 func (c *SockConn) Stop() {
-	if len(c.closeReadEvt) == 0 {
-		fmt.Println("stop connect: ", c.conn.RemoteAddr())
+	c.stopOnce.Do(func() {
+		c.logger.I(LOG_TAG_CONN, "stop connect")
 		c.closeReadEvt <- true
+		// wake up the blocking read at once
+		c.conn.SetReadDeadline(sockWakeTime)
+	})
+}
+
+// StopRead stop reading but keep the writer alive until CloseWrite,
+// so the respones of the packs already read can still be sent
+func (c *SockConn) StopRead() {
+	atomic.StoreInt32(&c.holdWrite, 1)
+	c.Stop()
+}
+
+func (c *SockConn) IsReadExit() bool {
+	return atomic.LoadInt32(&c.readExit) == 1
+}
+
+// CloseWrite let the writer flush the respone queue and close the conn
+func (c *SockConn) CloseWrite() {
+	select {
+	case c.closeWriteEvt <- true:
+	default:
+	}
+}
+
+// ForceClose close the conn without flushing, return the count of the dropped packs
+func (c *SockConn) ForceClose() int {
+	packs := c.popAllResp()
+	c.conn.Close()
+	c.CloseWrite()
+	return len(packs)
+}
+
+func (c *SockConn) SetId(id uint64) {
+	c.id = id
+}
+
+func (c *SockConn) GetId() uint64 {
+	return c.id
+}
+
+// SetLogger set the logger of the conn, it should carry the conn context
+func (c *SockConn) SetLogger(l util.ILogger) {
+	c.logger = l
+}
+
+// GetLogger get the logger of the conn,
+// it carries the trace of the pack being handled if there is one
+func (c *SockConn) GetLogger() util.ILogger {
+	traceId, spanId := c.GetCurTrace()
+	if traceId != 0 {
+		return util.LoggerWithTrace(c.logger, traceId, spanId)
+	}
+
+	return c.logger
+}
+
+// setCurTrace set the trace of the pack being handled, 0 when the handling ends
+func (c *SockConn) setCurTrace(traceId uint64, spanId uint64) {
+	c.lckAttr.Lock()
+	defer c.lckAttr.Unlock()
+
+	c.curTraceId = traceId
+	c.curSpanId = spanId
+}
+
+// GetCurTrace get the trace and the span of the pack being handled, 0 if there is none
+func (c *SockConn) GetCurTrace() (uint64, uint64) {
+	c.lckAttr.Lock()
+	defer c.lckAttr.Unlock()
+
+	return c.curTraceId, c.curSpanId
+}
+
+// SetTraceMark allow the packs sent to the peer to carry the trace mark,
+// it is set by itself once the peer sends a pack with the mark
+func (c *SockConn) SetTraceMark(enable bool) {
+	var v int32 = 0
+	if enable {
+		v = 1
+	}
+
+	atomic.StoreInt32(&c.traceMark, v)
+}
+
+// isTraceSerialized return true if the pack is sent with its trace context
+func (c *SockConn) isTraceSerialized(p *SockPack) bool {
+	return p.isTraceSerialized() && atomic.LoadInt32(&c.traceMark) == 1
+}
+
+// SetPrincipal store who the peer is, once it is authenticated
+func (c *SockConn) SetPrincipal(principal interface{}) {
+	c.lckAttr.Lock()
+	defer c.lckAttr.Unlock()
+
+	c.principal = principal
+}
+
+func (c *SockConn) GetPrincipal() interface{} {
+	c.lckAttr.Lock()
+	defer c.lckAttr.Unlock()
+
+	return c.principal
+}
+
+func (c *SockConn) recordRecv(p *SockPack) {
+	atomic.AddUint64(&c.recvBytes, uint64(p.GetPackLen()))
+	if atomic.LoadUint32(&c.peerNo) == 0 && atomic.LoadUint32(&c.peerEnd) == 0 {
+		atomic.StoreUint32(&c.peerEnd, uint32(p.SrcEnd))
+		atomic.StoreUint32(&c.peerNo, uint32(p.SrcNo))
+	}
+}
+
+// GetInfo get a snapshot of the conn states
+func (c *SockConn) GetInfo() SockConnInfo {
+	packs, bytes := c.GetRespQueLen()
+	principal := ""
+	if p := c.GetPrincipal(); p != nil {
+		principal = fmt.Sprint(p)
+	}
+
+	return SockConnInfo{
+		Id:           c.id,
+		RemoteAddr:   c.conn.RemoteAddr().String(),
+		PeerEnd:      uint8(atomic.LoadUint32(&c.peerEnd)),
+		PeerNo:       uint16(atomic.LoadUint32(&c.peerNo)),
+		Principal:    principal,
+		CreateTime:   c.createTime,
+		RespQuePacks: packs,
+		RespQueBytes: bytes,
+		RecvBytes:    atomic.LoadUint64(&c.recvBytes),
+		SentBytes:    atomic.LoadUint64(&c.sentBytes),
 	}
 }
 
@@ -74,8 +293,112 @@ func (c *SockConn) CanRemove() bool {
 	return retCode
 }
 
-func (c *SockConn) PushRespone(p *SockPack) {
-	c.responeQue <- p
+// SetSendPolicy set the full queue policy and the queue limits,
+// a limit <= 0 means unlimited
+func (c *SockConn) SetSendPolicy(policy SockSendPolicy, maxPacks int, maxBytes int) {
+	c.lckResp.Lock()
+	defer c.lckResp.Unlock()
+
+	c.sendPolicy = policy
+	c.maxRespPacks = maxPacks
+	c.maxRespBytes = maxBytes
+}
+
+// PushRespone push the pack to the respone queue, it never blocks.
+// When the queue is full, the send policy decides the result
+func (c *SockConn) PushRespone(p *SockPack) error {
+	var err error = nil
+	dropped := 0
+	size := p.GetPackLen()
+
+	c.lckResp.Lock()
+	policy := c.sendPolicy
+	if c.isRespQueFull(size) {
+		switch policy {
+		case SOCK_SEND_POLICY_DROP_NEWEST:
+			c.lckResp.Unlock()
+			metricSendDropped.With(mapSendPolicyName[SOCK_SEND_POLICY_DROP_NEWEST]).Inc()
+			return nil
+
+		case SOCK_SEND_POLICY_DROP_OLDEST:
+			for len(c.responeQue) > 0 && c.isRespQueFull(size) {
+				dropped++
+				c.responeBytes -= c.responeQue[0].GetPackLen()
+				c.responeQue[0] = nil
+				c.responeQue = c.responeQue[1:]
+			}
+
+		case SOCK_SEND_POLICY_DISCONNECT:
+			err = ErrSlowConsumer
+
+		default:
+			err = ErrQueueFull
+		}
+	}
+
+	if err == nil {
+		c.responeQue = append(c.responeQue, p)
+		c.responeBytes += size
+	}
+	c.lckResp.Unlock()
+
+	if err != nil {
+		dropped++
+	}
+
+	if dropped > 0 {
+		metricSendDropped.With(mapSendPolicyName[policy]).Add(float64(dropped))
+	}
+
+	if err == ErrSlowConsumer {
+		c.Stop()
+		return err
+	}
+
+	if err == nil {
+		select {
+		case c.responeEvt <- true:
+		default:
+		}
+	}
+
+	return err
+}
+
+// GetRespQueLen get the count and the total bytes of the waiting packs
+func (c *SockConn) GetRespQueLen() (int, int) {
+	c.lckResp.Lock()
+	defer c.lckResp.Unlock()
+
+	return len(c.responeQue), c.responeBytes
+}
+
+// an empty queue always accepts a pack, otherwise a pack larger than
+// maxRespBytes could never be sent
+func (c *SockConn) isRespQueFull(size int) bool {
+	if len(c.responeQue) == 0 {
+		return false
+	}
+
+	if c.maxRespPacks > 0 && len(c.responeQue) >= c.maxRespPacks {
+		return true
+	}
+
+	if c.maxRespBytes > 0 && c.responeBytes+size > c.maxRespBytes {
+		return true
+	}
+
+	return false
+}
+
+func (c *SockConn) popAllResp() []*SockPack {
+	c.lckResp.Lock()
+	defer c.lckResp.Unlock()
+
+	packs := c.responeQue
+	c.responeQue = make([]*SockPack, 0)
+	c.responeBytes = 0
+	return packs
 }
 
 //===============================
@@ -97,18 +420,24 @@ func (c *SockConn) read() {
 		}
 
 		if err != nil {
-			fmt.Println("read data len error: ", err)
+			c.logger.D(LOG_TAG_CONN, "read data len error: ", err)
 			break
 		}
 
-		buff := make([]byte, len+SOCK_PACK_HEADER_LEN)
+		extLen := 0
+		if binary.BigEndian.Uint16(c.headerBuff) == GetPackTraceMark() {
+			extLen = SOCK_PACK_TRACE_LEN
+			atomic.StoreInt32(&c.traceMark, 1)
+		}
+
+		buff := make([]byte, int(len)+SOCK_PACK_HEADER_LEN+extLen)
 		copy(buff, c.headerBuff)
 
-		// read data
-		if len > 0 {
+		// read trace and data
+		if int(len)+extLen > 0 {
 			err = c.readData(buff[SOCK_PACK_HEADER_LEN:])
 			if err != nil {
-				fmt.Println("read data error: ", err)
+				c.logger.W(LOG_TAG_CONN, "read data error: ", err)
 				break
 			}
 		}
@@ -116,15 +445,23 @@ func (c *SockConn) read() {
 		// unpack
 		p, err := c.unpack(buff)
 		if err != nil {
-			fmt.Println("unpack error: ", err)
+			c.logger.W(LOG_TAG_CONN, "unpack error: ", err)
 			break
 		}
 
 		// push to request queue
-		c.requestQue <- NewSockPackWrap(p, c.conn)
+		p.startSpan()
+		observePackIn(p, c.metricCmdFilter)
+		c.recordRecv(p)
+		wrap := NewSockPackWrap(p, c.conn)
+		wrap.ConnId = c.id
+		c.requestQue <- wrap
 	}
 
-	c.closeWriteEvt <- true
+	atomic.StoreInt32(&c.readExit, 1)
+	if atomic.LoadInt32(&c.holdWrite) == 0 {
+		c.closeWriteEvt <- true
+	}
 }
 
 func (c *SockConn) isCloseRead() bool {
@@ -155,7 +492,7 @@ func (c *SockConn) readHeader(buff []byte) (uint16, error) {
 		return 0, err
 	}
 
-	if mark != GetPackMark() {
+	if mark != GetPackMark() && mark != GetPackTraceMark() {
 		err = errors.New("wrong start mark")
 		return 0, err
 	}
@@ -188,7 +525,7 @@ func (c *SockConn) readToBuff(buff []byte) (int, error) {
 			break
 		}
 
-		err = c.conn.SetReadDeadline(time.Now().Add(time.Second * SOCK_READ_DEAD_LINE))
+		err = c.setReadTimeout(time.Second * SOCK_READ_DEAD_LINE)
 		if err != nil {
 			break
 		}
@@ -205,6 +542,11 @@ func (c *SockConn) readToBuff(buff []byte) (int, error) {
 		break
 	}
 
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+		c.readTimer = nil
+	}
+
 	if err == nil && totalSize < buffLen {
 		err = errors.New("unexpect read end")
 	}
@@ -212,6 +554,33 @@ func (c *SockConn) readToBuff(buff []byte) (int, error) {
 	return totalSize, err
 }
 
+// setReadTimeout let the blocking read return after d by the clock of the conn.
+// The deadline of a net.Conn is in the wall time, so the read is woken by a timer
+// of the clock if it is not the real one
+func (c *SockConn) setReadTimeout(d time.Duration) error {
+	var err error = nil
+	if c.clock == util.RealClock {
+		err = c.conn.SetReadDeadline(time.Now().Add(d))
+	} else {
+		if c.readTimer != nil {
+			c.readTimer.Stop()
+		}
+
+		c.readTimer = c.clock.AfterFunc(d, func() {
+			c.conn.SetReadDeadline(sockWakeTime)
+		})
+
+		err = c.conn.SetReadDeadline(time.Time{})
+	}
+
+	// Stop may wake the read before the deadline is set
+	if err == nil && len(c.closeReadEvt) > 0 {
+		err = c.conn.SetReadDeadline(sockWakeTime)
+	}
+
+	return err
+}
+
 func (c *SockConn) unpack(buff []byte) (*SockPack, error) {
 	p := NewSockPack()
 	headerBuff := buff[SOCK_PACK_MARK_LEN:SOCK_PACK_HEADER_LEN]
@@ -251,9 +620,21 @@ func (c *SockConn) unpack(buff []byte) (*SockPack, error) {
 		return nil, err
 	}
 
+	// trace
+	dataBuff := buff[SOCK_PACK_HEADER_LEN:]
+	if binary.BigEndian.Uint16(buff) == GetPackTraceMark() {
+		if len(dataBuff) < SOCK_PACK_TRACE_LEN {
+			return nil, errors.New("short trace context")
+		}
+
+		p.TraceId = binary.BigEndian.Uint64(dataBuff)
+		p.SpanId = binary.BigEndian.Uint64(dataBuff[8:])
+		dataBuff = dataBuff[SOCK_PACK_TRACE_LEN:]
+	}
+
 	// data
 	if p.DataLen > 0 {
-		p.Data = buff[SOCK_PACK_HEADER_LEN:]
+		p.Data = dataBuff
 	}
 
 	p.RawBuff = buff
@@ -280,7 +661,7 @@ func (c *SockConn) write() {
 	/*if err == ErrStopSockWrite {
 
 	} else */if err != nil {
-		fmt.Println("write pack error: ", err)
+		c.logger.W(LOG_TAG_CONN, "write pack error: ", err)
 		c.Stop()
 		c.waitCloseWrite()
 	} else {
@@ -289,11 +670,15 @@ func (c *SockConn) write() {
 
 	// close
 	err = c.conn.Close()
-	if err != nil {
-		fmt.Println("close conn failed!")
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		c.logger.E(LOG_TAG_CONN, "close conn error: ", err)
 	}
 
 	// notify exit
+	if c.exitHook != nil {
+		c.exitHook()
+	}
+
 	c.exitEvt <- true
 }
 
@@ -302,10 +687,14 @@ func (c *SockConn) writeLogic() (bool, error) {
 	isExit := false
 
 	select {
-	case p := <-c.responeQue:
-		err = c.writePack(p)
-		if err != nil {
-			isExit = true
+	case <-c.responeEvt:
+		packs := c.popAllResp()
+		for _, p := range packs {
+			err = c.writePack(p)
+			if err != nil {
+				isExit = true
+				break
+			}
 		}
 
 	case <-c.closeWriteEvt:
@@ -336,6 +725,8 @@ func (c *SockConn) writePack(p *SockPack) error {
 		return err
 	}
 
+	observePackOut(p, c.metricCmdFilter)
+	atomic.AddUint64(&c.sentBytes, uint64(len(buff)))
 	return nil
 }
 
@@ -344,6 +735,10 @@ func (c *SockConn) writeHeader(buff []byte) error {
 }
 
 func (c *SockConn) writeData(buff []byte) error {
+	if len(buff) == 0 {
+		return nil
+	}
+
 	return c.writeBuff(buff)
 }
 
@@ -358,7 +753,10 @@ func (c *SockConn) writeBuff(buff []byte) error {
 }
 
 func (c *SockConn) pack(p *SockPack) ([]byte, error) {
-	if p.RawBuff != nil {
+	// a traced pack is rebuilt, so the raw buff of a forwarded pack carries the current span,
+	// and a raw buff with the trace mark is rebuilt without it for a peer not using the mark
+	traced := c.isTraceSerialized(p)
+	if p.RawBuff != nil && !traced && p.getDataOffset() == SOCK_PACK_HEADER_LEN {
 		return p.RawBuff, nil
 	}
 
@@ -367,11 +765,17 @@ func (c *SockConn) pack(p *SockPack) ([]byte, error) {
 		dataLen = uint16(len(p.Data))
 	}
 
-	buff := make([]byte, SOCK_PACK_HEADER_LEN+dataLen)
-	buffWrap := bytes.NewBuffer(buff)
+	var mark uint16 = GetPackMark()
+	extLen := 0
+	if traced {
+		mark = GetPackTraceMark()
+		extLen = SOCK_PACK_TRACE_LEN
+	}
+
+	buff := make([]byte, SOCK_PACK_HEADER_LEN+extLen+int(dataLen))
+	buffWrap := bytes.NewBuffer(buff[:0])
 
 	// mark
-	var mark uint16 = GetPackMark()
 	err := binary.Write(buffWrap, binary.BigEndian, &mark)
 	if err != nil {
 		return nil, err
@@ -413,9 +817,15 @@ func (c *SockConn) pack(p *SockPack) ([]byte, error) {
 		return nil, err
 	}
 
+	// trace
+	if extLen > 0 {
+		binary.BigEndian.PutUint64(buff[SOCK_PACK_HEADER_LEN:], p.TraceId)
+		binary.BigEndian.PutUint64(buff[SOCK_PACK_HEADER_LEN+8:], p.SpanId)
+	}
+
 	// data
 	if dataLen > 0 {
-		subBuff := buff[SOCK_PACK_HEADER_LEN:]
+		subBuff := buff[SOCK_PACK_HEADER_LEN+extLen:]
 		copy(subBuff, p.Data)
 	}
 
@@ -427,15 +837,11 @@ func (c *SockConn) waitCloseWrite() {
 }
 
 func (c *SockConn) writeAllResp() {
-	for {
-		select {
-		case p := <-c.responeQue:
-			c.writePack(p)
-		default:
-			goto Exit0
+	packs := c.popAllResp()
+	for _, p := range packs {
+		err := c.writePack(p)
+		if err != nil {
+			break
 		}
 	}
-
-Exit0:
-	return
 }
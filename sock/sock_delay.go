@@ -0,0 +1,123 @@
+package sock
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+// sockDelayQue the packs of a conn waiting for the rate limits, in the receiving order.
+// The head has taken its tokens and waits for the timer, the others are checked when they reach the head
+type sockDelayQue struct {
+	connId  uint64
+	packs   []*SockPackWrap
+	timer   util.ClockTimer
+	dropped int32 // set when the queue is dropped, the timer gives up
+}
+
+// startDelay begin a delay queue with the pack, on the manager loop
+func (m *SockMgr) startDelay(wrap *SockPackWrap, wait time.Duration) {
+	q := &sockDelayQue{
+		connId: wrap.ConnId,
+		packs:  make([]*SockPackWrap, 0, 1),
+	}
+
+	m.mapDelayQue[wrap.ConnId] = q
+	m.pushDelayed(q, wrap)
+	m.scheduleDelayed(q, wait)
+}
+
+func (m *SockMgr) pushDelayed(q *sockDelayQue, wrap *SockPackWrap) {
+	q.packs = append(q.packs, wrap)
+	atomic.AddInt64(&m.limiter.delayed, 1)
+}
+
+func (m *SockMgr) popDelayed(q *sockDelayQue) *SockPackWrap {
+	wrap := q.packs[0]
+	q.packs[0] = nil
+	q.packs = q.packs[1:]
+	atomic.AddInt64(&m.limiter.delayed, -1)
+	return wrap
+}
+
+// scheduleDelayed release the queue on the manager loop after the wait.
+// The timer only posts a task, so it never blocks even if the loop has exited
+func (m *SockMgr) scheduleDelayed(q *sockDelayQue, wait time.Duration) {
+	q.timer = m.clock.AfterFunc(wait, func() {
+		m.postDelayed(q)
+	})
+}
+
+// postDelayed run on the timer goroutine, a retry timer is not kept in the queue,
+// it gives up by itself once the queue is dropped
+func (m *SockMgr) postDelayed(q *sockDelayQue) {
+	if atomic.LoadInt32(&q.dropped) == 1 {
+		return
+	}
+
+	err := m.Post(func() {
+		m.releaseDelayed(q)
+	})
+
+	// try again later if the task queue is full
+	if err != nil {
+		m.clock.AfterFunc(SOCK_SHUTDOWN_CHECK_INTV, func() {
+			m.postDelayed(q)
+		})
+	}
+}
+
+// releaseDelayed handle the head of the queue, then the packs behind it until one exceeds the limits again
+func (m *SockMgr) releaseDelayed(q *sockDelayQue) {
+	if m.mapDelayQue[q.connId] != q {
+		return
+	}
+
+	m.deliver(m.popDelayed(q))
+	for len(q.packs) > 0 {
+		action, wait := m.limiter.check(q.packs[0])
+		if wait == 0 {
+			m.deliver(m.popDelayed(q))
+			continue
+		}
+
+		metricRateLimited.With(mapLimitActionName[action]).Inc()
+		if action == SOCK_LIMIT_ACTION_DELAY {
+			m.scheduleDelayed(q, wait)
+			return
+		}
+
+		m.applyLimitAction(action, m.popDelayed(q))
+	}
+
+	delete(m.mapDelayQue, q.connId)
+}
+
+// dropDelayed drop the delayed packs of a conn, return the dropped count
+func (m *SockMgr) dropDelayed(connId uint64) int {
+	q := m.mapDelayQue[connId]
+	if q == nil {
+		return 0
+	}
+
+	delete(m.mapDelayQue, connId)
+	atomic.StoreInt32(&q.dropped, 1)
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+
+	cnt := len(q.packs)
+	atomic.AddInt64(&m.limiter.delayed, -int64(cnt))
+	return cnt
+}
+
+// dropAllDelayed drop the delayed packs of all the conns when the manager stops
+func (m *SockMgr) dropAllDelayed() int {
+	cnt := 0
+	for connId := range m.mapDelayQue {
+		cnt += m.dropDelayed(connId)
+	}
+
+	return cnt
+}
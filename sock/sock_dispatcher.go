@@ -0,0 +1,258 @@
+package sock
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	SOCK_DISPATCH_QUE_MAX = 256
+)
+
+var (
+	ErrDispatchQueFull error = errors.New("dispatch queue full")
+	ErrDispatchStopped error = errors.New("dispatcher stopped")
+)
+
+// SockDispatchKeyFunc map a pack to an ordering key,
+// the packs with the same key are handled one by one in the receiving order
+type SockDispatchKeyFunc func(wrap *SockPackWrap) uint64
+
+// SockDispatchByConn keep the packs of the same conn in order
+func SockDispatchByConn(wrap *SockPackWrap) uint64 {
+	return wrap.ConnId
+}
+
+type SockDispatcherStats struct {
+	Workers    int
+	QueueCap   int    // capacity of the queue of each key
+	QueueDepth int    // packs waiting in all the key queues
+	Keys       int    // keys with packs waiting or running
+	Busy       int    // workers running a handler
+	Rejected   uint64 // packs rejected by a full key queue
+	Handled    uint64
+}
+
+// sockDispatchQue the packs of a key waiting for a worker,
+// active when the key is in the ready list or running on a worker
+type sockDispatchQue struct {
+	key    uint64
+	packs  []*SockPackWrap
+	active bool
+}
+
+// SockDispatcher run the handlers on a bounded worker pool.
+// Every key has its own queue, and at most one worker runs a key at a time,
+// so the packs of one key keep their order while different keys run in parallel.
+// Dispatch never blocks: a slow key only stalls its own packs, and when its queue is full
+// the new packs of that key are rejected with ErrDispatchQueFull
+type SockDispatcher struct {
+	workers    int
+	queSize    int
+	keyFunc    SockDispatchKeyFunc
+	handler    func(p *SockPack, c net.Conn)
+	crash      *util.CrashHandler
+	lck        sync.Mutex
+	cond       *sync.Cond
+	mapKey2Que map[uint64]*sockDispatchQue
+	ready      []*sockDispatchQue
+	stopped    bool
+	busy       int32
+	pending    int64 // queued and running packs
+	rejected   uint64
+	handled    uint64
+}
+
+// NewSockDispatcher create a dispatcher with the workers, queSize is the max packs waiting per key
+func NewSockDispatcher(workers int, queSize int, keyFunc SockDispatchKeyFunc) *SockDispatcher {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	if queSize <= 0 {
+		queSize = SOCK_DISPATCH_QUE_MAX
+	}
+
+	if keyFunc == nil {
+		keyFunc = SockDispatchByConn
+	}
+
+	d := &SockDispatcher{
+		workers:    workers,
+		queSize:    queSize,
+		keyFunc:    keyFunc,
+		handler:    nil,
+		crash:      nil,
+		mapKey2Que: make(map[uint64]*sockDispatchQue),
+		ready:      make([]*sockDispatchQue, 0),
+		stopped:    false,
+		busy:       0,
+		pending:    0,
+		rejected:   0,
+		handled:    0,
+	}
+
+	d.cond = sync.NewCond(&d.lck)
+	return d
+}
+
+// SetCrashHandler write a crash file when a handler panics on a worker, it must be set before Start
+func (d *SockDispatcher) SetCrashHandler(h *util.CrashHandler) {
+	d.crash = h
+}
+
+func (d *SockDispatcher) Start(handler func(p *SockPack, c net.Conn)) {
+	d.handler = handler
+	for i := 0; i < d.workers; i++ {
+		go d.work()
+	}
+}
+
+// Stop let the workers exit after the queued packs are handled, it does not wait
+func (d *SockDispatcher) Stop() {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+
+	d.stopped = true
+	d.cond.Broadcast()
+}
+
+// Dispatch push the pack to the queue of its key without blocking.
+// ErrDispatchQueFull is returned if the key already has queSize packs waiting
+func (d *SockDispatcher) Dispatch(wrap *SockPackWrap) error {
+	key := d.keyFunc(wrap)
+
+	d.lck.Lock()
+	defer d.lck.Unlock()
+
+	if d.stopped {
+		return ErrDispatchStopped
+	}
+
+	q := d.mapKey2Que[key]
+	if q == nil {
+		q = &sockDispatchQue{key: key, packs: make([]*SockPackWrap, 0, 1)}
+		d.mapKey2Que[key] = q
+	}
+
+	if len(q.packs) >= d.queSize {
+		atomic.AddUint64(&d.rejected, 1)
+		return ErrDispatchQueFull
+	}
+
+	q.packs = append(q.packs, wrap)
+	atomic.AddInt64(&d.pending, 1)
+	if !q.active {
+		q.active = true
+		d.ready = append(d.ready, q)
+		d.cond.Signal()
+	}
+
+	return nil
+}
+
+// Discard drop the packs still waiting in the queues, return the dropped count
+func (d *SockDispatcher) Discard() int {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+
+	cnt := 0
+	for _, q := range d.mapKey2Que {
+		cnt += len(q.packs)
+		q.packs = nil
+	}
+
+	atomic.AddInt64(&d.pending, -int64(cnt))
+	return cnt
+}
+
+// GetPending get the count of the packs queued or being handled
+func (d *SockDispatcher) GetPending() int {
+	return int(atomic.LoadInt64(&d.pending))
+}
+
+func (d *SockDispatcher) GetStats() SockDispatcherStats {
+	d.lck.Lock()
+	depth := 0
+	for _, q := range d.mapKey2Que {
+		depth += len(q.packs)
+	}
+
+	keys := len(d.mapKey2Que)
+	d.lck.Unlock()
+
+	return SockDispatcherStats{
+		Workers:    d.workers,
+		QueueCap:   d.queSize,
+		QueueDepth: depth,
+		Keys:       keys,
+		Busy:       int(atomic.LoadInt32(&d.busy)),
+		Rejected:   atomic.LoadUint64(&d.rejected),
+		Handled:    atomic.LoadUint64(&d.handled),
+	}
+}
+
+// work handle the packs of the ready keys, the lock is not held while a handler runs,
+// so it is not unlocked by a defer which a panic of the handler would run
+func (d *SockDispatcher) work() {
+	if d.crash != nil {
+		defer d.crash.Recover()
+	}
+
+	d.lck.Lock()
+	for {
+		for len(d.ready) == 0 && !d.stopped {
+			d.cond.Wait()
+		}
+
+		if len(d.ready) == 0 {
+			d.lck.Unlock()
+			return
+		}
+
+		q := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+
+		// the packs may be discarded after the key became ready
+		if len(q.packs) == 0 {
+			q.active = false
+			delete(d.mapKey2Que, q.key)
+			continue
+		}
+
+		wrap := q.packs[0]
+		q.packs[0] = nil
+		q.packs = q.packs[1:]
+
+		d.lck.Unlock()
+		atomic.AddInt32(&d.busy, 1)
+		d.handler(wrap.Pack, wrap.Conn)
+		atomic.AddInt32(&d.busy, -1)
+		atomic.AddUint64(&d.handled, 1)
+		atomic.AddInt64(&d.pending, -1)
+		d.lck.Lock()
+
+		// go to the back of the ready list, so a busy key does not starve the others
+		if len(q.packs) > 0 {
+			d.ready = append(d.ready, q)
+		} else {
+			q.active = false
+			delete(d.mapKey2Que, q.key)
+		}
+	}
+}
+
+func newBusyPack(p *SockPack) *SockPack {
+	resp := GetRespSockPack(p)
+	resp.Cmd = SOCK_CMD_BUSY
+	resp.Data = make([]byte, 2)
+	binary.BigEndian.PutUint16(resp.Data, p.Cmd)
+	resp.DataLen = uint16(len(resp.Data))
+	return resp
+}
@@ -0,0 +1,402 @@
+package sock
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	SOCK_CMD_RATE_LIMITED uint16        = 0xFFFE
+	SOCK_LIMIT_MAX_DELAY  time.Duration = (2 * time.Second)
+)
+
+// SockLimitAction decides what happens to a pack exceeding a limit
+type SockLimitAction int
+
+const (
+	SOCK_LIMIT_ACTION_DROP       SockLimitAction = 0
+	SOCK_LIMIT_ACTION_DELAY      SockLimitAction = 1 // handle it later, drop it if the delay is too long
+	SOCK_LIMIT_ACTION_ERROR      SockLimitAction = 2 // drop it and respond SOCK_CMD_RATE_LIMITED
+	SOCK_LIMIT_ACTION_DISCONNECT SockLimitAction = 3
+)
+
+// SockRateLimit is a pair of token buckets, a rate <= 0 means unlimited.
+// A burst <= 0 defaults to one second of the rate, a pack larger than the byte burst
+// passes when the bucket is full and delays the packs after it
+type SockRateLimit struct {
+	PacksPerSec float64
+	PackBurst   float64
+	BytesPerSec float64
+	ByteBurst   float64
+}
+
+type SockLimiterStats struct {
+	Allowed      uint64
+	Dropped      uint64
+	Delayed      uint64
+	Errored      uint64
+	Disconnected uint64
+}
+
+type sockBuckets struct {
+	packs *util.TokenBucket
+	bytes *util.TokenBucket
+}
+
+func newSockBuckets(limit *SockRateLimit, clock util.Clock) *sockBuckets {
+	b := &sockBuckets{
+		packs: nil,
+		bytes: nil,
+	}
+
+	if limit.PacksPerSec > 0 {
+		b.packs = util.NewTokenBucket(limit.PacksPerSec, limit.PackBurst)
+	}
+
+	if limit.BytesPerSec > 0 {
+		b.bytes = util.NewTokenBucket(limit.BytesPerSec, limit.ByteBurst)
+	}
+
+	b.setClock(clock)
+	return b
+}
+
+func (b *sockBuckets) setClock(c util.Clock) {
+	if b.packs != nil {
+		b.packs.SetClock(c)
+	}
+
+	if b.bytes != nil {
+		b.bytes.SetClock(c)
+	}
+}
+
+func (b *sockBuckets) wait(size int) time.Duration {
+	var wait time.Duration = 0
+	if b.packs != nil {
+		wait = b.packs.Wait(1)
+	}
+
+	if b.bytes != nil {
+		bytesWait := b.bytes.Wait(float64(size))
+		if bytesWait > wait {
+			wait = bytesWait
+		}
+	}
+
+	return wait
+}
+
+func (b *sockBuckets) take(size int) {
+	if b.packs != nil {
+		b.packs.Take(1)
+	}
+
+	if b.bytes != nil {
+		b.bytes.Take(float64(size))
+	}
+}
+
+func (b *sockBuckets) isFull() bool {
+	return (b.packs == nil || b.packs.IsFull()) && (b.bytes == nil || b.bytes.IsFull())
+}
+
+type sockConnBuckets struct {
+	conn     *sockBuckets
+	mapCmd   map[uint16]*sockBuckets
+	override *SockRateLimit
+}
+
+// SockLimiter limit the inbound packs before they reach SockListener.OnHandlePack.
+// The limits are checked globally, per conn, per source ip and per cmd of each conn
+type SockLimiter struct {
+	lck          sync.Mutex
+	action       SockLimitAction
+	maxDelay     time.Duration
+	global       *sockBuckets
+	connLimit    *SockRateLimit
+	ipLimit      *SockRateLimit
+	mapCmdLimit  map[uint16]*SockRateLimit
+	mapIp        map[string]*sockBuckets
+	mapConn      map[uint64]*sockConnBuckets
+	delayed      int64
+	allowed      uint64
+	dropped      uint64
+	delayedTotal uint64
+	errored      uint64
+	disconnected uint64
+	clock        util.Clock
+}
+
+func NewSockLimiter(action SockLimitAction) *SockLimiter {
+	return &SockLimiter{
+		action:      action,
+		maxDelay:    SOCK_LIMIT_MAX_DELAY,
+		global:      nil,
+		connLimit:   nil,
+		ipLimit:     nil,
+		mapCmdLimit: make(map[uint16]*SockRateLimit),
+		mapIp:       make(map[string]*sockBuckets),
+		mapConn:     make(map[uint64]*sockConnBuckets),
+		clock:       util.RealClock,
+	}
+}
+
+// SetClock set the clock of the buckets, the sock manager sets its clock
+func (l *SockLimiter) SetClock(c util.Clock) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	l.clock = c
+	if l.global != nil {
+		l.global.setClock(c)
+	}
+
+	for _, b := range l.mapIp {
+		b.setClock(c)
+	}
+
+	for _, cb := range l.mapConn {
+		if cb.conn != nil {
+			cb.conn.setClock(c)
+		}
+
+		for _, b := range cb.mapCmd {
+			b.setClock(c)
+		}
+	}
+}
+
+// SetAction set the action on exceeding, maxDelay is only used by SOCK_LIMIT_ACTION_DELAY
+func (l *SockLimiter) SetAction(action SockLimitAction, maxDelay time.Duration) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	l.action = action
+	l.maxDelay = maxDelay
+}
+
+// SetGlobalLimit limit all the conns together, nil to remove
+func (l *SockLimiter) SetGlobalLimit(limit *SockRateLimit) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	l.global = nil
+	if limit != nil {
+		l.global = newSockBuckets(limit, l.clock)
+	}
+}
+
+// SetConnLimit limit each conn, nil to remove
+func (l *SockLimiter) SetConnLimit(limit *SockRateLimit) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	l.connLimit = limit
+	for _, b := range l.mapConn {
+		b.conn = nil
+	}
+}
+
+// SetIpLimit limit the conns from the same ip together, nil to remove
+func (l *SockLimiter) SetIpLimit(limit *SockRateLimit) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	l.ipLimit = limit
+	l.mapIp = make(map[string]*sockBuckets)
+}
+
+// SetCmdLimit limit a cmd of each conn, nil to remove
+func (l *SockLimiter) SetCmdLimit(cmd uint16, limit *SockRateLimit) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	if limit == nil {
+		delete(l.mapCmdLimit, cmd)
+	} else {
+		l.mapCmdLimit[cmd] = limit
+	}
+
+	for _, b := range l.mapConn {
+		delete(b.mapCmd, cmd)
+	}
+}
+
+// SetConnOverride replace the conn limit of one conn, nil to restore
+func (l *SockLimiter) SetConnOverride(connId uint64, limit *SockRateLimit) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	b := l.getConnBuckets(connId)
+	b.override = limit
+	b.conn = nil
+}
+
+func (l *SockLimiter) RemoveConn(connId uint64) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	delete(l.mapConn, connId)
+}
+
+// Clean remove the idle ip buckets
+func (l *SockLimiter) Clean() {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	for ip, b := range l.mapIp {
+		if b.isFull() {
+			delete(l.mapIp, ip)
+		}
+	}
+}
+
+// GetDelayed get the count of the packs waiting for the delay
+func (l *SockLimiter) GetDelayed() int {
+	return int(atomic.LoadInt64(&l.delayed))
+}
+
+func (l *SockLimiter) GetStats() SockLimiterStats {
+	return SockLimiterStats{
+		Allowed:      atomic.LoadUint64(&l.allowed),
+		Dropped:      atomic.LoadUint64(&l.dropped),
+		Delayed:      atomic.LoadUint64(&l.delayedTotal),
+		Errored:      atomic.LoadUint64(&l.errored),
+		Disconnected: atomic.LoadUint64(&l.disconnected),
+	}
+}
+
+// check return the action and the delay for the pack,
+// the action is meaningless when the delay is 0
+func (l *SockLimiter) check(wrap *SockPackWrap) (SockLimitAction, time.Duration) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	size := wrap.Pack.GetPackLen()
+	buckets := l.getBucketsOf(wrap)
+	var wait time.Duration = 0
+	for _, b := range buckets {
+		bWait := b.wait(size)
+		if bWait > wait {
+			wait = bWait
+		}
+	}
+
+	if wait == 0 || (l.action == SOCK_LIMIT_ACTION_DELAY && wait <= l.maxDelay) {
+		for _, b := range buckets {
+			b.take(size)
+		}
+	}
+
+	if wait == 0 {
+		atomic.AddUint64(&l.allowed, 1)
+		return l.action, 0
+	}
+
+	switch l.action {
+	case SOCK_LIMIT_ACTION_DELAY:
+		if wait > l.maxDelay {
+			atomic.AddUint64(&l.dropped, 1)
+			return SOCK_LIMIT_ACTION_DROP, wait
+		}
+
+		atomic.AddUint64(&l.delayedTotal, 1)
+
+	case SOCK_LIMIT_ACTION_ERROR:
+		atomic.AddUint64(&l.errored, 1)
+
+	case SOCK_LIMIT_ACTION_DISCONNECT:
+		atomic.AddUint64(&l.disconnected, 1)
+
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+
+	return l.action, wait
+}
+
+func (l *SockLimiter) getBucketsOf(wrap *SockPackWrap) []*sockBuckets {
+	buckets := make([]*sockBuckets, 0, 4)
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+
+	if l.ipLimit != nil && wrap.Conn != nil {
+		ip := GetRemoteIp(wrap.Conn)
+		b := l.mapIp[ip]
+		if b == nil {
+			b = newSockBuckets(l.ipLimit, l.clock)
+			l.mapIp[ip] = b
+		}
+
+		buckets = append(buckets, b)
+	}
+
+	connBuckets := l.getConnBuckets(wrap.ConnId)
+	limit := connBuckets.override
+	if limit == nil {
+		limit = l.connLimit
+	}
+
+	if limit != nil {
+		if connBuckets.conn == nil {
+			connBuckets.conn = newSockBuckets(limit, l.clock)
+		}
+
+		buckets = append(buckets, connBuckets.conn)
+	}
+
+	cmdLimit := l.mapCmdLimit[wrap.Pack.Cmd]
+	if cmdLimit != nil {
+		b := connBuckets.mapCmd[wrap.Pack.Cmd]
+		if b == nil {
+			b = newSockBuckets(cmdLimit, l.clock)
+			connBuckets.mapCmd[wrap.Pack.Cmd] = b
+		}
+
+		buckets = append(buckets, b)
+	}
+
+	return buckets
+}
+
+func (l *SockLimiter) getConnBuckets(connId uint64) *sockConnBuckets {
+	b := l.mapConn[connId]
+	if b == nil {
+		b = &sockConnBuckets{
+			conn:     nil,
+			mapCmd:   make(map[uint16]*sockBuckets),
+			override: nil,
+		}
+
+		l.mapConn[connId] = b
+	}
+
+	return b
+}
+
+// GetRemoteIp get the ip part of the remote address
+func GetRemoteIp(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+func newRateLimitedPack(p *SockPack) *SockPack {
+	resp := GetRespSockPack(p)
+	resp.Cmd = SOCK_CMD_RATE_LIMITED
+	resp.Data = make([]byte, 2)
+	binary.BigEndian.PutUint16(resp.Data, p.Cmd)
+	resp.DataLen = uint16(len(resp.Data))
+	return resp
+}
@@ -8,3 +8,10 @@ type SockListener interface {
 	OnSockError(c net.Conn)
 	OnHandlePack(p *SockPack, c net.Conn)
 }
+
+// SockPackFilter is an optional interface of SockListener,
+// it is called on the manager loop before a pack is dispatched, so it sees the packs of a conn in order.
+// The pack is dropped if it returns false
+type SockPackFilter interface {
+	FilterPack(p *SockPack, c net.Conn) bool
+}
@@ -0,0 +1,135 @@
+package sock
+
+import (
+	"strconv"
+
+	"github.com/wuyiyinxia/yxlib/metrics"
+)
+
+var (
+	metricConnOpened  = metrics.DefaultRegistry.NewCounter("yxlib_sock_conns_opened_total", "Conns added to the sock managers.")
+	metricConnClosed  = metrics.DefaultRegistry.NewCounter("yxlib_sock_conns_closed_total", "Conns removed from the sock managers.")
+	metricPacksIn     = metrics.DefaultRegistry.NewCounterVec("yxlib_sock_packs_received_total", "Packs read from the conns.", "cmd")
+	metricPacksOut    = metrics.DefaultRegistry.NewCounterVec("yxlib_sock_packs_sent_total", "Packs written to the conns.", "cmd")
+	metricBytesIn     = metrics.DefaultRegistry.NewCounter("yxlib_sock_received_bytes_total", "Bytes read from the conns.")
+	metricBytesOut    = metrics.DefaultRegistry.NewCounter("yxlib_sock_sent_bytes_total", "Bytes written to the conns.")
+	metricFrameBytes  = metrics.DefaultRegistry.NewHistogramVec("yxlib_sock_frame_bytes", "Size of the packs.", metrics.BytesBuckets, "dir")
+	metricSendDropped = metrics.DefaultRegistry.NewCounterVec("yxlib_sock_send_dropped_total", "Outbound packs dropped by the send policy.", "policy")
+	metricRateLimited = metrics.DefaultRegistry.NewCounterVec("yxlib_sock_rate_limited_total", "Inbound packs exceeding the rate limits.", "action")
+	metricRejected    = metrics.DefaultRegistry.NewCounterVec("yxlib_sock_rejected_total", "Accepted sockets rejected by the admission control.", "reason")
+)
+
+const (
+	SOCK_METRIC_CMD_OTHER = "other"
+)
+
+// SockMetricCmdFilter return true if the packs of the cmd are counted by their own label
+type SockMetricCmdFilter func(cmd uint16) bool
+
+var mapRejectReasonName = map[error]string{
+	ErrRejectMaxConn:      "max_conn",
+	ErrRejectMaxConnPerIp: "max_per_ip",
+	ErrRejectDenied:       "denied",
+	ErrRejectBanned:       "banned",
+}
+
+var mapSendPolicyName = map[SockSendPolicy]string{
+	SOCK_SEND_POLICY_ERROR:       "error",
+	SOCK_SEND_POLICY_DROP_NEWEST: "drop_newest",
+	SOCK_SEND_POLICY_DROP_OLDEST: "drop_oldest",
+	SOCK_SEND_POLICY_DISCONNECT:  "disconnect",
+}
+
+var mapLimitActionName = map[SockLimitAction]string{
+	SOCK_LIMIT_ACTION_DROP:       "drop",
+	SOCK_LIMIT_ACTION_DELAY:      "delay",
+	SOCK_LIMIT_ACTION_ERROR:      "error",
+	SOCK_LIMIT_ACTION_DISCONNECT: "disconnect",
+}
+
+// observePackIn count the pack, the cmds not passing the filter are counted as other,
+// so the peers cannot grow the labels without limit
+func observePackIn(p *SockPack, filter SockMetricCmdFilter) {
+	size := float64(p.GetPackLen())
+	metricPacksIn.With(getMetricCmd(p.Cmd, filter)).Inc()
+	metricBytesIn.Add(size)
+	metricFrameBytes.With("in").Observe(size)
+}
+
+// observePackOut count the pack with the same filter, the respones echo the cmds of the peers
+func observePackOut(p *SockPack, filter SockMetricCmdFilter) {
+	size := float64(p.GetPackLen())
+	metricPacksOut.With(getMetricCmd(p.Cmd, filter)).Inc()
+	metricBytesOut.Add(size)
+	metricFrameBytes.With("out").Observe(size)
+}
+
+func getMetricCmd(cmd uint16, filter SockMetricCmdFilter) string {
+	if filter != nil && filter(cmd) {
+		return strconv.Itoa(int(cmd))
+	}
+
+	return SOCK_METRIC_CMD_OTHER
+}
+
+// RegisterMetrics expose the queue depths of the manager,
+// the gauges of another manager registered before are replaced
+func (m *SockMgr) RegisterMetrics(r *metrics.Registry) {
+	r.NewGaugeFunc("yxlib_sock_conns", "Conns in the sock manager.", func() float64 {
+		return float64(m.GetConnCount())
+	})
+
+	r.NewGaugeFunc("yxlib_sock_conn_ids_in_use", "Conn ids allocated and not freed.", func() float64 {
+		return float64(m.connIdGen.GetInUseCount())
+	})
+
+	r.NewGaugeFunc("yxlib_sock_recv_queue_depth", "Packs waiting in the receive queue.", func() float64 {
+		return float64(len(m.recvQue))
+	})
+
+	r.NewGaugeFunc("yxlib_sock_resp_queue_packs", "Packs waiting in the respone queues of all the conns.", func() float64 {
+		packs, _ := m.getRespQueLen()
+		return float64(packs)
+	})
+
+	r.NewGaugeFunc("yxlib_sock_resp_queue_bytes", "Bytes waiting in the respone queues of all the conns.", func() float64 {
+		_, bytes := m.getRespQueLen()
+		return float64(bytes)
+	})
+
+	r.NewGaugeFunc("yxlib_sock_dispatch_queue_depth", "Packs waiting in the dispatcher queues.", func() float64 {
+		if m.dispatcher == nil {
+			return 0
+		}
+
+		return float64(m.dispatcher.GetStats().QueueDepth)
+	})
+
+	r.NewGaugeFunc("yxlib_sock_dispatch_busy", "Dispatcher workers running a handler.", func() float64 {
+		if m.dispatcher == nil {
+			return 0
+		}
+
+		return float64(m.dispatcher.GetStats().Busy)
+	})
+
+	r.NewCounterFunc("yxlib_sock_dispatch_rejected_total", "Packs rejected by a full dispatcher key queue.", func() float64 {
+		if m.dispatcher == nil {
+			return 0
+		}
+
+		return float64(m.dispatcher.GetStats().Rejected)
+	})
+}
+
+func (m *SockMgr) getRespQueLen() (int, int) {
+	totalPacks := 0
+	totalBytes := 0
+	for _, conn := range m.getAllConns() {
+		packs, bytes := conn.GetRespQueLen()
+		totalPacks += packs
+		totalBytes += bytes
+	}
+
+	return totalPacks, totalBytes
+}
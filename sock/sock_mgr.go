@@ -1,55 +1,279 @@
 package sock
 
 import (
+	"context"
 	"errors"
+	"math"
 	"net"
+	"sort"
+	"sync"
 	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	LOG_TAG_SM = "SockMgr"
 )
 
 const (
 	SOCK_CONN_ADD_QUE_MAX     uint16        = 1024
 	SOCK_CONN_CLOSE_QUE_MAX   uint16        = 1024
-	SOCK_SEND_QUE_MAX         uint16        = 1024
 	SOCK_RECV_QUE_MAX         uint16        = 1024
+	SOCK_TASK_QUE_MAX         uint16        = 1024
 	SOCK_MAINTAIN_INTV        time.Duration = (2 * time.Minute)
 	SOCK_MGR_CLOSE_DELAY      time.Duration = (2 * time.Minute)
 	SOCK_CHECK_ALL_CLOSE_INTV time.Duration = (2 * time.Second)
+	SOCK_SHUTDOWN_CHECK_INTV  time.Duration = (50 * time.Millisecond)
+	SOCK_CONN_ID_QUARANTINE   time.Duration = (2 * time.Minute)
+)
+
+const (
+	SOCK_CMD_KICKED uint16 = 0xFFFC // sent to a kicked conn, the data is the reason
+	SOCK_CMD_BUSY   uint16 = 0xFFFB // the respone of a pack rejected by a full dispatcher key queue, the data is the cmd
+)
+
+var (
+	ErrConnNotFound    error = errors.New("conn not found")
+	ErrConnIdExhausted error = errors.New("conn id exhausted")
+	ErrTaskQueFull     error = errors.New("task queue full")
+	ErrMgrStopped      error = errors.New("sock manager stopped")
 )
 
 type SockMgr struct {
 	endType      uint8
 	endNo        uint16
+	lckConn      sync.RWMutex
+	connIdGen    *util.IdGenerator
 	mapConn      map[net.Conn]*SockConn
-	connAddQue   chan net.Conn
+	connAddQue   chan *SockConn
 	connCloseQue chan net.Conn
-	sendQue      chan *SockPackWrap
 	recvQue      chan *SockPackWrap
+	taskQue      chan func()
+	mapDelayQue  map[uint64]*sockDelayQue // only used on the manager loop
 	closeEvt     chan bool
+	shutdownEvt  chan *sockShutdownReq
+	loopExitEvt  chan bool // closed when the manager loop exits
 	stopAddEvt   chan bool
 	listener     SockListener
+	dispatcher   *SockDispatcher
+	limiter      *SockLimiter
+	admission    *SockAdmission
+	goodbye      *SockPack
+	sendPolicy   SockSendPolicy
+	maxRespPacks int
+	maxRespBytes int
+	cmdFilter    SockMetricCmdFilter
+	crash        *util.CrashHandler
+	logger       util.ILogger
+	clock        util.Clock
 }
 
 func NewSockMgr(endType uint8, endNo uint16) *SockMgr {
-	return &SockMgr{
+	m := &SockMgr{
 		endType:      endType,
 		endNo:        endNo,
+		connIdGen:    util.NewIdGenerator(1, math.MaxUint64),
 		mapConn:      make(map[net.Conn]*SockConn),
-		connAddQue:   make(chan net.Conn, SOCK_CONN_ADD_QUE_MAX),
+		connAddQue:   make(chan *SockConn, SOCK_CONN_ADD_QUE_MAX),
 		connCloseQue: make(chan net.Conn, SOCK_CONN_CLOSE_QUE_MAX),
-		sendQue:      make(chan *SockPackWrap, SOCK_SEND_QUE_MAX),
 		recvQue:      make(chan *SockPackWrap, SOCK_RECV_QUE_MAX),
+		taskQue:      make(chan func(), SOCK_TASK_QUE_MAX),
+		mapDelayQue:  make(map[uint64]*sockDelayQue),
 		closeEvt:     make(chan bool, 1),
+		shutdownEvt:  make(chan *sockShutdownReq, 1),
+		loopExitEvt:  make(chan bool),
 		stopAddEvt:   make(chan bool, 1),
 		listener:     nil,
+		dispatcher:   nil,
+		limiter:      nil,
+		admission:    nil,
+		goodbye:      nil,
+		sendPolicy:   SOCK_SEND_POLICY_ERROR,
+		maxRespPacks: SOCK_MAX_RESP_QUE,
+		maxRespBytes: SOCK_MAX_RESP_BYTES,
+		cmdFilter:    nil,
+		crash:        nil,
+		logger:       util.Logger,
+		clock:        util.RealClock,
 	}
+
+	// the ids of the closed conns may still be referred by the limiter, the dispatcher and the logs,
+	// the range is never used up in practice so the ids are not reused, the quarantine is the guard after that
+	m.connIdGen.SetQuarantine(SOCK_CONN_ID_QUARANTINE)
+	return m
 }
 
 func (m *SockMgr) SetListener(l SockListener) {
 	m.listener = l
 }
 
+// SetLogger write the logs of the manager and the conns added later to l,
+// util.Logger by default
+func (m *SockMgr) SetLogger(l util.ILogger) {
+	m.logger = l
+}
+
+func (m *SockMgr) GetLogger() util.ILogger {
+	return m.logger
+}
+
+// SetClock set the clock of the tickers, the delays, the rate limits, the bans and the conn times and reads,
+// it must be set before Start
+func (m *SockMgr) SetClock(c util.Clock) {
+	m.clock = c
+	m.connIdGen.SetClock(c)
+	if m.limiter != nil {
+		m.limiter.SetClock(c)
+	}
+
+	if m.admission != nil {
+		m.admission.SetClock(c)
+	}
+}
+
+func (m *SockMgr) GetClock() util.Clock {
+	return m.clock
+}
+
+// GetConnLogger get the logger carrying the context of the conn and the trace of the pack being handled,
+// or the manager logger if the conn is not found
+func (m *SockMgr) GetConnLogger(c net.Conn) util.ILogger {
+	conn := m.getConn(c)
+	if conn == nil {
+		return m.logger
+	}
+
+	return conn.GetLogger()
+}
+
+// GetPackLogger get the conn logger carrying the trace of the pack
+func (m *SockMgr) GetPackLogger(p *SockPack, c net.Conn) util.ILogger {
+	var l util.ILogger = m.logger
+	if conn := m.getConn(c); conn != nil {
+		l = conn.logger
+	}
+
+	if p.TraceId != 0 {
+		l = util.LoggerWithTrace(l, p.TraceId, p.SpanId)
+	}
+
+	return l
+}
+
+// SetConnTraceMark allow the packs sent to the conn to carry the trace mark,
+// for a peer known to understand it before it sends a pack with the mark
+func (m *SockMgr) SetConnTraceMark(c net.Conn, enable bool) error {
+	conn := m.getConn(c)
+	if conn == nil {
+		return ErrConnNotFound
+	}
+
+	conn.SetTraceMark(enable)
+	return nil
+}
+
+// SetDispatcher run OnHandlePack on the dispatcher workers instead of the manager loop,
+// it must be set before Start
+func (m *SockMgr) SetDispatcher(d *SockDispatcher) {
+	m.dispatcher = d
+}
+
+func (m *SockMgr) GetDispatcher() *SockDispatcher {
+	return m.dispatcher
+}
+
+// SetMetricCmdFilter set the cmds counted by their own label,
+// the others are counted as other. Every cmd is other by default, it must be set before Start
+func (m *SockMgr) SetMetricCmdFilter(f SockMetricCmdFilter) {
+	m.cmdFilter = f
+}
+
+// SetCrashHandler write a crash file when a panic happens on the manager loop or the dispatcher workers,
+// it must be set before Start
+func (m *SockMgr) SetCrashHandler(h *util.CrashHandler) {
+	m.crash = h
+}
+
+// SetLimiter check the inbound packs with the limiter before handling them,
+// it must be set before Start
+func (m *SockMgr) SetLimiter(l *SockLimiter) {
+	m.limiter = l
+	if l != nil {
+		l.SetClock(m.clock)
+	}
+}
+
+func (m *SockMgr) GetLimiter() *SockLimiter {
+	return m.limiter
+}
+
+// SetAdmission check the accepted sockets with the admission control
+func (m *SockMgr) SetAdmission(a *SockAdmission) {
+	m.admission = a
+	if a != nil {
+		a.SetClock(m.clock)
+	}
+}
+
+func (m *SockMgr) GetAdmission() *SockAdmission {
+	return m.admission
+}
+
+// SetConnRateLimit replace the per conn limit of one conn, nil to restore
+func (m *SockMgr) SetConnRateLimit(c net.Conn, limit *SockRateLimit) error {
+	conn := m.getConn(c)
+	if conn == nil {
+		return ErrConnNotFound
+	}
+
+	if m.limiter != nil {
+		m.limiter.SetConnOverride(conn.GetId(), limit)
+	}
+
+	return nil
+}
+
+// SetSendPolicy set the default send policy and queue limits for the conns added later
+func (m *SockMgr) SetSendPolicy(policy SockSendPolicy, maxPacks int, maxBytes int) {
+	m.sendPolicy = policy
+	m.maxRespPacks = maxPacks
+	m.maxRespBytes = maxBytes
+}
+
+// SetConnSendPolicy override the send policy and queue limits of one conn
+func (m *SockMgr) SetConnSendPolicy(c net.Conn, policy SockSendPolicy, maxPacks int, maxBytes int) error {
+	conn := m.getConn(c)
+	if conn == nil {
+		return ErrConnNotFound
+	}
+
+	conn.SetSendPolicy(policy, maxPacks, maxBytes)
+	return nil
+}
+
+func (m *SockMgr) SetPrincipal(c net.Conn, principal interface{}) error {
+	conn := m.getConn(c)
+	if conn == nil {
+		return ErrConnNotFound
+	}
+
+	conn.SetPrincipal(principal)
+	return nil
+}
+
+// GetPrincipal get the principal of an authenticated conn, nil if not authenticated
+func (m *SockMgr) GetPrincipal(c net.Conn) interface{} {
+	conn := m.getConn(c)
+	if conn == nil {
+		return nil
+	}
+
+	return conn.GetPrincipal()
+}
+
 func (m *SockMgr) SetHeaderProcessor(headerProcessor SockHeaderProcessor, c net.Conn) {
-	conn := m.mapConn[c]
+	conn := m.getConn(c)
 	if conn == nil {
 		return
 	}
@@ -57,46 +281,143 @@ func (m *SockMgr) SetHeaderProcessor(headerProcessor SockHeaderProcessor, c net.
 	conn.SetHeaderProcessor(headerProcessor)
 }
 
-func (m *SockMgr) addConn(c net.Conn) error {
-	var err error = nil
-	if len(m.stopAddEvt) == 0 {
-		m.connAddQue <- c
-	} else {
-		err = errors.New("stop add conn")
+// acceptConn add an accepted socket if the admission control allows,
+// a rejected socket is closed at once and reported to the listener,
+// a socket failed to add is closed too
+func (m *SockMgr) acceptConn(c net.Conn) error {
+	a := m.admission
+	if a == nil {
+		_, err := m.addConn(c, false)
+		if err != nil {
+			c.Close()
+		}
+
+		return err
+	}
+
+	ip := GetRemoteIp(c)
+	err := a.admit(ip)
+	if err != nil {
+		c.Close()
+		metricRejected.With(mapRejectReasonName[err]).Inc()
+		if l, ok := m.listener.(SockRejectListener); ok {
+			l.OnSockReject(c, err)
+		}
+
+		return nil
+	}
+
+	_, err = m.addConn(c, true)
+	if err != nil {
+		c.Close()
+		a.release(ip)
 	}
 
 	return err
 }
 
+// addConn register the conn at once, so it can be sent to right after connected,
+// the conn is started by the manager loop
+func (m *SockMgr) addConn(c net.Conn, admitted bool) (*SockConn, error) {
+	if len(m.stopAddEvt) != 0 {
+		return nil, errors.New("stop add conn")
+	}
+
+	id := m.connIdGen.GetId()
+	if id == 0 {
+		return nil, ErrConnIdExhausted
+	}
+
+	conn := NewSockConn(c, m.recvQue)
+	conn.SetId(id)
+	conn.clock = m.clock
+	conn.createTime = m.clock.Now()
+	conn.SetLogger(util.LoggerWith(m.logger, "conn", conn.GetId(), "addr", c.RemoteAddr().String()))
+	conn.admitted = admitted
+	conn.metricCmdFilter = m.cmdFilter
+	conn.exitHook = func() {
+		m.releaseAdmission(conn)
+	}
+
+	conn.SetSendPolicy(m.sendPolicy, m.maxRespPacks, m.maxRespBytes)
+
+	m.lckConn.Lock()
+	m.mapConn[c] = conn
+	m.lckConn.Unlock()
+
+	m.connAddQue <- conn
+	return conn, nil
+}
+
+func (m *SockMgr) getConn(c net.Conn) *SockConn {
+	m.lckConn.RLock()
+	defer m.lckConn.RUnlock()
+
+	return m.mapConn[c]
+}
+
 func (m *SockMgr) CloseConn(c net.Conn) {
 	m.connCloseQue <- c
 }
 
-func (m *SockMgr) Send(p *SockPack, c net.Conn) {
-	wrap := NewSockPackWrap(p, c)
-	m.sendQue <- wrap
+// Send push the pack to the respone queue of the conn, it never blocks.
+// A pack without a trace joins the trace of the pack being handled for the conn
+func (m *SockMgr) Send(p *SockPack, c net.Conn) error {
+	conn := m.getConn(c)
+	if conn == nil {
+		return ErrConnNotFound
+	}
+
+	// the caller's pack may be sent to other conns, the trace goes on a copy
+	if p.TraceId == 0 {
+		if traceId, spanId := conn.GetCurTrace(); traceId != 0 {
+			traced := *p
+			traced.TraceId, traced.SpanId = traceId, spanId
+			p = &traced
+		}
+	}
+
+	return conn.PushRespone(p)
 }
 
 func (m *SockMgr) Start() {
-	ticker := time.NewTicker(SOCK_MAINTAIN_INTV)
+	defer close(m.loopExitEvt)
+	if m.crash != nil {
+		defer m.crash.Recover()
+	}
+
+	ticker := m.clock.NewTicker(SOCK_MAINTAIN_INTV)
+	if m.dispatcher != nil {
+		if m.crash != nil {
+			m.dispatcher.SetCrashHandler(m.crash)
+		}
+
+		m.dispatcher.Start(m.handlePack)
+		defer m.dispatcher.Stop()
+	}
 
 	for {
 		select {
-		case c := <-m.connAddQue:
-			m.handleAddConn(c)
+		case conn := <-m.connAddQue:
+			m.handleAddConn(conn)
 
 		case c := <-m.connCloseQue:
 			m.handleCloseConn(c)
 
-		case wrap := <-m.sendQue:
-			m.handleSend(wrap)
-
 		case wrap := <-m.recvQue:
 			m.handleRecv(wrap)
 
-		case <-ticker.C:
+		case f := <-m.taskQue:
+			f()
+
+		case <-ticker.C():
 			m.handleTicker()
 
+		case req := <-m.shutdownEvt:
+			ticker.Stop()
+			m.handleShutdown(req)
+			return
+
 		case <-m.closeEvt:
 			goto Exit0
 		}
@@ -107,24 +428,107 @@ Exit0:
 	m.handleExit()
 }
 
+// Post run f on the manager loop, where the packs are handled if there is no dispatcher.
+// It never blocks, ErrTaskQueFull is returned if the queue is full
+func (m *SockMgr) Post(f func()) error {
+	select {
+	case m.taskQue <- f:
+		return nil
+
+	default:
+		return ErrTaskQueFull
+	}
+}
+
+// PostWait run f on the manager loop like Post, but wait up to timeout for a room in the queue
+func (m *SockMgr) PostWait(f func(), timeout time.Duration) error {
+	if m.Post(f) == nil {
+		return nil
+	}
+
+	t := m.clock.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case m.taskQue <- f:
+		return nil
+
+	case <-t.C():
+		return ErrTaskQueFull
+	}
+}
+
+// Stop close the conns and exit the manager loop, it is safe to call more than once
 func (m *SockMgr) Stop() {
-	m.stopAddEvt <- true
-	m.closeEvt <- true
+	select {
+	case m.stopAddEvt <- true:
+	default:
+	}
+
+	select {
+	case m.closeEvt <- true:
+	default:
+	}
 }
 
-func (m *SockMgr) handleAddConn(c net.Conn) {
-	conn := NewSockConn(c, m.recvQue)
-	m.mapConn[c] = conn
+// SetGoodbyePack set the pack sent to every conn when shutdown begins
+func (m *SockMgr) SetGoodbyePack(p *SockPack) {
+	m.goodbye = p
+}
+
+// Shutdown stop the manager gracefully: stop reading, handle the packs already read,
+// flush the respone queues and close the conns.
+// When ctx expires the remaining conns are force closed and ctx.Err() is returned.
+// The manager loop must be running, ErrMgrStopped is returned once it has exited
+func (m *SockMgr) Shutdown(ctx context.Context) (*SockShutdownSummary, error) {
+	select {
+	case m.stopAddEvt <- true:
+	default:
+	}
+
+	req := &sockShutdownReq{
+		ctx:    ctx,
+		result: make(chan *sockShutdownResult, 1),
+	}
+
+	select {
+	case m.shutdownEvt <- req:
+	case <-m.loopExitEvt:
+		return nil, ErrMgrStopped
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case res := <-req.result:
+		return res.summary, res.err
+
+	case <-m.loopExitEvt:
+		// the result is sent before the loop exits
+		select {
+		case res := <-req.result:
+			return res.summary, res.err
+
+		default:
+			return nil, ErrMgrStopped
+		}
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
+func (m *SockMgr) handleAddConn(conn *SockConn) {
+	metricConnOpened.Inc()
 	if m.listener != nil {
-		m.listener.OnSockOpen(c)
+		m.listener.OnSockOpen(conn.conn)
 	}
 
 	conn.Start()
 }
 
 func (m *SockMgr) handleCloseConn(c net.Conn) {
-	conn := m.mapConn[c]
+	conn := m.getConn(c)
 	if conn == nil {
 		return
 	}
@@ -132,46 +536,153 @@ func (m *SockMgr) handleCloseConn(c net.Conn) {
 	conn.Stop()
 }
 
-func (m *SockMgr) handleSend(wrap *SockPackWrap) {
-	c := wrap.Conn
-	p := wrap.Pack
-	conn := m.mapConn[c]
-	if conn == nil {
+func (m *SockMgr) handleRecv(wrap *SockPackWrap) {
+	if m.limiter != nil {
+		// the packs behind a delayed one wait in its queue to keep the order of the conn
+		if q := m.mapDelayQue[wrap.ConnId]; q != nil {
+			m.pushDelayed(q, wrap)
+			return
+		}
+
+		if !m.checkLimit(wrap) {
+			return
+		}
+	}
+
+	m.deliver(wrap)
+}
+
+// deliver pass the pack to the dispatcher or the listener
+func (m *SockMgr) deliver(wrap *SockPackWrap) {
+	if !m.filterPack(wrap.Pack, wrap.Conn) {
 		return
 	}
 
-	conn.PushRespone(p)
+	if m.dispatcher != nil {
+		// a key whose handler falls behind loses its new packs instead of stalling the loop,
+		// the peer is told with SOCK_CMD_BUSY, the rejects are counted by the dispatcher stats
+		err := m.dispatcher.Dispatch(wrap)
+		if err != nil {
+			m.GetPackLogger(wrap.Pack, wrap.Conn).W(LOG_TAG_SM, "dispatch pack error, cmd: ", wrap.Pack.Cmd, ", ", err)
+		}
+
+		if err == ErrDispatchQueFull {
+			m.Send(newBusyPack(wrap.Pack), wrap.Conn)
+		}
+	} else {
+		m.handlePack(wrap.Pack, wrap.Conn)
+	}
 }
 
-func (m *SockMgr) handleRecv(wrap *SockPackWrap) {
-	if m.listener != nil {
-		m.listener.OnHandlePack(wrap.Pack, wrap.Conn)
+// checkLimit return true if the pack can be handled now
+func (m *SockMgr) checkLimit(wrap *SockPackWrap) bool {
+	action, wait := m.limiter.check(wrap)
+	if wait == 0 {
+		return true
+	}
+
+	metricRateLimited.With(mapLimitActionName[action]).Inc()
+	if action == SOCK_LIMIT_ACTION_DELAY {
+		m.startDelay(wrap, wait)
+	} else {
+		m.applyLimitAction(action, wrap)
+	}
+
+	return false
+}
+
+// applyLimitAction handle a pack exceeding the limits, except the delay
+func (m *SockMgr) applyLimitAction(action SockLimitAction, wrap *SockPackWrap) {
+	switch action {
+	case SOCK_LIMIT_ACTION_ERROR:
+		m.Send(newRateLimitedPack(wrap.Pack), wrap.Conn)
+
+	case SOCK_LIMIT_ACTION_DISCONNECT:
+		m.handleCloseConn(wrap.Conn)
+	}
+}
+
+// filterPack return false if the listener drops the pack before it is dispatched
+func (m *SockMgr) filterPack(p *SockPack, c net.Conn) bool {
+	f, ok := m.listener.(SockPackFilter)
+	if !ok {
+		return true
 	}
+
+	defer m.joinTrace(p, c)()
+	return f.FilterPack(p, c)
+}
+
+func (m *SockMgr) handlePack(p *SockPack, c net.Conn) {
+	if m.listener == nil {
+		return
+	}
+
+	defer m.joinTrace(p, c)()
+	m.listener.OnHandlePack(p, c)
+}
+
+// joinTrace make the packs sent and the lines logged for the conn join the trace of p,
+// the returned func leaves the trace
+func (m *SockMgr) joinTrace(p *SockPack, c net.Conn) func() {
+	if p.TraceId == 0 {
+		return func() {}
+	}
+
+	conn := m.getConn(c)
+	if conn == nil {
+		return func() {}
+	}
+
+	conn.setCurTrace(p.TraceId, p.SpanId)
+	return func() { conn.setCurTrace(0, 0) }
 }
 
 func (m *SockMgr) handleTicker() {
 	var removeKeys []net.Conn = make([]net.Conn, 0)
+	m.lckConn.RLock()
 	for k, v := range m.mapConn {
 		if v.CanRemove() {
 			removeKeys = append(removeKeys, k)
 		}
 	}
+	m.lckConn.RUnlock()
 
 	for _, key := range removeKeys {
 		if m.listener != nil {
 			m.listener.OnSockClose(key)
 		}
 
+		m.lckConn.Lock()
+		conn := m.mapConn[key]
 		delete(m.mapConn, key)
+		m.lckConn.Unlock()
+
+		if conn != nil {
+			m.releaseConn(conn)
+		}
+	}
+
+	if m.limiter != nil {
+		m.limiter.Clean()
+	}
+
+	if m.admission != nil {
+		m.admission.Clean()
 	}
 }
 
 func (m *SockMgr) handleExit() {
+	m.startAddedConns()
+	m.dropAllDelayed()
+
+	m.lckConn.RLock()
 	for _, conn := range m.mapConn {
 		conn.Stop()
 	}
+	m.lckConn.RUnlock()
 
-	ticker := time.NewTicker(SOCK_CHECK_ALL_CLOSE_INTV)
+	ticker := m.clock.NewTicker(SOCK_CHECK_ALL_CLOSE_INTV)
 	for {
 		if m.waitCloseAllConn(ticker) {
 			break
@@ -181,12 +692,12 @@ func (m *SockMgr) handleExit() {
 	ticker.Stop()
 }
 
-func (m *SockMgr) waitCloseAllConn(ticker *time.Ticker) bool {
+func (m *SockMgr) waitCloseAllConn(ticker util.ClockTicker) bool {
 	bRetCode := false
 
-	<-ticker.C
+	<-ticker.C()
 	m.handleTicker()
-	if len(m.mapConn) == 0 {
+	if m.GetConnCount() == 0 {
 		bRetCode = true
 	}
 	// select {
@@ -199,3 +710,107 @@ func (m *SockMgr) waitCloseAllConn(ticker *time.Ticker) bool {
 
 	return bRetCode
 }
+
+// startAddedConns start the conns still waiting in the add queue,
+// so that every registered conn can be stopped
+func (m *SockMgr) startAddedConns() {
+	for {
+		select {
+		case conn := <-m.connAddQue:
+			m.handleAddConn(conn)
+		default:
+			return
+		}
+	}
+}
+
+func (m *SockMgr) GetConnCount() int {
+	m.lckConn.RLock()
+	defer m.lckConn.RUnlock()
+
+	return len(m.mapConn)
+}
+
+func (m *SockMgr) getAllConns() []*SockConn {
+	m.lckConn.RLock()
+	defer m.lckConn.RUnlock()
+
+	conns := make([]*SockConn, 0, len(m.mapConn))
+	for _, conn := range m.mapConn {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// releaseConn clean the states of a removed conn
+func (m *SockMgr) releaseConn(conn *SockConn) {
+	metricConnClosed.Inc()
+	err := m.connIdGen.ReuseId(conn.GetId())
+	if err != nil {
+		conn.logger.W(LOG_TAG_SM, "release conn id error: ", err)
+	}
+
+	if m.limiter != nil {
+		m.limiter.RemoveConn(conn.GetId())
+		m.dropDelayed(conn.GetId())
+	}
+
+	// the conns never started have not released their slots
+	m.releaseAdmission(conn)
+}
+
+// releaseAdmission free the admission slot of the conn once,
+// it is called as soon as the conn exits so the peer can reconnect before the sweep
+func (m *SockMgr) releaseAdmission(conn *SockConn) {
+	if m.admission == nil || !conn.admitted {
+		return
+	}
+
+	conn.releaseOnce.Do(func() {
+		m.admission.release(GetRemoteIp(conn.conn))
+	})
+}
+
+// GetConnInfos get the snapshots of all the conns, sorted by id
+func (m *SockMgr) GetConnInfos() []SockConnInfo {
+	conns := m.getAllConns()
+	infos := make([]SockConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		infos = append(infos, conn.GetInfo())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+
+	return infos
+}
+
+// KickConn close the conn with the id,
+// the reason is sent to the peer in a SOCK_CMD_KICKED pack before the close, cut to the max data length
+func (m *SockMgr) KickConn(id uint64, reason string) error {
+	if len(reason) > SOCK_PACK_MAX_DATA {
+		reason = reason[:SOCK_PACK_MAX_DATA]
+	}
+
+	for _, conn := range m.getAllConns() {
+		if conn.GetId() == id {
+			conn.logger.W(LOG_TAG_SM, "kick conn, reason: ", reason)
+			info := conn.GetInfo()
+			p := NewReqSockPack(SOCK_CMD_KICKED, m.endType, m.endNo, info.PeerEnd, info.PeerNo)
+			p.Data = []byte(reason)
+			p.DataLen = uint16(len(p.Data))
+			err := conn.PushRespone(p)
+			if err != nil {
+				conn.logger.W(LOG_TAG_SM, "send kick reason error: ", err)
+			}
+
+			// the write goroutine sends the queued packs after the read stops
+			conn.Stop()
+			return nil
+		}
+	}
+
+	return ErrConnNotFound
+}
@@ -1,15 +1,23 @@
 package sock
 
 import (
+	"encoding/binary"
 	"net"
+	"sync/atomic"
+
+	"github.com/wuyiyinxia/yxlib/trace"
 )
 
 const (
 	SOCK_PACK_MARK_LEN   = 2
 	SOCK_PACK_HEADER_LEN = 12
+	SOCK_PACK_TRACE_LEN  = 16
+	SOCK_PACK_MAX_DATA   = 0xFFFF
 )
 
 var sockPackMark uint16 = 0x5958
+var sockPackTraceMark uint16 = 0x5954
+var sockTraceEnable int32 = 0 // read by the conn goroutines
 
 func SetPackMark(mark uint16) {
 	sockPackMark = mark
@@ -19,6 +27,32 @@ func GetPackMark() uint16 {
 	return sockPackMark
 }
 
+// SetPackTraceMark set the mark of the packs carrying a trace context
+func SetPackTraceMark(mark uint16) {
+	sockPackTraceMark = mark
+}
+
+func GetPackTraceMark() uint16 {
+	return sockPackTraceMark
+}
+
+// SetTraceEnable turn on the tracing: the inbound packs without a trace context get a new one,
+// and the packs with a trace context are sent with the trace mark to the peers using it.
+// A peer uses the mark once it sends a pack with the mark, or after SockConn.SetTraceMark,
+// so the old peers keep receiving the plain packs. The packs with the mark are always accepted
+func SetTraceEnable(enable bool) {
+	var v int32 = 0
+	if enable {
+		v = 1
+	}
+
+	atomic.StoreInt32(&sockTraceEnable, v)
+}
+
+func IsTraceEnable() bool {
+	return atomic.LoadInt32(&sockTraceEnable) == 1
+}
+
 /*
  * @struct SockPackWrap
  * Serialized data:
@@ -26,17 +60,21 @@ func GetPackMark() uint16 {
  * 1 byte for source type, 2 byte for source number,
  * 1 byte for dest type, 2 byte for dest number,
  * 2 byte for data length,
- * the rest is data
+ * the rest is data.
+ * A pack with the trace mark has 8 bytes trace id and 8 bytes span id between the header and the data
  */
 type SockPack struct {
-	Cmd     uint16
-	SrcEnd  uint8
-	SrcNo   uint16
-	DstEnd  uint8
-	DstNo   uint16
-	DataLen uint16
-	Data    []byte
-	RawBuff []byte // whold package stream data
+	Cmd          uint16
+	SrcEnd       uint8
+	SrcNo        uint16
+	DstEnd       uint8
+	DstNo        uint16
+	DataLen      uint16
+	Data         []byte
+	RawBuff      []byte // whold package stream data
+	TraceId      uint64
+	SpanId       uint64 // the span of the current hop after received
+	ParentSpanId uint64 // the span of the sender, not serialized
 }
 
 func NewSockPack() *SockPack {
@@ -49,6 +87,8 @@ func NewSockPack() *SockPack {
 		DataLen: 0,
 		Data:    nil,
 		RawBuff: nil,
+		TraceId: 0,
+		SpanId:  0,
 	}
 }
 
@@ -62,9 +102,12 @@ func NewReqSockPack(cmd uint16, srcEnd uint8, srcNo uint16, dstEnd uint8, dstNo
 		DataLen: 0,
 		Data:    nil,
 		RawBuff: nil,
+		TraceId: 0,
+		SpanId:  0,
 	}
 }
 
+// GetRespSockPack make the respone of the pack, it joins the trace of the pack
 func GetRespSockPack(p *SockPack) *SockPack {
 	return &SockPack{
 		Cmd:     p.Cmd,
@@ -75,11 +118,68 @@ func GetRespSockPack(p *SockPack) *SockPack {
 		DataLen: 0,
 		Data:    nil,
 		RawBuff: nil,
+		TraceId: p.TraceId,
+		SpanId:  p.SpanId,
 	}
 }
 
+// NewFollowSockPack make a request sent while handling the parent, it joins the trace of the parent
+func NewFollowSockPack(parent *SockPack, cmd uint16, srcEnd uint8, srcNo uint16, dstEnd uint8, dstNo uint16) *SockPack {
+	p := NewReqSockPack(cmd, srcEnd, srcNo, dstEnd, dstNo)
+	p.FollowTrace(parent)
+	return p
+}
+
+// FollowTrace join the trace of the parent
+func (p *SockPack) FollowTrace(parent *SockPack) {
+	p.TraceId = parent.TraceId
+	p.SpanId = parent.SpanId
+}
+
+// startSpan give the received pack the span of the current hop
+func (p *SockPack) startSpan() {
+	if p.TraceId == 0 {
+		if !IsTraceEnable() {
+			return
+		}
+
+		p.TraceId = trace.NewId()
+		p.ParentSpanId = 0
+	} else {
+		p.ParentSpanId = p.SpanId
+	}
+
+	p.SpanId = trace.NewId()
+}
+
+func (p *SockPack) isTraceSerialized() bool {
+	return IsTraceEnable() && p.TraceId != 0
+}
+
+func (p *SockPack) getDataOffset() int {
+	if len(p.RawBuff) >= SOCK_PACK_MARK_LEN && binary.BigEndian.Uint16(p.RawBuff) == sockPackTraceMark {
+		return SOCK_PACK_HEADER_LEN + SOCK_PACK_TRACE_LEN
+	}
+
+	return SOCK_PACK_HEADER_LEN
+}
+
+// GetPackLen get the serialized length of the pack
+func (p *SockPack) GetPackLen() int {
+	if p.RawBuff != nil && !p.isTraceSerialized() {
+		return len(p.RawBuff)
+	}
+
+	if p.isTraceSerialized() {
+		return SOCK_PACK_HEADER_LEN + SOCK_PACK_TRACE_LEN + len(p.Data)
+	}
+
+	return SOCK_PACK_HEADER_LEN + len(p.Data)
+}
+
 func (p *SockPack) GetDataFromRaw() []byte {
-	if p.RawBuff == nil || len(p.RawBuff) <= SOCK_PACK_HEADER_LEN {
+	offset := p.getDataOffset()
+	if p.RawBuff == nil || len(p.RawBuff) <= offset {
 		return nil
 	}
 
@@ -87,21 +187,23 @@ func (p *SockPack) GetDataFromRaw() []byte {
 		return nil
 	}
 
-	return p.RawBuff[SOCK_PACK_HEADER_LEN:]
+	return p.RawBuff[offset:]
 }
 
 /*
  * @struct SockPackWrap
  */
 type SockPackWrap struct {
-	Pack *SockPack
-	Conn net.Conn
+	Pack   *SockPack
+	Conn   net.Conn
+	ConnId uint64
 }
 
 func NewSockPackWrap(pack *SockPack, c net.Conn) *SockPackWrap {
 	wrap := &SockPackWrap{
-		Pack: pack,
-		Conn: c,
+		Pack:   pack,
+		Conn:   c,
+		ConnId: 0,
 	}
 
 	return wrap
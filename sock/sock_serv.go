@@ -1,8 +1,13 @@
 package sock
 
 import (
-	"fmt"
 	"net"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	LOG_TAG_SS = "SockServ"
 )
 
 type SockServ struct {
@@ -29,8 +34,14 @@ func (s *SockServ) Listen(network string, address string) error {
 	return nil
 }
 
+// ListenOn accept the conns from l instead of listening on an address,
+// so an in-memory listener can be served
+func (s *SockServ) ListenOn(l net.Listener) {
+	s.l = l
+}
+
 func (s *SockServ) Start() {
-	fmt.Println("server start")
+	s.getLogger().I(LOG_TAG_SS, "server start: ", s.getAddr())
 
 	for {
 		select {
@@ -40,7 +51,7 @@ func (s *SockServ) Start() {
 		default:
 			err := s.accept()
 			if err != nil {
-				fmt.Println("accept error:", err)
+				s.getLogger().E(LOG_TAG_SS, "accept error: ", err)
 				<-s.closeEvt
 				goto Exit0
 			}
@@ -48,11 +59,19 @@ func (s *SockServ) Start() {
 	}
 
 Exit0:
-	fmt.Println("server stop")
+	s.getLogger().I(LOG_TAG_SS, "server stop: ", s.getAddr())
 }
 
 func (s *SockServ) Stop() {
-	s.closeEvt <- true
+	if s.l == nil {
+		return
+	}
+
+	select {
+	case s.closeEvt <- true:
+	default:
+	}
+
 	s.l.Close()
 }
 
@@ -63,7 +82,7 @@ func (s *SockServ) accept() error {
 	}
 
 	if s.mgr != nil {
-		err = s.mgr.addConn(c)
+		err = s.mgr.acceptConn(c)
 		if err != nil {
 			return err
 		}
@@ -71,3 +90,19 @@ func (s *SockServ) accept() error {
 
 	return nil
 }
+
+func (s *SockServ) getLogger() util.ILogger {
+	if s.mgr != nil {
+		return s.mgr.logger
+	}
+
+	return util.Logger
+}
+
+func (s *SockServ) getAddr() string {
+	if s.l == nil {
+		return ""
+	}
+
+	return s.l.Addr().String()
+}
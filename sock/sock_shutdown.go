@@ -0,0 +1,148 @@
+package sock
+
+import (
+	"context"
+	"net"
+)
+
+// SockShutdownSummary report what a shutdown could not finish
+type SockShutdownSummary struct {
+	ConnTotal   int // conns alive when the shutdown began
+	ConnForced  int // conns force closed when the deadline expired
+	DroppedRecv int // inbound packs never handled
+	DroppedSend int // outbound packs never flushed
+}
+
+type sockShutdownResult struct {
+	summary *SockShutdownSummary
+	err     error
+}
+
+type sockShutdownReq struct {
+	ctx    context.Context
+	result chan *sockShutdownResult
+}
+
+func (m *SockMgr) handleShutdown(req *sockShutdownReq) {
+	summary := &SockShutdownSummary{}
+	var err error = nil
+
+	m.startAddedConns()
+	conns := m.getAllConns()
+	summary.ConnTotal = len(conns)
+	for _, conn := range conns {
+		m.stopConnRead(conn, summary)
+	}
+
+	ticker := m.clock.NewTicker(SOCK_SHUTDOWN_CHECK_INTV)
+	for !m.isDrained() {
+		select {
+		case conn := <-m.connAddQue:
+			// added before the stop flag was seen
+			m.handleAddConn(conn)
+			summary.ConnTotal++
+			m.stopConnRead(conn, summary)
+
+		case c := <-m.connCloseQue:
+			m.handleCloseConn(c)
+
+		case wrap := <-m.recvQue:
+			m.handleRecv(wrap)
+
+		case f := <-m.taskQue:
+			f()
+
+		case <-ticker.C():
+			m.handleDrainTicker()
+
+		case <-req.ctx.Done():
+			err = req.ctx.Err()
+			m.forceCloseAll(summary)
+			goto Exit0
+		}
+	}
+
+Exit0:
+	ticker.Stop()
+	req.result <- &sockShutdownResult{
+		summary: summary,
+		err:     err,
+	}
+}
+
+func (m *SockMgr) stopConnRead(conn *SockConn, summary *SockShutdownSummary) {
+	if m.goodbye != nil {
+		err := conn.PushRespone(m.goodbye)
+		if err != nil {
+			summary.DroppedSend++
+		}
+	}
+
+	conn.StopRead()
+}
+
+func (m *SockMgr) isDrained() bool {
+	return m.isRecvDrained() && m.GetConnCount() == 0
+}
+
+func (m *SockMgr) isRecvDrained() bool {
+	if len(m.recvQue) != 0 {
+		return false
+	}
+
+	if m.limiter != nil && m.limiter.GetDelayed() != 0 {
+		return false
+	}
+
+	return m.dispatcher == nil || m.dispatcher.GetPending() == 0
+}
+
+// handleDrainTicker close the writers of the conns whose packs are all handled
+func (m *SockMgr) handleDrainTicker() {
+	if m.isRecvDrained() {
+		for _, conn := range m.getAllConns() {
+			if conn.IsReadExit() {
+				conn.CloseWrite()
+			}
+		}
+	}
+
+	m.handleTicker()
+}
+
+func (m *SockMgr) forceCloseAll(summary *SockShutdownSummary) {
+	for {
+		select {
+		case <-m.recvQue:
+			summary.DroppedRecv++
+		default:
+			goto Exit0
+		}
+	}
+
+Exit0:
+	summary.DroppedRecv += m.dropAllDelayed()
+	if m.dispatcher != nil {
+		// the running handlers can not be stopped, only the waiting ones are dropped
+		summary.DroppedRecv += m.dispatcher.Discard()
+	}
+
+	for _, conn := range m.getAllConns() {
+		summary.DroppedSend += conn.ForceClose()
+		summary.ConnForced++
+	}
+
+	// the writers exit soon after the force close, remove them without waiting
+	m.lckConn.Lock()
+	conns := m.mapConn
+	m.mapConn = make(map[net.Conn]*SockConn)
+	m.lckConn.Unlock()
+
+	for c, conn := range conns {
+		if m.listener != nil {
+			m.listener.OnSockClose(c)
+		}
+
+		m.releaseConn(conn)
+	}
+}
@@ -1,6 +1,682 @@
 package sock
 
-import "testing"
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
 
 func TestSock(t *testing.T) {
 }
+
+func TestSendPolicy(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	conn := NewSockConn(c1, make(chan *SockPackWrap, 1))
+	conn.SetSendPolicy(SOCK_SEND_POLICY_ERROR, 2, 0)
+	for i := 0; i < 2; i++ {
+		if err := conn.PushRespone(NewReqSockPack(uint16(i), 0, 0, 0, 0)); err != nil {
+			t.Fatal("push error:", err)
+		}
+	}
+
+	if err := conn.PushRespone(NewReqSockPack(2, 0, 0, 0, 0)); err != ErrQueueFull {
+		t.Fatal("expect ErrQueueFull, got", err)
+	}
+
+	conn.SetSendPolicy(SOCK_SEND_POLICY_DROP_OLDEST, 2, 0)
+	if err := conn.PushRespone(NewReqSockPack(3, 0, 0, 0, 0)); err != nil {
+		t.Fatal("push error:", err)
+	}
+
+	packs := conn.popAllResp()
+	if len(packs) != 2 || packs[0].Cmd != 1 || packs[1].Cmd != 3 {
+		t.Fatal("drop oldest failed")
+	}
+
+	conn.SetSendPolicy(SOCK_SEND_POLICY_DROP_NEWEST, 0, SOCK_PACK_HEADER_LEN)
+	conn.PushRespone(NewReqSockPack(4, 0, 0, 0, 0))
+	conn.PushRespone(NewReqSockPack(5, 0, 0, 0, 0))
+	cnt, bytes := conn.GetRespQueLen()
+	if cnt != 1 || bytes != SOCK_PACK_HEADER_LEN {
+		t.Fatal("drop newest failed")
+	}
+}
+
+func TestConnStop(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := NewSockConn(c1, make(chan *SockPackWrap, 1))
+	conn.Start()
+	conn.Stop()
+	for !conn.IsReadExit() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the later stops from other goroutines must not block on the consumed event
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			conn.Stop()
+			wg.Done()
+		}()
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stop blocked")
+	}
+}
+
+type echoListener struct {
+	mgr *SockMgr
+}
+
+func (l *echoListener) OnSockOpen(c net.Conn)  {}
+func (l *echoListener) OnSockClose(c net.Conn) {}
+func (l *echoListener) OnSockError(c net.Conn) {}
+func (l *echoListener) OnHandlePack(p *SockPack, c net.Conn) {
+	l.mgr.Send(GetRespSockPack(p), c)
+}
+
+func TestShutdown(t *testing.T) {
+	mgr := NewSockMgr(1, 1)
+	mgr.SetListener(&echoListener{mgr: mgr})
+	mgr.SetGoodbyePack(NewReqSockPack(99, 1, 1, 0, 0))
+	go mgr.Start()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	mgr.addConn(c1, false)
+
+	peer := NewSockConn(c2, make(chan *SockPackWrap, 8))
+	buff, _ := peer.pack(NewReqSockPack(7, 2, 2, 1, 1))
+	if _, err := c2.Write(buff); err != nil {
+		t.Fatal("write error:", err)
+	}
+
+	// take the echo first, so the goodbye is the only pack sent by the shutdown
+	readCmd := func() (uint16, error) {
+		_, err := peer.readHeader(peer.headerBuff)
+		if err != nil {
+			return 0, err
+		}
+
+		p, err := peer.unpack(peer.headerBuff)
+		if err != nil {
+			return 0, err
+		}
+
+		return p.Cmd, nil
+	}
+
+	if cmd, err := readCmd(); err != nil || cmd != 7 {
+		t.Fatal("expect the echo, got", cmd, err)
+	}
+
+	done := make(chan *SockShutdownSummary, 1)
+	go func() {
+		summary, err := mgr.Shutdown(context.Background())
+		if err != nil {
+			t.Error("shutdown error:", err)
+		}
+		done <- summary
+	}()
+
+	cmds := make([]uint16, 0)
+	for {
+		cmd, err := readCmd()
+		if err != nil {
+			break
+		}
+
+		cmds = append(cmds, cmd)
+	}
+
+	summary := <-done
+	if summary.ConnTotal != 1 || summary.ConnForced != 0 {
+		t.Fatal("unexpect summary:", summary)
+	}
+
+	if len(cmds) != 1 || cmds[0] != 99 {
+		t.Fatal("unexpect cmds:", cmds)
+	}
+
+	// a second shutdown and a stop after the loop exits return at once
+	<-mgr.loopExitEvt
+	if _, err := mgr.Shutdown(context.Background()); err != ErrMgrStopped {
+		t.Fatal("expect ErrMgrStopped:", err)
+	}
+
+	mgr.Stop()
+	mgr.Stop()
+
+	// the wait for a loop never started ends with the ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := NewSockMgr(1, 1).Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expect the deadline:", err)
+	}
+}
+
+func TestPack(t *testing.T) {
+	c := NewSockConn(nil, nil)
+	p := NewReqSockPack(5, 1, 2, 3, 4)
+	buff, err := c.pack(p)
+	if err != nil || len(buff) != SOCK_PACK_HEADER_LEN || binary.BigEndian.Uint16(buff) != GetPackMark() {
+		t.Fatal("wrong empty pack:", buff, err)
+	}
+
+	p.Data = []byte("hello")
+	buff, err = c.pack(p)
+	if err != nil || len(buff) != SOCK_PACK_HEADER_LEN+5 || string(buff[SOCK_PACK_HEADER_LEN:]) != "hello" {
+		t.Fatal("wrong pack:", buff, err)
+	}
+}
+
+func TestDispatcherOrder(t *testing.T) {
+	var lck sync.Mutex
+	var wg sync.WaitGroup
+	mapKey2Cmds := make(map[uint64][]uint16)
+
+	d := NewSockDispatcher(4, 128, nil)
+	d.Start(func(p *SockPack, c net.Conn) {
+		lck.Lock()
+		mapKey2Cmds[uint64(p.SrcNo)] = append(mapKey2Cmds[uint64(p.SrcNo)], p.Cmd)
+		lck.Unlock()
+		wg.Done()
+	})
+
+	for i := 0; i < 100; i++ {
+		for key := uint64(0); key < 10; key++ {
+			wg.Add(1)
+			wrap := NewSockPackWrap(NewReqSockPack(uint16(i), 0, uint16(key), 0, 0), nil)
+			wrap.ConnId = key
+			d.Dispatch(wrap)
+		}
+	}
+
+	wg.Wait()
+	d.Stop()
+
+	for key, cmds := range mapKey2Cmds {
+		for i, cmd := range cmds {
+			if int(cmd) != i {
+				t.Fatal("out of order, key:", key)
+			}
+		}
+	}
+}
+
+func TestDispatcherBlockedKey(t *testing.T) {
+	block := make(chan bool)
+	handled := make(chan uint64, 8)
+
+	d := NewSockDispatcher(2, 2, nil)
+	d.Start(func(p *SockPack, c net.Conn) {
+		if p.SrcNo == 1 {
+			<-block
+		}
+		handled <- uint64(p.SrcNo)
+	})
+	defer d.Stop()
+
+	dispatch := func(key uint64) error {
+		wrap := NewSockPackWrap(NewReqSockPack(0, 0, uint16(key), 0, 0), nil)
+		wrap.ConnId = key
+		return d.Dispatch(wrap)
+	}
+
+	// the first pack of key 1 runs and blocks, two more wait, the next is rejected
+	if err := dispatch(1); err != nil {
+		t.Fatal("dispatch error:", err)
+	}
+
+	for d.GetStats().Busy != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := dispatch(1); err != nil {
+			t.Fatal("dispatch error:", err)
+		}
+	}
+
+	if err := dispatch(1); err != ErrDispatchQueFull || d.GetStats().Rejected != 1 {
+		t.Fatal("expect ErrDispatchQueFull, got", err)
+	}
+
+	// another key is not held up by the blocked one
+	if err := dispatch(2); err != nil {
+		t.Fatal("dispatch error:", err)
+	}
+
+	select {
+	case key := <-handled:
+		if key != 2 {
+			t.Fatal("unexpect key:", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("key 2 stalled by key 1")
+	}
+
+	close(block)
+	for i := 0; i < 3; i++ {
+		<-handled
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewSockLimiter(SOCK_LIMIT_ACTION_DROP)
+	l.SetConnLimit(&SockRateLimit{PacksPerSec: 1, PackBurst: 3})
+	l.SetCmdLimit(9, &SockRateLimit{PacksPerSec: 1, PackBurst: 1})
+
+	wrap := NewSockPackWrap(NewReqSockPack(1, 0, 0, 0, 0), nil)
+	wrap.ConnId = 1
+	for i := 0; i < 3; i++ {
+		if _, wait := l.check(wrap); wait != 0 {
+			t.Fatal("expect allow at", i)
+		}
+	}
+
+	if _, wait := l.check(wrap); wait == 0 {
+		t.Fatal("expect conn limit")
+	}
+
+	wrap = NewSockPackWrap(NewReqSockPack(9, 0, 0, 0, 0), nil)
+	wrap.ConnId = 2
+	if _, wait := l.check(wrap); wait != 0 {
+		t.Fatal("expect allow")
+	}
+
+	if _, wait := l.check(wrap); wait == 0 {
+		t.Fatal("expect cmd limit")
+	}
+
+	if l.GetStats().Dropped != 2 {
+		t.Fatal("unexpect dropped count:", l.GetStats().Dropped)
+	}
+}
+
+func TestLimiterDelay(t *testing.T) {
+	clock := util.NewFakeClock(time.Now())
+	mgr := NewSockMgr(1, 1)
+	mgr.SetClock(clock)
+	mgr.SetListener(&echoListener{mgr: mgr})
+
+	l := NewSockLimiter(SOCK_LIMIT_ACTION_DELAY)
+	l.SetCmdLimit(9, &SockRateLimit{PacksPerSec: 1, PackBurst: 1})
+	mgr.SetLimiter(l)
+
+	exitEvt := make(chan bool)
+	go func() {
+		mgr.Start()
+		close(exitEvt)
+	}()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	mgr.addConn(c1, false)
+
+	peer := NewSockConn(c2, make(chan *SockPackWrap, 8))
+	for _, cmd := range []uint16{9, 9, 1, 2} {
+		buff, _ := peer.pack(NewReqSockPack(cmd, 2, 2, 1, 1))
+		if _, err := c2.Write(buff); err != nil {
+			t.Fatal("write error:", err)
+		}
+	}
+
+	readCmd := func() uint16 {
+		_, err := peer.readHeader(peer.headerBuff)
+		if err != nil {
+			t.Fatal("read error:", err)
+		}
+
+		p, err := peer.unpack(peer.headerBuff)
+		if err != nil {
+			t.Fatal("unpack error:", err)
+		}
+
+		return p.Cmd
+	}
+
+	// the packs behind the delayed one wait for it
+	if cmd := readCmd(); cmd != 9 {
+		t.Fatal("expect the first pack, got", cmd)
+	}
+
+	for l.GetDelayed() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(time.Second)
+	for i, expect := range []uint16{9, 1, 2} {
+		if cmd := readCmd(); cmd != expect {
+			t.Fatal("wrong order at", i, ", got", cmd)
+		}
+	}
+
+	// the delayed packs are dropped when the manager stops
+	buff, _ := peer.pack(NewReqSockPack(9, 2, 2, 1, 1))
+	if _, err := c2.Write(buff); err != nil {
+		t.Fatal("write error:", err)
+	}
+
+	for l.GetDelayed() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	mgr.Stop()
+	c2.Close()
+	for {
+		select {
+		case <-exitEvt:
+			if l.GetDelayed() != 0 {
+				t.Fatal("delayed packs left:", l.GetDelayed())
+			}
+
+			// the timer of the dropped queue must not block
+			clock.Advance(time.Second)
+			return
+
+		case <-time.After(time.Millisecond):
+			clock.Advance(SOCK_CHECK_ALL_CLOSE_INTV)
+		}
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	a := NewSockAdmission(3, 2)
+	err := a.SetRules(nil, []string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal("set rules error:", err)
+	}
+
+	if a.admit("10.1.2.3") != ErrRejectDenied || a.admit("192.168.1.1") != ErrRejectDenied {
+		t.Fatal("expect denied")
+	}
+
+	if a.admit("1.1.1.1") != nil || a.admit("1.1.1.1") != nil {
+		t.Fatal("expect admitted")
+	}
+
+	if a.admit("1.1.1.1") != ErrRejectMaxConnPerIp {
+		t.Fatal("expect per ip limit")
+	}
+
+	if a.admit("2.2.2.2") != nil || a.admit("3.3.3.3") != ErrRejectMaxConn {
+		t.Fatal("expect total limit")
+	}
+
+	a.release("2.2.2.2")
+	a.Ban("3.3.3.3", time.Minute)
+	if a.admit("3.3.3.3") != ErrRejectBanned {
+		t.Fatal("expect banned")
+	}
+
+	if a.SetRules([]string{"bad"}, nil) == nil {
+		t.Fatal("expect invalid rule error")
+	}
+}
+
+func TestAdmissionRelease(t *testing.T) {
+	mgr := NewSockMgr(1, 1)
+	mgr.SetListener(&echoListener{mgr: mgr})
+	a := NewSockAdmission(1, 0)
+	mgr.SetAdmission(a)
+	go mgr.Start()
+	defer mgr.Stop()
+
+	getConnCnt := func() int {
+		a.lck.Lock()
+		defer a.lck.Unlock()
+
+		return a.connCnt
+	}
+
+	c1, c2 := net.Pipe()
+	if err := mgr.acceptConn(c1); err != nil || getConnCnt() != 1 {
+		t.Fatal("expect admitted:", err)
+	}
+
+	// the slot is freed when the conn exits, without waiting for the sweep
+	c2.Close()
+	deadline := time.Now().Add(time.Second)
+	for getConnCnt() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("admission slot not released")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	if err := mgr.acceptConn(c3); err != nil || getConnCnt() != 1 {
+		t.Fatal("expect the reconnect admitted:", err)
+	}
+
+	// the sweep does not release it again
+	mgr.handleTicker()
+	if getConnCnt() != 1 {
+		t.Fatal("slot released twice:", getConnCnt())
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	p := NewReqSockPack(0x4321, 0, 0, 0, 0)
+	other := metricPacksIn.With(SOCK_METRIC_CMD_OTHER).Get()
+	observePackIn(p, nil)
+	observePackIn(p, func(cmd uint16) bool { return cmd != 0x4321 })
+	if metricPacksIn.With(SOCK_METRIC_CMD_OTHER).Get() != other+2 {
+		t.Fatal("expect the unknown cmds counted as other")
+	}
+
+	known := metricPacksIn.With("17185").Get()
+	observePackIn(p, func(cmd uint16) bool { return true })
+	if metricPacksIn.With("17185").Get() != known+1 {
+		t.Fatal("expect the known cmd counted by its label")
+	}
+
+	// the outbound packs follow the same filter
+	otherOut := metricPacksOut.With(SOCK_METRIC_CMD_OTHER).Get()
+	observePackOut(p, nil)
+	if metricPacksOut.With(SOCK_METRIC_CMD_OTHER).Get() != otherOut+1 || metricPacksOut.With("17185").Get() != 0 {
+		t.Fatal("expect the unknown outbound cmd counted as other")
+	}
+
+	// the reject reasons are fixed codes
+	mgr := NewSockMgr(1, 1)
+	a := NewSockAdmission(0, 0)
+	a.Ban("pipe", time.Minute)
+	mgr.SetAdmission(a)
+
+	banned := metricRejected.With("banned").Get()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	if err := mgr.acceptConn(c1); err != nil || metricRejected.With("banned").Get() != banned+1 {
+		t.Fatal("expect the banned code:", err)
+	}
+}
+
+type panicListener struct {
+	echoListener
+}
+
+func (l *panicListener) OnHandlePack(p *SockPack, c net.Conn) {
+	panic("handler crash")
+}
+
+// TestCrashHandler run itself in child processes, where a handler panics on the manager loop or a worker
+func TestCrashHandler(t *testing.T) {
+	if dir := os.Getenv("YX_CRASH_DIR"); dir != "" {
+		mgr := NewSockMgr(1, 1)
+		mgr.SetListener(&panicListener{})
+		mgr.SetCrashHandler(util.NewCrashHandler(dir, 0))
+		if os.Getenv("YX_CRASH_MODE") == "worker" {
+			mgr.SetDispatcher(NewSockDispatcher(2, 0, nil))
+		}
+
+		go mgr.Start()
+
+		c1, c2 := net.Pipe()
+		mgr.addConn(c1, false)
+		buff, _ := NewSockConn(c2, nil).pack(NewReqSockPack(1, 2, 2, 1, 1))
+		c2.Write(buff)
+		time.Sleep(5 * time.Second)
+		return
+	}
+
+	for _, mode := range []string{"loop", "worker"} {
+		dir := t.TempDir()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCrashHandler$")
+		cmd.Env = append(os.Environ(), "YX_CRASH_DIR="+dir, "YX_CRASH_MODE="+mode)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Fatal("expect the child to crash on the", mode)
+		}
+
+		files, _ := ioutil.ReadDir(dir)
+		if len(files) != 1 || !strings.Contains(string(out), "handler crash") {
+			t.Fatal("crash file not written on the", mode, len(files), string(out))
+		}
+	}
+}
+
+func TestTracePack(t *testing.T) {
+	SetTraceEnable(true)
+	defer SetTraceEnable(false)
+
+	c := NewSockConn(nil, nil)
+	p := NewReqSockPack(5, 1, 2, 3, 4)
+	p.Data = []byte("hello")
+	p.startSpan()
+	if p.TraceId == 0 || p.SpanId == 0 || p.ParentSpanId != 0 {
+		t.Fatal("expect a new trace")
+	}
+
+	// a peer not using the trace mark gets the plain pack
+	buff, err := c.pack(p)
+	if err != nil || binary.BigEndian.Uint16(buff) != GetPackMark() || len(buff) != SOCK_PACK_HEADER_LEN+len(p.Data) {
+		t.Fatal("expect a plain pack:", err)
+	}
+
+	c.SetTraceMark(true)
+	buff, err = c.pack(p)
+	if err != nil || len(buff) != p.GetPackLen() {
+		t.Fatal("pack error:", err)
+	}
+
+	recv, err := c.unpack(buff)
+	if err != nil {
+		t.Fatal("unpack error:", err)
+	}
+
+	if recv.TraceId != p.TraceId || recv.SpanId != p.SpanId || string(recv.Data) != "hello" {
+		t.Fatal("trace context lost")
+	}
+
+	recv.startSpan()
+	if recv.ParentSpanId != p.SpanId || recv.SpanId == p.SpanId {
+		t.Fatal("expect a child span")
+	}
+
+	if string(recv.GetDataFromRaw()) != "hello" {
+		t.Fatal("wrong raw data")
+	}
+}
+
+func TestPostWait(t *testing.T) {
+	m := NewSockMgr(1, 1)
+	for i := 0; i < int(SOCK_TASK_QUE_MAX); i++ {
+		if m.Post(func() {}) != nil {
+			t.Fatal("task queue full too early")
+		}
+	}
+
+	if m.Post(func() {}) != ErrTaskQueFull || m.PostWait(func() {}, 10*time.Millisecond) != ErrTaskQueFull {
+		t.Fatal("full task queue not reported")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-m.taskQue
+	}()
+
+	if err := m.PostWait(func() {}, time.Second); err != nil {
+		t.Fatal("no wait for the task queue:", err)
+	}
+}
+
+func TestConnReadClock(t *testing.T) {
+	clock := util.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local))
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	conn := NewSockConn(a, make(chan *SockPackWrap, 1))
+	conn.clock = clock
+	waitReadTimer := func() {
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second)
+		for clock.GetTimerCount() != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("read timer not set")
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	result := make(chan error, 1)
+	read := func() {
+		_, err := conn.readToBuff(make([]byte, 4))
+		result <- err
+	}
+
+	// the read deadline follows the clock
+	go read()
+	waitReadTimer()
+	clock.Advance(SOCK_READ_DEAD_LINE * time.Second)
+	waitReadTimer()
+
+	b.Write([]byte{1, 2, 3, 4})
+	if err := <-result; err != nil || clock.GetTimerCount() != 0 {
+		t.Fatal("wrong read:", err, clock.GetTimerCount())
+	}
+
+	// Stop wakes the read without the clock
+	go read()
+	waitReadTimer()
+	conn.Stop()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("read not stopped")
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("read not woken by Stop")
+	}
+}
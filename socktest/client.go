@@ -0,0 +1,204 @@
+package socktest
+
+import (
+	"errors"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/sock"
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const CLIENT_RECV_QUE_MAX = 1024
+
+var (
+	ErrPackTimeout error = errors.New("wait pack timeout")
+	ErrConnClosed  error = errors.New("conn closed")
+)
+
+// Client is a scripted peer of a server, it reads and writes the packs with a SockConn
+// but handles nothing by itself: the test sends the requests and waits for the packs.
+// The assertions call t.Fatal, so they must be called from the test goroutine
+type Client struct {
+	h       *Harness
+	Conn    *sock.SockConn
+	endType uint8
+	endNo   uint16
+	dstEnd  uint8
+	dstNo   uint16
+	recvQue chan *sock.SockPackWrap
+	pending []*sock.SockPack
+	closed  bool
+}
+
+// Connect connect a scripted client to the address on the network
+func (h *Harness) Connect(address string, endType uint8, endNo uint16) *Client {
+	h.t.Helper()
+
+	c, err := h.Net.Dial(PIPE_NETWORK, address, 0)
+	if err != nil {
+		h.t.Fatalf("socktest: connect %s: %v", address, err)
+	}
+
+	client := &Client{
+		h:       h,
+		endType: endType,
+		endNo:   endNo,
+		dstEnd:  0,
+		dstNo:   0,
+		recvQue: make(chan *sock.SockPackWrap, CLIENT_RECV_QUE_MAX),
+		pending: make([]*sock.SockPack, 0),
+		closed:  false,
+	}
+
+	client.Conn = sock.NewSockConn(c, client.recvQue)
+	client.Conn.SetLogger(util.LoggerWith(util.Logger, "client", c.LocalAddr().String()))
+	client.Conn.Start()
+
+	h.t.Cleanup(client.Close)
+	return client
+}
+
+// SetDst set the destination of the requests
+func (c *Client) SetDst(dstEnd uint8, dstNo uint16) {
+	c.dstEnd = dstEnd
+	c.dstNo = dstNo
+}
+
+// Send send the pack as it is
+func (c *Client) Send(p *sock.SockPack) {
+	c.h.t.Helper()
+
+	err := c.Conn.PushRespone(p)
+	if err != nil {
+		c.h.t.Fatalf("socktest: send cmd %d: %v", p.Cmd, err)
+	}
+}
+
+// Request send a pack from the client to its destination
+func (c *Client) Request(cmd uint16, data []byte) *sock.SockPack {
+	c.h.t.Helper()
+
+	p := sock.NewReqSockPack(cmd, c.endType, c.endNo, c.dstEnd, c.dstNo)
+	p.Data = data
+	p.DataLen = uint16(len(data))
+	c.Send(p)
+	return p
+}
+
+// WaitPack wait for the next pack of the cmd, the packs of the other cmds received
+// meanwhile are kept for the later waits.
+// ErrConnClosed is returned if the conn is closed before the pack comes
+func (c *Client) WaitPack(cmd uint16, timeout time.Duration) (*sock.SockPack, error) {
+	for i, p := range c.pending {
+		if p.Cmd == cmd {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return p, nil
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		p, err := c.recv(timer.C)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Cmd == cmd {
+			return p, nil
+		}
+
+		c.pending = append(c.pending, p)
+	}
+}
+
+// ExpectPack fail the test if no pack of the cmd comes in time
+func (c *Client) ExpectPack(cmd uint16, timeout time.Duration) *sock.SockPack {
+	c.h.t.Helper()
+
+	p, err := c.WaitPack(cmd, timeout)
+	if err != nil {
+		c.h.t.Fatalf("socktest: expect cmd %d: %v, pending cmds %v", cmd, err, c.getPendingCmds())
+	}
+
+	return p
+}
+
+// ExpectNoPack fail the test if any pack comes in the duration
+func (c *Client) ExpectNoPack(d time.Duration) {
+	c.h.t.Helper()
+
+	if len(c.pending) > 0 {
+		c.h.t.Fatalf("socktest: expect no pack, pending cmds %v", c.getPendingCmds())
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	p, err := c.recv(timer.C)
+	if err == nil {
+		c.h.t.Fatalf("socktest: expect no pack, got cmd %d", p.Cmd)
+	}
+}
+
+// ExpectClosed fail the test if the conn is not closed by the peer in time
+func (c *Client) ExpectClosed(timeout time.Duration) {
+	c.h.t.Helper()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		p, err := c.recv(timer.C)
+		if err == ErrConnClosed {
+			return
+		}
+
+		if err != nil {
+			c.h.t.Fatalf("socktest: expect conn closed: %v", err)
+		}
+
+		c.pending = append(c.pending, p)
+	}
+}
+
+// Close close the conn, it is called at the end of the test too
+func (c *Client) Close() {
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+	c.Conn.Stop()
+}
+
+// recv get the next pack, the received packs are taken before a closed conn is reported
+func (c *Client) recv(timeoutEvt <-chan time.Time) (*sock.SockPack, error) {
+	ticker := time.NewTicker(LEAK_CHECK_INTV)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case wrap := <-c.recvQue:
+			return wrap.Pack, nil
+
+		case <-timeoutEvt:
+			return nil, ErrPackTimeout
+
+		case <-ticker.C:
+			if c.Conn.IsReadExit() && len(c.recvQue) == 0 {
+				return nil, ErrConnClosed
+			}
+		}
+	}
+}
+
+func (c *Client) getPendingCmds() []uint16 {
+	cmds := make([]uint16, 0, len(c.pending))
+	for _, p := range c.pending {
+		cmds = append(cmds, p.Cmd)
+	}
+
+	return cmds
+}
@@ -0,0 +1,75 @@
+package socktest
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+)
+
+// LEAK_CHECK_PKG the goroutines running the code of the packages under it are checked
+const LEAK_CHECK_PKG = "github.com/wuyiyinxia/yxlib"
+
+// goroutineSnapshot the ids of the goroutines at a moment
+type goroutineSnapshot map[string]bool
+
+func takeGoroutineSnapshot() goroutineSnapshot {
+	snapshot := make(goroutineSnapshot)
+	for _, g := range getGoroutineStacks() {
+		snapshot[getGoroutineId(g)] = true
+	}
+
+	return snapshot
+}
+
+// getLeaked get the stacks of the goroutines started after the snapshot and still running the repo code.
+// The goroutines of the testing package, like the parallel subtests, are ignored.
+// The goroutines started by the other tests running meanwhile are reported too,
+// so the check is only right when the harness runs alone
+func (s goroutineSnapshot) getLeaked() []string {
+	leaked := make([]string, 0)
+	for _, g := range getGoroutineStacks() {
+		if s[getGoroutineId(g)] {
+			continue
+		}
+
+		if !strings.Contains(g, LEAK_CHECK_PKG) || strings.Contains(g, "testing.tRunner") {
+			continue
+		}
+
+		leaked = append(leaked, g)
+	}
+
+	return leaked
+}
+
+func getGoroutineStacks() []string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make([]string, 0)
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		if len(g) > 0 {
+			stacks = append(stacks, string(g))
+		}
+	}
+
+	return stacks
+}
+
+// getGoroutineId get "12" from "goroutine 12 [running]:"
+func getGoroutineId(stack string) string {
+	fields := strings.SplitN(stack, " ", 3)
+	if len(fields) < 2 {
+		return ""
+	}
+
+	return fields[1]
+}
@@ -0,0 +1,270 @@
+package socktest
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PIPE_NETWORK        = "pipe"
+	PIPE_ACCEPT_BACKLOG = 128
+)
+
+var (
+	ErrAddrInUse   error = errors.New("pipe address in use")
+	ErrConnRefused error = errors.New("pipe connection refused")
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return PIPE_NETWORK
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// pipeConn is one end of a net.Pipe with the addresses of the ends,
+// the network counts it as open until it is closed
+type pipeConn struct {
+	net.Conn
+	n         *Network
+	local     pipeAddr
+	remote    pipeAddr
+	closeOnce sync.Once
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *pipeConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.n.removeConn(c)
+	})
+
+	return err
+}
+
+// Network is an in-memory network, the listeners are found by address
+// and every dial makes a net.Pipe. It keeps the open conns for the leak check
+type Network struct {
+	lck              sync.Mutex
+	mapAddr2Listener map[string]*Listener
+	mapConn          map[*pipeConn]bool
+	lastPort         int
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		mapAddr2Listener: make(map[string]*Listener),
+		mapConn:          make(map[*pipeConn]bool),
+		lastPort:         0,
+	}
+}
+
+// Listen listen on the address, any string not used by another listener is valid
+func (n *Network) Listen(address string) (*Listener, error) {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+
+	if _, ok := n.mapAddr2Listener[address]; ok {
+		return nil, ErrAddrInUse
+	}
+
+	l := &Listener{
+		n:         n,
+		addr:      pipeAddr(address),
+		acceptQue: make(chan net.Conn, PIPE_ACCEPT_BACKLOG),
+		closeEvt:  make(chan bool),
+		acceptEvt: make(chan bool),
+	}
+
+	n.mapAddr2Listener[address] = l
+	return l, nil
+}
+
+// Dial connect to the listener on the address, it has the signature of sock.SockDialer,
+// so a Server can connect with it. The network and the timeout are ignored,
+// a dial never waits: it is refused if the listener is closed or its backlog is full
+func (n *Network) Dial(network string, address string, timeout time.Duration) (net.Conn, error) {
+	n.lck.Lock()
+	n.lastPort++
+	local := "pipe:" + strconv.Itoa(n.lastPort)
+	n.lck.Unlock()
+
+	return n.DialFrom(local, address)
+}
+
+// DialFrom connect from the given local address, the ip based limits can be tested with it
+func (n *Network) DialFrom(local string, address string) (net.Conn, error) {
+	n.lck.Lock()
+	l := n.mapAddr2Listener[address]
+	n.lck.Unlock()
+
+	if l == nil {
+		return nil, ErrConnRefused
+	}
+
+	c1, c2 := net.Pipe()
+	client := n.addConn(c1, pipeAddr(local), pipeAddr(address))
+	serv := n.addConn(c2, pipeAddr(address), pipeAddr(local))
+
+	if !l.push(serv) {
+		client.Close()
+		serv.Close()
+		return nil, ErrConnRefused
+	}
+
+	return client, nil
+}
+
+// GetOpenConnCount get the number of the conn ends not closed
+func (n *Network) GetOpenConnCount() int {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+
+	return len(n.mapConn)
+}
+
+// GetOpenConns get the "local->remote" of the conn ends not closed
+func (n *Network) GetOpenConns() []string {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+
+	conns := make([]string, 0, len(n.mapConn))
+	for c := range n.mapConn {
+		conns = append(conns, c.local.String()+"->"+c.remote.String())
+	}
+
+	sort.Strings(conns)
+	return conns
+}
+
+func (n *Network) addConn(c net.Conn, local pipeAddr, remote pipeAddr) *pipeConn {
+	pc := &pipeConn{
+		Conn:   c,
+		n:      n,
+		local:  local,
+		remote: remote,
+	}
+
+	n.lck.Lock()
+	n.mapConn[pc] = true
+	n.lck.Unlock()
+
+	return pc
+}
+
+func (n *Network) removeConn(c *pipeConn) {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+
+	delete(n.mapConn, c)
+}
+
+func (n *Network) removeListener(l *Listener) {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+
+	if n.mapAddr2Listener[l.addr.String()] == l {
+		delete(n.mapAddr2Listener, l.addr.String())
+	}
+}
+
+// Listener is a net.Listener of the Network
+type Listener struct {
+	n         *Network
+	addr      pipeAddr
+	acceptQue chan net.Conn
+	closeEvt  chan bool
+	acceptEvt chan bool // closed when Accept is called the first time
+	lck       sync.Mutex
+	closed    bool
+	accepting bool
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	l.lck.Lock()
+	if !l.accepting {
+		l.accepting = true
+		close(l.acceptEvt)
+	}
+	l.lck.Unlock()
+
+	select {
+	case c := <-l.acceptQue:
+		return c, nil
+
+	case <-l.closeEvt:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stop accepting, the conns not accepted yet are closed
+func (l *Listener) Close() error {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	close(l.closeEvt)
+	l.n.removeListener(l)
+
+	for {
+		select {
+		case c := <-l.acceptQue:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// push put the conn in the backlog, false if the listener is closed or the backlog is full
+func (l *Listener) push(c net.Conn) bool {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	if l.closed {
+		return false
+	}
+
+	select {
+	case l.acceptQue <- c:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitAccept wait until someone is accepting, false on timeout
+func (l *Listener) WaitAccept(timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-l.acceptEvt:
+		return true
+
+	case <-t.C:
+		return false
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
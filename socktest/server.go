@@ -0,0 +1,131 @@
+package socktest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib"
+	"github.com/wuyiyinxia/yxlib/sock"
+)
+
+// SERV_STOP_TIMEOUT how long the closing waits for the manager loop to exit
+const SERV_STOP_TIMEOUT = 5 * time.Second
+
+// TestServer is a Server listening on the harness network and driven by the fake clock,
+// its Connect dials the network too
+type TestServer struct {
+	h       *Harness
+	Serv    *yxlib.Server
+	endType uint8
+	endNo   uint16
+	addr    string
+	started bool
+	exitEvt chan bool
+}
+
+// NewServer create a server listening on "serv-<endType>-<endNo>",
+// the services should be added before Start
+func (h *Harness) NewServer(endType uint8, endNo uint16) *TestServer {
+	h.t.Helper()
+
+	s := &TestServer{
+		h:       h,
+		Serv:    yxlib.NewServer(endType, endNo),
+		endType: endType,
+		endNo:   endNo,
+		addr:    fmt.Sprintf("serv-%d-%d", endType, endNo),
+		started: false,
+		exitEvt: make(chan bool),
+	}
+
+	s.Serv.SetClock(h.Clock)
+	s.Serv.SetDialer(h.Net.Dial)
+	return s
+}
+
+func (s *TestServer) GetAddr() string {
+	return s.addr
+}
+
+// Start run the server in the background and wait until it accepts,
+// it is closed at the end of the test
+func (s *TestServer) Start() {
+	s.h.t.Helper()
+
+	l, err := s.h.Net.Listen(s.addr)
+	if err != nil {
+		s.h.t.Fatalf("socktest: listen %s: %v", s.addr, err)
+	}
+
+	s.started = true
+	go func() {
+		s.Serv.StartWithListener(l)
+		close(s.exitEvt)
+	}()
+
+	s.h.t.Cleanup(s.Close)
+
+	// a server stopped before it accepts would miss the stop
+	if !l.WaitAccept(SERV_STOP_TIMEOUT) {
+		s.h.t.Fatalf("socktest: server %s not accepting", s.addr)
+	}
+}
+
+// Connect connect a scripted client with the identity endType/endNo to the server,
+// the packs it sends are addressed to the server
+func (s *TestServer) Connect(endType uint8, endNo uint16) *Client {
+	s.h.t.Helper()
+
+	c := s.h.Connect(s.addr, endType, endNo)
+	c.SetDst(s.endType, s.endNo)
+	return c
+}
+
+// Sweep advance the clock by a maintenance interval,
+// so the manager removes the closed conns
+func (s *TestServer) Sweep() {
+	s.h.Advance(sock.SOCK_MAINTAIN_INTV)
+}
+
+// WaitConnCount wait until the manager has n conns, false on timeout.
+// The closed conns are counted until they are swept
+func (s *TestServer) WaitConnCount(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.Serv.GetConnCount() != n {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(LEAK_CHECK_INTV)
+	}
+
+	return true
+}
+
+// Close stop the server and wait for the manager loop to exit,
+// the clock is advanced for the manager to check the closed conns
+func (s *TestServer) Close() {
+	if !s.started {
+		return
+	}
+
+	s.started = false
+	s.Serv.Stop()
+
+	deadline := time.Now().Add(SERV_STOP_TIMEOUT)
+	for {
+		select {
+		case <-s.exitEvt:
+			return
+
+		case <-time.After(LEAK_CHECK_INTV):
+		}
+
+		if time.Now().After(deadline) {
+			s.h.t.Errorf("socktest: server %s not stopped, %d conns left", s.addr, s.Serv.GetConnCount())
+			return
+		}
+
+		s.h.Advance(sock.SOCK_CHECK_ALL_CLOSE_INTV)
+	}
+}
@@ -0,0 +1,117 @@
+// Package socktest runs the servers and the scripted clients on an in-memory network,
+// so the sock code can be tested without real sockets and real waits.
+//
+// A test creates a Harness, starts the servers on it and connects the clients:
+//
+//	h := socktest.New(t)
+//	s := h.NewServer(1, 1)
+//	s.Serv.AddCmdRange(0x0101, 0x01FF, 0x01)
+//	s.Serv.AddService(0x01, service)
+//	s.Start()
+//
+//	c := s.Connect(2, 1)
+//	c.Request(0x0101, data)
+//	p := c.ExpectPack(0x0102, time.Second)
+//
+// All the servers share a FakeClock, the maintenance and the timers only move with Advance.
+// At the end of the test the clients and the servers are closed, and the goroutines
+// and the conns left behind are reported as errors.
+//
+// The goroutines are checked for the whole process, so the tests using a harness must not
+// run in parallel with the other tests starting the goroutines of this module.
+// The goroutine check is skipped with a log when two harnesses overlap, the conns are
+// still checked as every harness has its own network
+package socktest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	LEAK_CHECK_TIMEOUT = 5 * time.Second
+	LEAK_CHECK_INTV    = 10 * time.Millisecond
+)
+
+// SOCKTEST_START_TIME the time of the fake clock when a harness is created
+var SOCKTEST_START_TIME = time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local)
+
+type Harness struct {
+	t          testing.TB
+	Net        *Network
+	Clock      *util.FakeClock
+	snapshot   goroutineSnapshot
+	overlapped bool // another harness was alive at the same time, guarded by lckHarness
+}
+
+var lckHarness sync.Mutex
+var mapHarness = make(map[*Harness]bool) // the harnesses alive
+
+// New create a harness for the test, the leak check is registered to the cleanup of t,
+// it runs after the cleanups of the servers and the clients
+func New(t testing.TB) *Harness {
+	h := &Harness{
+		t:        t,
+		Net:      NewNetwork(),
+		Clock:    util.NewFakeClock(SOCKTEST_START_TIME),
+		snapshot: takeGoroutineSnapshot(),
+	}
+
+	lckHarness.Lock()
+	for other := range mapHarness {
+		other.overlapped = true
+		h.overlapped = true
+	}
+
+	mapHarness[h] = true
+	lckHarness.Unlock()
+
+	t.Cleanup(h.checkLeaks)
+	return h
+}
+
+// Advance move the fake clock of all the servers
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Advance(d)
+}
+
+// checkLeaks wait for the goroutines and the conns to end, then report the ones left
+func (h *Harness) checkLeaks() {
+	lckHarness.Lock()
+	delete(mapHarness, h)
+	overlapped := h.overlapped
+	lckHarness.Unlock()
+
+	if overlapped {
+		h.t.Log("socktest: goroutine leak check skipped, the harness overlapped with another one")
+	}
+
+	var leaked []string = nil
+	var conns []string = nil
+
+	deadline := time.Now().Add(LEAK_CHECK_TIMEOUT)
+	for {
+		if !overlapped {
+			leaked = h.snapshot.getLeaked()
+		}
+
+		conns = h.Net.GetOpenConns()
+		if (len(leaked) == 0 && len(conns) == 0) || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(LEAK_CHECK_INTV)
+	}
+
+	if len(conns) > 0 {
+		h.t.Errorf("socktest: %d conns not closed: %s", len(conns), strings.Join(conns, ", "))
+	}
+
+	if len(leaked) > 0 {
+		h.t.Errorf("socktest: %d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+	}
+}
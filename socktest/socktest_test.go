@@ -0,0 +1,170 @@
+package socktest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wuyiyinxia/yxlib"
+	"github.com/wuyiyinxia/yxlib/sock"
+)
+
+const (
+	TEST_MOD      uint16 = 0x01
+	TEST_CMD_ECHO uint16 = 0x0101
+	TEST_CMD_RESP uint16 = 0x0102
+	TEST_CMD_PUSH uint16 = 0x0103
+	TEST_CMD_KICK uint16 = 0x0104
+)
+
+type echoService struct {
+	serv *yxlib.Server
+}
+
+func (s *echoService) OnHandlePack(p *sock.SockPack, c net.Conn) error {
+	switch p.Cmd {
+	case TEST_CMD_ECHO:
+		push := sock.GetRespSockPack(p)
+		push.Cmd = TEST_CMD_PUSH
+		s.serv.Send(push, c)
+
+		resp := sock.GetRespSockPack(p)
+		resp.Cmd = TEST_CMD_RESP
+		resp.Data = p.Data
+		return s.serv.Send(resp, c)
+
+	case TEST_CMD_KICK:
+		s.serv.CloseConn(c)
+		return nil
+	}
+
+	return yxlib.ErrCmdNotFound
+}
+
+func startEchoServer(h *Harness) *TestServer {
+	s := h.NewServer(1, 1)
+	s.Serv.AddCmdRange(TEST_CMD_ECHO, TEST_CMD_KICK, TEST_MOD)
+	s.Serv.AddService(TEST_MOD, &echoService{serv: s.Serv})
+	s.Start()
+	return s
+}
+
+func TestEcho(t *testing.T) {
+	h := New(t)
+	s := startEchoServer(h)
+
+	c := s.Connect(2, 1)
+	c.Request(TEST_CMD_ECHO, []byte("hello"))
+
+	// the push before the respone is kept for the later wait
+	p := c.ExpectPack(TEST_CMD_RESP, time.Second)
+	if string(p.Data) != "hello" || p.SrcEnd != 1 || p.DstEnd != 2 {
+		t.Fatal("wrong respone:", p)
+	}
+
+	c.ExpectPack(TEST_CMD_PUSH, time.Second)
+	c.ExpectNoPack(50 * time.Millisecond)
+
+	if _, err := c.WaitPack(TEST_CMD_RESP, 50*time.Millisecond); err != ErrPackTimeout {
+		t.Fatal("expect ErrPackTimeout, got", err)
+	}
+}
+
+func TestKick(t *testing.T) {
+	h := New(t)
+	s := startEchoServer(h)
+
+	c1 := s.Connect(2, 1)
+	c2 := s.Connect(2, 2)
+	if !s.WaitConnCount(2, time.Second) {
+		t.Fatal("conns not added:", s.Serv.GetConnCount())
+	}
+
+	c1.Request(TEST_CMD_KICK, nil)
+	c1.ExpectClosed(time.Second)
+
+	// the closed conn stays in the manager until the maintenance sweeps it
+	s.Sweep()
+	if !s.WaitConnCount(1, time.Second) {
+		t.Fatal("closed conn not swept:", s.Serv.GetConnCount())
+	}
+
+	c2.Request(TEST_CMD_ECHO, nil)
+	c2.ExpectPack(TEST_CMD_RESP, time.Second)
+}
+
+func TestServerConnect(t *testing.T) {
+	h := New(t)
+	s1 := h.NewServer(1, 1)
+	svc, err := yxlib.NewIdSegService(s1.Serv, t.TempDir()+"/id_seg.json", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.Register()
+	s1.Start()
+
+	s2 := h.NewServer(2, 1)
+	s2.Start()
+
+	conn, err := s2.Serv.Connect(PIPE_NETWORK, s1.GetAddr(), 1)
+	if err != nil {
+		t.Fatal("connect error:", err)
+	}
+
+	client := yxlib.NewIdSegClient(s2.Serv, conn, 1, 1)
+	client.Register()
+	for i := uint64(1); i <= 25; i++ {
+		id, err := client.NextId("order")
+		if err != nil || id != i {
+			t.Fatal("wrong id:", id, err)
+		}
+	}
+
+	if _, err := h.Net.Dial(PIPE_NETWORK, "serv-9-9", 0); err != ErrConnRefused {
+		t.Fatal("expect ErrConnRefused, got", err)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	h := New(t)
+	s := startEchoServer(h)
+
+	fired := make(chan bool, 1)
+	s.Serv.AfterFunc(time.Hour, func() { fired <- true })
+
+	select {
+	case <-fired:
+		t.Fatal("timer fired before the clock moves")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the wheel goroutine takes one tick at a time
+	deadline := time.Now().Add(time.Second)
+	for len(fired) == 0 && time.Now().Before(deadline) {
+		h.Advance(10 * time.Minute)
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(fired) == 0 {
+		t.Fatal("timer not fired")
+	}
+}
+
+func TestHarnessOverlap(t *testing.T) {
+	h1 := New(t)
+	h2 := New(t)
+	if !h1.overlapped || !h2.overlapped {
+		t.Fatal("overlap not detected")
+	}
+
+	// an overlapped harness still runs and closes its servers
+	s := startEchoServer(h2)
+	s.Connect(2, 1).Request(TEST_CMD_ECHO, nil)
+}
+
+func TestHarnessAlone(t *testing.T) {
+	if New(t).overlapped {
+		t.Fatal("harness overlapped with a finished one")
+	}
+}
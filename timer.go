@@ -0,0 +1,44 @@
+package yxlib
+
+import (
+	"time"
+
+	"github.com/wuyiyinxia/yxlib/util"
+)
+
+const (
+	SERV_TIMER_TICK      = 10 * time.Millisecond
+	SERV_TIMER_POST_WAIT = time.Second // how long a callback waits for the full task queue of the loop
+)
+
+// AfterFunc call f once after d, the timer can be stopped or reset
+func (s *Server) AfterFunc(d time.Duration, f func()) *util.WheelTimer {
+	s.wheel.Start()
+	return s.wheel.AfterFunc(d, f)
+}
+
+// Every call f every d until the timer is stopped
+func (s *Server) Every(d time.Duration, f func()) *util.WheelTimer {
+	s.wheel.Start()
+	return s.wheel.Every(d, f)
+}
+
+// SetTimerOnLoop run the timer callbacks on the sock manager loop, where the packs
+// are handled if there is no dispatcher, so they need no lock against the handlers.
+// With a dispatcher the handlers run on the workers, and the callbacks need the same
+// locks as the handlers. Otherwise the callbacks run on the timer goroutine.
+// When the task queue of the loop is full, the timer goroutine waits up to
+// SERV_TIMER_POST_WAIT, the callback is dropped with an error log after that
+func (s *Server) SetTimerOnLoop(onLoop bool) {
+	if !onLoop {
+		s.wheel.SetExecutor(nil)
+		return
+	}
+
+	s.wheel.SetExecutor(func(f func()) {
+		err := s.mgr.PostWait(f, SERV_TIMER_POST_WAIT)
+		if err != nil {
+			s.mgr.GetLogger().E(LOG_TAG_SERV, "timer callback dropped: ", err)
+		}
+	})
+}
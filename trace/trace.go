@@ -0,0 +1,125 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Span is the handling of a pack on one hop
+type Span struct {
+	TraceId  uint64
+	SpanId   uint64
+	ParentId uint64
+	Name     string
+	EndType  uint8
+	EndNo    uint16
+	Start    time.Time
+	Duration time.Duration
+	Error    string
+}
+
+type SpanExporter interface {
+	Export(s *Span)
+}
+
+// NewId generate a random non-zero id
+func NewId() uint64 {
+	buff := make([]byte, 8)
+	for {
+		_, err := rand.Read(buff)
+		if err != nil {
+			// fall back to the clock, it is still unique enough for tracing
+			return uint64(time.Now().UnixNano()) | 1
+		}
+
+		id := binary.BigEndian.Uint64(buff)
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+func FormatId(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+type jsonSpan struct {
+	TraceId    string `json:"trace_id"`
+	SpanId     string `json:"span_id"`
+	ParentId   string `json:"parent_id,omitempty"`
+	Name       string `json:"name"`
+	EndType    uint8  `json:"end_type"`
+	EndNo      uint16 `json:"end_no"`
+	Start      string `json:"start"`
+	DurationUs int64  `json:"duration_us"`
+	Error      string `json:"error,omitempty"`
+}
+
+// JsonExporter write every span as a json line
+type JsonExporter struct {
+	lck sync.Mutex
+	w   io.Writer
+	f   *os.File
+}
+
+func NewJsonExporter(w io.Writer) *JsonExporter {
+	return &JsonExporter{
+		w: w,
+		f: nil,
+	}
+}
+
+// NewFileExporter append the json lines to the file
+func NewFileExporter(file string) (*JsonExporter, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JsonExporter{
+		w: f,
+		f: f,
+	}, nil
+}
+
+func (e *JsonExporter) Export(s *Span) {
+	js := jsonSpan{
+		TraceId:    FormatId(s.TraceId),
+		SpanId:     FormatId(s.SpanId),
+		ParentId:   "",
+		Name:       s.Name,
+		EndType:    s.EndType,
+		EndNo:      s.EndNo,
+		Start:      s.Start.Format(time.RFC3339Nano),
+		DurationUs: s.Duration.Microseconds(),
+		Error:      s.Error,
+	}
+
+	if s.ParentId != 0 {
+		js.ParentId = FormatId(s.ParentId)
+	}
+
+	line, err := json.Marshal(&js)
+	if err != nil {
+		return
+	}
+
+	line = append(line, '\n')
+	e.lck.Lock()
+	e.w.Write(line)
+	e.lck.Unlock()
+}
+
+func (e *JsonExporter) Close() error {
+	if e.f == nil {
+		return nil
+	}
+
+	return e.f.Close()
+}
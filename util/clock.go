@@ -0,0 +1,302 @@
+package util
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the source of the time, so the code depending on time can be tested
+// with a FakeClock
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) ClockTimer
+	NewTicker(d time.Duration) ClockTicker
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+type ClockTimer interface {
+	C() <-chan time.Time // nil for a timer made by AfterFunc
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type ClockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the Clock of the time package
+var RealClock Clock = &realClock{}
+
+// clockHolder keep a Clock in an atomic.Value, which needs the same type on every store
+type clockHolder struct {
+	c Clock
+}
+
+var defaultClock atomic.Value // clockHolder, RealClock before SetClock
+
+// SetClock set the clock of the time helpers and the logger, it is safe while logging
+func SetClock(c Clock) {
+	if c == nil {
+		c = RealClock
+	}
+
+	defaultClock.Store(clockHolder{c: c})
+}
+
+func GetClock() Clock {
+	h, ok := defaultClock.Load().(clockHolder)
+	if !ok {
+		return RealClock
+	}
+
+	return h.c
+}
+
+type realClock struct {
+}
+
+func (c *realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (c *realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (c *realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *realClock) NewTimer(d time.Duration) ClockTimer {
+	return &realTimer{t: time.NewTimer(d)}
+}
+
+func (c *realClock) NewTicker(d time.Duration) ClockTicker {
+	return &realTicker{t: time.NewTicker(d)}
+}
+
+func (c *realClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return &realTimer{t: time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t *realTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *realTicker) Stop() {
+	t.t.Stop()
+}
+
+// FakeClock only moves when Advance or Set is called, the timers and the tickers
+// due are fired in time order while it moves. The AfterFunc callbacks run on
+// the goroutine calling Advance
+type FakeClock struct {
+	lck    sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:    now,
+		timers: make([]*fakeTimer, 0),
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Sleep block until the clock is advanced by d
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) ClockTimer {
+	return c.addTimer(d, 0, nil)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) ClockTicker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	return &fakeTicker{t: c.addTimer(d, d, nil)}
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return c.addTimer(d, 0, f)
+}
+
+// GetTimerCount get the number of the active timers and tickers,
+// a test can wait for a goroutine to set its timer with it
+func (c *FakeClock) GetTimerCount() int {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	return len(c.timers)
+}
+
+// Set move the clock to t, it never moves backwards
+func (c *FakeClock) Set(t time.Time) {
+	c.Advance(t.Sub(c.Now()))
+}
+
+// Advance move the clock forward by d, and fire the timers due in time order
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lck.Lock()
+	target := c.now.Add(d)
+	for {
+		var next *fakeTimer = nil
+		for _, t := range c.timers {
+			if !t.when.After(target) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		if next.when.After(c.now) {
+			c.now = next.when
+		}
+
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			c.removeTimer(next)
+		}
+
+		if next.f != nil {
+			c.lck.Unlock()
+			next.f()
+			c.lck.Lock()
+		} else {
+			// drop the tick if the last one is not taken, as the time package does
+			select {
+			case next.ch <- c.now:
+			default:
+			}
+		}
+	}
+
+	if target.After(c.now) {
+		c.now = target
+	}
+
+	c.lck.Unlock()
+}
+
+func (c *FakeClock) addTimer(d time.Duration, period time.Duration, f func()) *fakeTimer {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	t := &fakeTimer{
+		c:      c,
+		when:   c.now.Add(d),
+		period: period,
+		ch:     nil,
+		f:      f,
+	}
+
+	if f == nil {
+		t.ch = make(chan time.Time, 1)
+	}
+
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// removeTimer the lock must be held
+func (c *FakeClock) removeTimer(t *fakeTimer) bool {
+	for i, v := range c.timers {
+		if v == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+type fakeTimer struct {
+	c      *FakeClock
+	when   time.Time
+	period time.Duration
+	ch     chan time.Time
+	f      func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.lck.Lock()
+	defer t.c.lck.Unlock()
+
+	return t.c.removeTimer(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.lck.Lock()
+	defer t.c.lck.Unlock()
+
+	active := t.c.removeTimer(t)
+	t.when = t.c.now.Add(d)
+	t.c.timers = append(t.c.timers, t)
+	return active
+}
+
+type fakeTicker struct {
+	t *fakeTimer
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.t.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.t.Stop()
+}
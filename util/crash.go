@@ -0,0 +1,209 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_TAG_CRASH   = "Crash"
+	LOG_SINK_CRASH  = "crash"
+	CRASH_LOG_LINES = 200
+)
+
+// CrashHandler write a crash file when a panic is recovered by it,
+// and dump the goroutine stacks when a signal comes, without exiting
+type CrashHandler struct {
+	dir       string
+	ring      *RingSink
+	startTime time.Time
+	lckSig    sync.Mutex
+	sigChan   chan os.Signal
+}
+
+// NewCrashHandler keep the last lines of the logs for the crash files written to dir,
+// lines <= 0 means CRASH_LOG_LINES
+func NewCrashHandler(dir string, lines int) *CrashHandler {
+	if lines <= 0 {
+		lines = CRASH_LOG_LINES
+	}
+
+	h := &CrashHandler{
+		dir:       dir,
+		ring:      NewRingSink(lines),
+		startTime: time.Now(),
+		sigChan:   nil,
+	}
+
+	Logger.AddSink(LOG_SINK_CRASH, h.ring, LOG_LV_DEBUG, nil)
+	return h
+}
+
+// Recover must be deferred directly, it writes the crash file and panics again
+// so the process still exits as before:
+//
+//	defer h.Recover()
+//
+// The server defers it on the manager loop, the dispatcher workers and the timer goroutine,
+// see SetCrashHandler of the Server
+func (h *CrashHandler) Recover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	h.HandlePanic(r, debug.Stack())
+	panic(r)
+}
+
+// HandlePanic flush the logger and write the crash file, return the file name
+func (h *CrashHandler) HandlePanic(r interface{}, stack []byte) string {
+	Logger.Flush()
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("panic: %v\n\n", r))
+	sb.WriteString("stack:\n")
+	sb.Write(stack)
+	sb.WriteString("\n")
+	h.writeRuntimeStats(&sb)
+	sb.WriteString("\nlast logs:\n")
+	for _, line := range h.ring.Lines() {
+		sb.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+
+	file, err := h.writeFile("crash", sb.String())
+	if err != nil {
+		Logger.E(LOG_TAG_CRASH, "write crash file error: ", err)
+	} else {
+		Logger.E(LOG_TAG_CRASH, "panic: ", r, ", crash file: ", file)
+	}
+
+	Logger.Flush()
+	return file
+}
+
+// DumpGoroutines write the stacks of all the goroutines to a file, return the file name
+func (h *CrashHandler) DumpGoroutines() (string, error) {
+	buff := make([]byte, 1024*1024)
+	for {
+		n := runtime.Stack(buff, true)
+		if n < len(buff) {
+			buff = buff[:n]
+			break
+		}
+
+		buff = make([]byte, len(buff)*2)
+	}
+
+	var sb strings.Builder
+	h.writeRuntimeStats(&sb)
+	sb.WriteString("\ngoroutines:\n")
+	sb.Write(buff)
+	return h.writeFile("goroutine", sb.String())
+}
+
+// WatchSignals dump the goroutine stacks when one of the signals comes,
+// SIGQUIT and SIGUSR1 by default. The process keeps running
+func (h *CrashHandler) WatchSignals(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = crashDumpSignals
+	}
+
+	h.lckSig.Lock()
+	defer h.lckSig.Unlock()
+
+	h.stopWatchSignals()
+	h.sigChan = make(chan os.Signal, 1)
+	signal.Notify(h.sigChan, sigs...)
+	go func(ch chan os.Signal) {
+		for sig := range ch {
+			file, err := h.DumpGoroutines()
+			if err != nil {
+				Logger.E(LOG_TAG_CRASH, "dump goroutines on ", sig, " error: ", err)
+			} else {
+				Logger.W(LOG_TAG_CRASH, "dump goroutines on ", sig, ": ", file)
+			}
+		}
+	}(h.sigChan)
+}
+
+// StopWatchSignals stop watching the signals
+func (h *CrashHandler) StopWatchSignals() {
+	h.lckSig.Lock()
+	defer h.lckSig.Unlock()
+
+	h.stopWatchSignals()
+}
+
+func (h *CrashHandler) stopWatchSignals() {
+	if h.sigChan == nil {
+		return
+	}
+
+	signal.Stop(h.sigChan)
+	close(h.sigChan)
+	h.sigChan = nil
+}
+
+// Close stop watching the signals and stop keeping the logs
+func (h *CrashHandler) Close() {
+	h.StopWatchSignals()
+	Logger.RemoveSink(LOG_SINK_CRASH)
+}
+
+func (h *CrashHandler) writeRuntimeStats(sb *strings.Builder) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	sb.WriteString("runtime:\n")
+	sb.WriteString(fmt.Sprintf("  time:        %s\n", FormatFullTime(time.Now(), LOG_TIME_FORMAT)))
+	sb.WriteString(fmt.Sprintf("  uptime:      %s\n", time.Since(h.startTime)))
+	sb.WriteString(fmt.Sprintf("  pid:         %d\n", os.Getpid()))
+	sb.WriteString(fmt.Sprintf("  go:          %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH))
+	sb.WriteString(fmt.Sprintf("  cpu:         %d, gomaxprocs: %d\n", runtime.NumCPU(), runtime.GOMAXPROCS(0)))
+	sb.WriteString(fmt.Sprintf("  goroutines:  %d\n", runtime.NumGoroutine()))
+	sb.WriteString(fmt.Sprintf("  heap alloc:  %d, heap inuse: %d, sys: %d\n", ms.HeapAlloc, ms.HeapInuse, ms.Sys))
+	sb.WriteString(fmt.Sprintf("  total alloc: %d, mallocs: %d, frees: %d\n", ms.TotalAlloc, ms.Mallocs, ms.Frees))
+	sb.WriteString(fmt.Sprintf("  gc:          %d, pause total: %s\n", ms.NumGC, time.Duration(ms.PauseTotalNs)))
+}
+
+// writeFile write to dir/prefix_YYYYMMDD_HHMMSS.txt, a number is appended if the name is taken
+func (h *CrashHandler) writeFile(prefix string, content string) (string, error) {
+	err := os.MkdirAll(h.dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	name := prefix + GetFullTimeString("_%s%s%s_%s%s%s")
+	file := path.Join(h.dir, name+".txt")
+	for i := 1; isFileExist(file); i++ {
+		file = path.Join(h.dir, fmt.Sprintf("%s_%d.txt", name, i))
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.WriteString(content)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return file, err
+}
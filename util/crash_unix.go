@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+var crashDumpSignals = []os.Signal{syscall.SIGQUIT, syscall.SIGUSR1}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// there is no SIGUSR1 on windows
+var crashDumpSignals = []os.Signal{syscall.SIGQUIT}
@@ -1,35 +1,218 @@
 package util
 
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrIdOutOfRange error = errors.New("id out of range")
+	ErrIdNotInUse   error = errors.New("id not in use")
+)
+
+type freeId struct {
+	id       uint64
+	freeTime time.Time
+}
+
+// IdGenerator allocate the ids in [min, max], it is safe for concurrent use.
+// The fresh ids are allocated first, so an id is never reused before the range runs out.
+// After that the ids freed before are swept up from min, then the ids freed later are reused in order,
+// both after the quarantine, so a late reference to an old id does not hit the new owner at once.
+// 0 is never allocated, min should be at least 1
 type IdGenerator struct {
-	curId    uint64
-	maxId    uint64
-	reuseIds []uint64
+	lck        sync.Mutex
+	curId      uint64
+	minId      uint64
+	maxId      uint64
+	quarantine time.Duration
+	freeIds    []freeId
+	mapInUse   map[uint64]bool
+	mapQueued  map[uint64]bool // the ids in freeIds
+	exhausted  bool            // the fresh ids run out, the freed ids are queued
+	sweeping   bool            // the ids freed before the exhaustion are not all reused
+	sweepId    uint64          // the next id checked for the ids freed before the exhaustion
+	sweepTime  time.Time       // the exhaustion, the quarantine of the ids freed before starts then
+	clock      Clock
 }
 
 func NewIdGenerator(min uint64, max uint64) *IdGenerator {
+	if min == 0 {
+		min = 1
+	}
+
 	return &IdGenerator{
-		curId:    min,
-		maxId:    max,
-		reuseIds: make([]uint64, 10),
+		curId:      min,
+		minId:      min,
+		maxId:      max,
+		quarantine: 0,
+		freeIds:    make([]freeId, 0),
+		mapInUse:   make(map[uint64]bool),
+		mapQueued:  make(map[uint64]bool),
+		exhausted:  false,
+		sweeping:   false,
+		sweepId:    min,
+		sweepTime:  time.Time{},
+		clock:      RealClock,
 	}
 }
 
+// SetQuarantine set how long a freed id waits before being reused
+func (g *IdGenerator) SetQuarantine(d time.Duration) {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	g.quarantine = d
+}
+
+// SetClock set the clock of the quarantine
+func (g *IdGenerator) SetClock(c Clock) {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	g.clock = c
+}
+
+// GetId get a free id, 0 if all the ids are in use or in quarantine
 func (g *IdGenerator) GetId() uint64 {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
 	var id uint64 = 0
-	l := len(g.reuseIds)
-	if l > 0 {
-		id = g.reuseIds[l-1]
-		g.reuseIds = g.reuseIds[:l-1]
-	} else if g.curId > g.maxId {
-		id = 0
-	} else {
+	if g.curId <= g.maxId && g.curId >= g.minId {
 		id = g.curId
+		// curId wraps to 0 after the last uint64, which stops the allocation
 		g.curId++
+	} else {
+		if !g.exhausted {
+			g.exhausted = true
+			g.sweeping = true
+			g.sweepTime = g.clock.Now()
+		}
+
+		id = g.getFreeId()
+		if id == 0 {
+			return 0
+		}
+	}
+
+	g.mapInUse[id] = true
+	return id
+}
+
+// ReuseId free the id, an id out of range or not in use is an error
+func (g *IdGenerator) ReuseId(id uint64) error {
+	if id < g.minId || id > g.maxId {
+		return ErrIdOutOfRange
+	}
+
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	if !g.mapInUse[id] {
+		return ErrIdNotInUse
+	}
+
+	delete(g.mapInUse, id)
+
+	// the ids freed before the exhaustion are not kept, the sweep finds them
+	if g.exhausted {
+		g.freeIds = append(g.freeIds, freeId{id: id, freeTime: g.clock.Now()})
+		g.mapQueued[id] = true
 	}
 
+	return nil
+}
+
+// getFreeId get a freed id out of the quarantine, 0 if none.
+// The ids freed before the exhaustion go first, the sweep skips the ones in use or queued
+// and moves on from where it stopped, so the range is walked once in all
+func (g *IdGenerator) getFreeId() uint64 {
+	if g.sweeping {
+		// the ids queued are freed after the exhaustion, they are in quarantine too
+		if g.clock.Since(g.sweepTime) < g.quarantine {
+			return 0
+		}
+
+		for g.sweeping {
+			id := g.sweepId
+			if id == g.maxId {
+				g.sweeping = false
+			} else {
+				g.sweepId++
+			}
+
+			if !g.mapInUse[id] && !g.mapQueued[id] {
+				return id
+			}
+		}
+	}
+
+	if len(g.freeIds) == 0 || g.clock.Since(g.freeIds[0].freeTime) < g.quarantine {
+		return 0
+	}
+
+	id := g.freeIds[0].id
+	g.freeIds[0] = freeId{}
+	g.freeIds = g.freeIds[1:]
+	delete(g.mapQueued, id)
 	return id
 }
 
-func (g *IdGenerator) ReuseId(id uint64) {
-	g.reuseIds = append(g.reuseIds, id)
+// getSweepCount get the number of the ids freed before the exhaustion and not reused yet
+func (g *IdGenerator) getSweepCount() uint64 {
+	if !g.sweeping {
+		return 0
+	}
+
+	cnt := g.maxId - g.sweepId + 1
+	for id := range g.mapInUse {
+		if id >= g.sweepId {
+			cnt--
+		}
+	}
+
+	for id := range g.mapQueued {
+		if id >= g.sweepId {
+			cnt--
+		}
+	}
+
+	return cnt
+}
+
+// IsInUse check if the id is allocated and not freed
+func (g *IdGenerator) IsInUse(id uint64) bool {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	return g.mapInUse[id]
+}
+
+// GetInUseCount get the number of the ids allocated and not freed
+func (g *IdGenerator) GetInUseCount() int {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	return len(g.mapInUse)
+}
+
+// GetQuarantineCount get the number of the freed ids waiting to be reused
+func (g *IdGenerator) GetQuarantineCount() int {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	cnt := 0
+	if g.clock.Since(g.sweepTime) < g.quarantine {
+		cnt += int(g.getSweepCount())
+	}
+
+	for _, f := range g.freeIds {
+		if g.clock.Since(f.freeTime) < g.quarantine {
+			cnt++
+		}
+	}
+
+	return cnt
 }
@@ -0,0 +1,147 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_TEXT_TIME_LAYOUT = "2006/01/02 15:04:05"
+)
+
+var ErrLogFormat error = errors.New("unknown log line format")
+
+// DecodeLogLine parse a line written by the TextEncoder or the JsonEncoder.
+// The fields of a text line are left in the message
+func DecodeLogLine(line string) (*LogRecord, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "{") {
+		return decodeJsonLog(line)
+	}
+
+	return decodeTextLog(line)
+}
+
+// decodeTextLog parse: [time] [ tag ] [LEVEL] msg key=value ... (file:line)
+func decodeTextLog(line string) (*LogRecord, error) {
+	timeLen := len(LOG_TEXT_TIME_LAYOUT) + 2
+	if len(line) < timeLen || line[0] != '[' || line[timeLen-1] != ']' {
+		return nil, ErrLogFormat
+	}
+
+	t, err := time.ParseInLocation(LOG_TEXT_TIME_LAYOUT, line[1:timeLen-1], time.Local)
+	if err != nil {
+		return nil, ErrLogFormat
+	}
+
+	rest := line[timeLen:]
+	if !strings.HasPrefix(rest, " [ ") {
+		return nil, ErrLogFormat
+	}
+
+	end := strings.Index(rest, " ] ")
+	if end < 0 {
+		return nil, ErrLogFormat
+	}
+
+	r := &LogRecord{
+		Time: t,
+		Tag:  rest[3:end],
+	}
+
+	rest = rest[end+3:]
+	found := false
+	for lv, mark := range mapLogLvMark {
+		if strings.HasPrefix(rest, mark) {
+			r.Level = lv
+			rest = strings.TrimPrefix(rest[len(mark):], " ")
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil, ErrLogFormat
+	}
+
+	// the caller is the last part in the brackets
+	if strings.HasSuffix(rest, ")") {
+		start := strings.LastIndex(rest, " (")
+		if start >= 0 {
+			file, line, ok := splitCaller(rest[start+2 : len(rest)-1])
+			if ok {
+				r.File = file
+				r.Line = line
+				rest = rest[:start]
+			}
+		}
+	}
+
+	r.Msg = rest
+	return r, nil
+}
+
+func decodeJsonLog(line string) (*LogRecord, error) {
+	obj := make(map[string]interface{})
+	err := json.Unmarshal([]byte(line), &obj)
+	if err != nil {
+		return nil, ErrLogFormat
+	}
+
+	timeStr, _ := obj["time"].(string)
+	t, err := time.Parse(LOG_JSON_TIME_FORMAT, timeStr)
+	if err != nil {
+		return nil, ErrLogFormat
+	}
+
+	lvName, _ := obj["level"].(string)
+	lv, err := ParseLogLv(lvName)
+	if err != nil {
+		return nil, ErrLogFormat
+	}
+
+	r := &LogRecord{
+		Time:   t,
+		Level:  lv,
+		Fields: make([]Field, 0),
+	}
+
+	r.Tag, _ = obj["tag"].(string)
+	r.Msg, _ = obj["msg"].(string)
+	caller, _ := obj["caller"].(string)
+	r.File, r.Line, _ = splitCaller(caller)
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		switch k {
+		case "time", "level", "tag", "msg", "caller":
+		default:
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		r.Fields = append(r.Fields, FieldAny(k, obj[k]))
+	}
+
+	return r, nil
+}
+
+func splitCaller(caller string) (string, int, bool) {
+	idx := strings.LastIndex(caller, ":")
+	if idx <= 0 {
+		return "", 0, false
+	}
+
+	line, err := strconv.Atoi(caller[idx+1:])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return caller[:idx], line, true
+}
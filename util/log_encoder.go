@@ -0,0 +1,132 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_TIME_FORMAT      = "[%s/%s/%s %s:%s:%s]"
+	LOG_JSON_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// LogRecord is one log line before encoding
+type LogRecord struct {
+	Time   time.Time
+	Level  LogLv
+	Tag    string
+	Msg    string
+	Fields []Field
+	File   string // empty if the caller is not recorded
+	Line   int
+
+	flushEvt chan bool // not a log, but a flush request to the dump goroutine
+}
+
+type LogEncoder interface {
+	Encode(r *LogRecord) []byte
+}
+
+var mapLogLvMark = map[LogLv]string{
+	LOG_LV_DEBUG: "[DEBUG]",
+	LOG_LV_INFO:  "[INFO ]",
+	LOG_LV_WARN:  "[WARN ]",
+	LOG_LV_ERROR: "[ERROR]",
+}
+
+// TextEncoder write: [time] [ tag ] [LEVEL] msg key=value ... (file:line)
+type TextEncoder struct {
+}
+
+func (e *TextEncoder) Encode(r *LogRecord) []byte {
+	var buff bytes.Buffer
+	buff.WriteString(FormatFullTime(r.Time, LOG_TIME_FORMAT))
+	buff.WriteString(" [ ")
+	buff.WriteString(r.Tag)
+	buff.WriteString(" ] ")
+	buff.WriteString(mapLogLvMark[r.Level])
+	buff.WriteString(" ")
+	buff.WriteString(r.Msg)
+
+	for _, f := range r.Fields {
+		buff.WriteString(" ")
+		buff.WriteString(f.Key)
+		buff.WriteString("=")
+		buff.WriteString(formatTextValue(f.Value))
+	}
+
+	if r.File != "" {
+		buff.WriteString(" (")
+		buff.WriteString(path.Base(r.File))
+		buff.WriteString(":")
+		buff.WriteString(strconv.Itoa(r.Line))
+		buff.WriteString(")")
+	}
+
+	buff.WriteString("\n")
+	return buff.Bytes()
+}
+
+func formatTextValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// JsonEncoder write a json object per line with the keys:
+// time, level, tag, msg, caller and the fields
+type JsonEncoder struct {
+}
+
+func (e *JsonEncoder) Encode(r *LogRecord) []byte {
+	var buff bytes.Buffer
+	buff.WriteString("{\"time\":")
+	writeJsonValue(&buff, r.Time.Format(LOG_JSON_TIME_FORMAT))
+	buff.WriteString(",\"level\":")
+	writeJsonValue(&buff, r.Level.String())
+	buff.WriteString(",\"tag\":")
+	writeJsonValue(&buff, r.Tag)
+	buff.WriteString(",\"msg\":")
+	writeJsonValue(&buff, r.Msg)
+
+	if r.File != "" {
+		buff.WriteString(",\"caller\":")
+		writeJsonValue(&buff, path.Base(r.File)+":"+strconv.Itoa(r.Line))
+	}
+
+	for _, f := range r.Fields {
+		buff.WriteString(",")
+		writeJsonValue(&buff, f.Key)
+		buff.WriteString(":")
+		writeJsonValue(&buff, f.Value)
+	}
+
+	buff.WriteString("}\n")
+	return buff.Bytes()
+}
+
+func writeJsonValue(buff *bytes.Buffer, v interface{}) {
+	switch val := v.(type) {
+	case error:
+		v = val.Error()
+	case time.Duration:
+		v = val.String()
+	case fmt.Stringer:
+		v = val.String()
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+
+	buff.Write(data)
+}
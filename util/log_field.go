@@ -0,0 +1,133 @@
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// Field is a typed key value pair of a structured log
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func FieldStr(key string, val string) Field {
+	return Field{Key: key, Value: val}
+}
+
+func FieldInt(key string, val int) Field {
+	return Field{Key: key, Value: val}
+}
+
+func FieldInt64(key string, val int64) Field {
+	return Field{Key: key, Value: val}
+}
+
+func FieldUint64(key string, val uint64) Field {
+	return Field{Key: key, Value: val}
+}
+
+func FieldFloat(key string, val float64) Field {
+	return Field{Key: key, Value: val}
+}
+
+func FieldBool(key string, val bool) Field {
+	return Field{Key: key, Value: val}
+}
+
+func FieldDur(key string, val time.Duration) Field {
+	return Field{Key: key, Value: val}
+}
+
+// FieldErr use the key "error", a nil error is kept as nil
+func FieldErr(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+func FieldAny(key string, val interface{}) Field {
+	return Field{Key: key, Value: val}
+}
+
+// makeFields turn the arguments of With into fields,
+// an argument is either a Field or a key followed by its value
+func makeFields(kvs []interface{}) []Field {
+	fields := make([]Field, 0, len(kvs))
+	for i := 0; i < len(kvs); i++ {
+		if f, ok := kvs[i].(Field); ok {
+			fields = append(fields, f)
+			continue
+		}
+
+		key := fmt.Sprint(kvs[i])
+		if i+1 < len(kvs) {
+			fields = append(fields, Field{Key: key, Value: kvs[i+1]})
+			i++
+		} else {
+			fields = append(fields, Field{Key: key, Value: nil})
+		}
+	}
+
+	return fields
+}
+
+// logEntry is a logger carrying fields
+type logEntry struct {
+	l      *logger
+	fields []Field
+}
+
+// With get a logger putting the fields in every line,
+// the arguments are Fields or key value pairs
+func (l *logger) With(kvs ...interface{}) *logEntry {
+	return &logEntry{
+		l:      l,
+		fields: makeFields(kvs),
+	}
+}
+
+// WithTrace get a logger putting the trace id and the span id in every line
+func (l *logger) WithTrace(traceId uint64, spanId uint64) *logEntry {
+	return l.With(FieldStr("trace", fmt.Sprintf("%016x", traceId)), FieldStr("span", fmt.Sprintf("%016x", spanId)))
+}
+
+func (e *logEntry) With(kvs ...interface{}) *logEntry {
+	fields := make([]Field, 0, len(e.fields)+len(kvs))
+	fields = append(fields, e.fields...)
+	fields = append(fields, makeFields(kvs)...)
+	return &logEntry{
+		l:      e.l,
+		fields: fields,
+	}
+}
+
+func (e *logEntry) D(tag string, a ...interface{}) {
+	if !e.l.IsEnabled(LOG_LV_DEBUG, tag) {
+		return
+	}
+
+	e.l.doLog(LOG_LV_DEBUG, tag, e.fields, a...)
+}
+
+func (e *logEntry) I(tag string, a ...interface{}) {
+	if !e.l.IsEnabled(LOG_LV_INFO, tag) {
+		return
+	}
+
+	e.l.doLog(LOG_LV_INFO, tag, e.fields, a...)
+}
+
+func (e *logEntry) W(tag string, a ...interface{}) {
+	if !e.l.IsEnabled(LOG_LV_WARN, tag) {
+		return
+	}
+
+	e.l.doLog(LOG_LV_WARN, tag, e.fields, a...)
+}
+
+func (e *logEntry) E(tag string, a ...interface{}) {
+	if !e.l.IsEnabled(LOG_LV_ERROR, tag) {
+		return
+	}
+
+	e.l.doLog(LOG_LV_ERROR, tag, e.fields, a...)
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ILogger is the logger the modules write to, so the app can plug in its own one.
+// Logger is the default, and a logger made by With fits too
+type ILogger interface {
+	D(tag string, a ...interface{})
+	I(tag string, a ...interface{})
+	W(tag string, a ...interface{})
+	E(tag string, a ...interface{})
+}
+
+// LoggerWith get a logger putting the fields in every line of l, the arguments are
+// Fields or key value pairs. The built-in logger keeps them as structured fields,
+// the others get them appended to the message as k=v
+func LoggerWith(l ILogger, kvs ...interface{}) ILogger {
+	switch v := l.(type) {
+	case *logger:
+		return v.With(kvs...)
+
+	case *logEntry:
+		return v.With(kvs...)
+
+	case *fieldLogger:
+		fields := make([]Field, 0, len(v.fields)+len(kvs))
+		fields = append(fields, v.fields...)
+		fields = append(fields, makeFields(kvs)...)
+		return newFieldLogger(v.l, fields)
+	}
+
+	return newFieldLogger(l, makeFields(kvs))
+}
+
+// LoggerWithTrace get a logger putting the trace id and the span id in every line of l
+func LoggerWithTrace(l ILogger, traceId uint64, spanId uint64) ILogger {
+	return LoggerWith(l, FieldStr("trace", fmt.Sprintf("%016x", traceId)), FieldStr("span", fmt.Sprintf("%016x", spanId)))
+}
+
+// fieldLogger add the fields to the message of a plugged in logger
+type fieldLogger struct {
+	l      ILogger
+	fields []Field
+	suffix string
+}
+
+func newFieldLogger(l ILogger, fields []Field) *fieldLogger {
+	var sb strings.Builder
+	for _, f := range fields {
+		sb.WriteString(" ")
+		sb.WriteString(f.Key)
+		sb.WriteString("=")
+		sb.WriteString(formatTextValue(f.Value))
+	}
+
+	return &fieldLogger{
+		l:      l,
+		fields: fields,
+		suffix: sb.String(),
+	}
+}
+
+func (f *fieldLogger) D(tag string, a ...interface{}) {
+	f.l.D(tag, append(a, f.suffix)...)
+}
+
+func (f *fieldLogger) I(tag string, a ...interface{}) {
+	f.l.I(tag, append(a, f.suffix)...)
+}
+
+func (f *fieldLogger) W(tag string, a ...interface{}) {
+	f.l.W(tag, append(a, f.suffix)...)
+}
+
+func (f *fieldLogger) E(tag string, a ...interface{}) {
+	f.l.E(tag, append(a, f.suffix)...)
+}
@@ -0,0 +1,265 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+const LOG_TAG_LOG = "Logger"
+
+// the cached level of the tags matching no pattern
+const tagLevelNone LogLv = -1
+
+type tagLevelRule struct {
+	pattern string
+	level   LogLv
+}
+
+// tagLevelTable is never changed after being stored, a change makes a new table
+type tagLevelTable struct {
+	rules []tagLevelRule
+	cache sync.Map
+}
+
+// getLevel the exact pattern wins, then the longest matching one
+func (t *tagLevelTable) getLevel(tag string) LogLv {
+	v, ok := t.cache.Load(tag)
+	if ok {
+		return v.(LogLv)
+	}
+
+	lv := tagLevelNone
+	matchLen := -1
+	for _, rule := range t.rules {
+		if rule.pattern == tag {
+			lv = rule.level
+			break
+		}
+
+		ok, _ := path.Match(rule.pattern, tag)
+		if ok && len(rule.pattern) > matchLen {
+			lv = rule.level
+			matchLen = len(rule.pattern)
+		}
+	}
+
+	t.cache.Store(tag, lv)
+	return lv
+}
+
+// LogLevelConfig the content of the level config file, for example:
+//
+//	{"level": "info", "tags": {"Sock*": "debug", "Server": "warn"}}
+type LogLevelConfig struct {
+	Level string            `json:"level"`
+	Tags  map[string]string `json:"tags"`
+}
+
+// IsEnabled check if the log of the tag at the level will be written.
+// It costs an atomic load and a compare when there is no tag level
+func (l *logger) IsEnabled(lv LogLv, tag string) bool {
+	t, _ := l.tagLevels.Load().(*tagLevelTable)
+	if t != nil {
+		tagLv := t.getLevel(tag)
+		if tagLv != tagLevelNone {
+			return lv >= tagLv
+		}
+	}
+
+	return lv >= l.GetLevel()
+}
+
+// GetTagLevel get the level used by the tag
+func (l *logger) GetTagLevel(tag string) LogLv {
+	t, _ := l.tagLevels.Load().(*tagLevelTable)
+	if t != nil {
+		tagLv := t.getLevel(tag)
+		if tagLv != tagLevelNone {
+			return tagLv
+		}
+	}
+
+	return l.GetLevel()
+}
+
+// SetTagLevel set the level of the tags matching the glob pattern, such as "Sock*".
+// An exact tag wins over the patterns, then the longest pattern wins
+func (l *logger) SetTagLevel(pattern string, lv LogLv) error {
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return err
+	}
+
+	l.lckTagLevel.Lock()
+	defer l.lckTagLevel.Unlock()
+
+	rules := make([]tagLevelRule, 0)
+	for _, rule := range l.getTagRules() {
+		if rule.pattern != pattern {
+			rules = append(rules, rule)
+		}
+	}
+
+	rules = append(rules, tagLevelRule{pattern: pattern, level: lv})
+	l.storeTagRules(rules)
+	return nil
+}
+
+// RemoveTagLevel the tags matching the pattern go back to the logger level
+func (l *logger) RemoveTagLevel(pattern string) {
+	l.lckTagLevel.Lock()
+	defer l.lckTagLevel.Unlock()
+
+	rules := make([]tagLevelRule, 0)
+	for _, rule := range l.getTagRules() {
+		if rule.pattern != pattern {
+			rules = append(rules, rule)
+		}
+	}
+
+	l.storeTagRules(rules)
+}
+
+// ClearTagLevels all the tags use the logger level
+func (l *logger) ClearTagLevels() {
+	l.lckTagLevel.Lock()
+	defer l.lckTagLevel.Unlock()
+
+	l.storeTagRules(nil)
+}
+
+// GetTagLevels get the level of every pattern
+func (l *logger) GetTagLevels() map[string]LogLv {
+	levels := make(map[string]LogLv)
+	for _, rule := range l.getTagRules() {
+		levels[rule.pattern] = rule.level
+	}
+
+	return levels
+}
+
+// GetTagPatterns get the patterns in order
+func (l *logger) GetTagPatterns() []string {
+	patterns := make([]string, 0)
+	for _, rule := range l.getTagRules() {
+		patterns = append(patterns, rule.pattern)
+	}
+
+	sort.Strings(patterns)
+	return patterns
+}
+
+// ApplyLevelConfig replace the logger level and all the tag levels
+func (l *logger) ApplyLevelConfig(cfg *LogLevelConfig) error {
+	rules := make([]tagLevelRule, 0, len(cfg.Tags))
+	for pattern, name := range cfg.Tags {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return errors.New("bad tag pattern " + pattern + ": " + err.Error())
+		}
+
+		lv, err := ParseLogLv(name)
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, tagLevelRule{pattern: pattern, level: lv})
+	}
+
+	if cfg.Level != "" {
+		lv, err := ParseLogLv(cfg.Level)
+		if err != nil {
+			return err
+		}
+
+		l.SetLevel(lv)
+	}
+
+	l.lckTagLevel.Lock()
+	defer l.lckTagLevel.Unlock()
+
+	l.storeTagRules(rules)
+	return nil
+}
+
+// LoadLevelConfig read the json level config file, and apply it
+func (l *logger) LoadLevelConfig(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	cfg := &LogLevelConfig{}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return err
+	}
+
+	return l.ApplyLevelConfig(cfg)
+}
+
+// WatchLevelConfig load the level config file again when one of the signals comes,
+// SIGHUP by default
+func (l *logger) WatchLevelConfig(file string, sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+
+	l.StopWatchLevelConfig()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+
+	l.lckTagLevel.Lock()
+	l.levelSigChan = ch
+	l.lckTagLevel.Unlock()
+
+	go func() {
+		for range ch {
+			err := l.LoadLevelConfig(file)
+			if err != nil {
+				l.E(LOG_TAG_LOG, "reload level config ", file, " err: ", err)
+			} else {
+				l.I(LOG_TAG_LOG, "reload level config ", file)
+			}
+		}
+	}()
+}
+
+// StopWatchLevelConfig stop watching the signals
+func (l *logger) StopWatchLevelConfig() {
+	l.lckTagLevel.Lock()
+	ch := l.levelSigChan
+	l.levelSigChan = nil
+	l.lckTagLevel.Unlock()
+
+	if ch != nil {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
+
+func (l *logger) getTagRules() []tagLevelRule {
+	t, _ := l.tagLevels.Load().(*tagLevelTable)
+	if t == nil {
+		return nil
+	}
+
+	return t.rules
+}
+
+func (l *logger) storeTagRules(rules []tagLevelRule) {
+	if len(rules) == 0 {
+		l.tagLevels.Store((*tagLevelTable)(nil))
+		return
+	}
+
+	l.tagLevels.Store(&tagLevelTable{rules: rules})
+}
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LOG_QUEUE_SIZE       = 1024
+	LOG_DROP_REPORT_INTV = 10 * time.Second
+)
+
+// LogQueuePolicy decides what happens to a log pushed into the full queue of the dump goroutine
+type LogQueuePolicy int
+
+const (
+	LOG_QUEUE_POLICY_BLOCK       LogQueuePolicy = 0 // wait until the queue has room
+	LOG_QUEUE_POLICY_DROP_NEWEST LogQueuePolicy = 1 // drop the new log
+	LOG_QUEUE_POLICY_DROP_DEBUG  LogQueuePolicy = 2 // drop the debug logs once the queue is 3/4 full, the others when it is full
+)
+
+var ErrLogDumpOpen error = errors.New("log dump is open")
+
+// SetQueue set the size and the overflow policy of the log queue, it must be set before StartDump
+func (l *logger) SetQueue(size int, policy LogQueuePolicy) error {
+	if l.isDumpOpen() {
+		return ErrLogDumpOpen
+	}
+
+	if size <= 0 {
+		size = LOG_QUEUE_SIZE
+	}
+
+	l.logs = make(chan *LogRecord, size)
+	l.queuePolicy = policy
+	return nil
+}
+
+// SetDropReportIntv how often the number of the dropped logs is written as a warning,
+// it must be set before StartDump, <= 0 to turn it off
+func (l *logger) SetDropReportIntv(intv time.Duration) {
+	l.reportIntv = intv
+}
+
+// GetDropped get the number of the dropped logs, and how many of them are debug ones
+func (l *logger) GetDropped() (uint64, uint64) {
+	return atomic.LoadUint64(&l.dropped), atomic.LoadUint64(&l.droppedDebug)
+}
+
+// Flush wait until the queued logs are written, then flush all the sinks.
+// It returns when the dump stops meanwhile, the logs are written by StopDump then
+func (l *logger) Flush() {
+	if !l.isDumpOpen() {
+		l.flushSinks()
+		return
+	}
+
+	exitEvt := l.getDumpExitEvt()
+	r := &LogRecord{flushEvt: make(chan bool)}
+	select {
+	case l.logs <- r:
+	case <-exitEvt:
+		l.flushSinks()
+		return
+	}
+
+	select {
+	case <-r.flushEvt:
+	case <-exitEvt:
+	}
+}
+
+// Sync same as Flush
+func (l *logger) Sync() error {
+	l.Flush()
+	return nil
+}
+
+func (l *logger) enqueue(r *LogRecord) {
+	switch l.queuePolicy {
+	case LOG_QUEUE_POLICY_DROP_NEWEST:
+		select {
+		case l.logs <- r:
+		default:
+			l.drop(r)
+		}
+
+	case LOG_QUEUE_POLICY_DROP_DEBUG:
+		if r.Level == LOG_LV_DEBUG && len(l.logs) >= cap(l.logs)*3/4 {
+			l.drop(r)
+			return
+		}
+
+		select {
+		case l.logs <- r:
+		default:
+			l.drop(r)
+		}
+
+	default:
+		// the dump may stop while waiting, the log is written directly then
+		select {
+		case l.logs <- r:
+		case <-l.getDumpExitEvt():
+			l.writeSinks(r)
+		}
+	}
+}
+
+func (l *logger) drop(r *LogRecord) {
+	atomic.AddUint64(&l.dropped, 1)
+	if r.Level == LOG_LV_DEBUG {
+		atomic.AddUint64(&l.droppedDebug, 1)
+	}
+}
+
+// writeRecord write a log or handle a flush request
+func (l *logger) writeRecord(r *LogRecord) {
+	if r.flushEvt != nil {
+		l.flushSinks()
+		close(r.flushEvt)
+		return
+	}
+
+	l.writeSinks(r)
+}
+
+// reportDropped write a warning if more logs are dropped since the last report
+func (l *logger) reportDropped(lastDropped uint64, lastDroppedDebug uint64) (uint64, uint64) {
+	dropped, droppedDebug := l.GetDropped()
+	if dropped == lastDropped {
+		return dropped, droppedDebug
+	}
+
+	n := dropped - lastDropped
+	nDebug := droppedDebug - lastDroppedDebug
+	l.writeSinks(&LogRecord{
+		Time:  l.getClock().Now(),
+		Level: LOG_LV_WARN,
+		Tag:   LOG_TAG_LOG,
+		Msg:   fmt.Sprint("log queue full, dropped ", n, " logs, ", nDebug, " of them debug"),
+		Fields: []Field{
+			FieldUint64("dropped", n),
+			FieldUint64("dropped_debug", nDebug),
+			FieldUint64("dropped_total", dropped),
+		},
+	})
+
+	return dropped, droppedDebug
+}
@@ -0,0 +1,733 @@
+package util
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_SINK_CONSOLE = "console"
+	LOG_SINK_DUMP    = "dump"
+	LOG_SINK_RING    = "ring"
+)
+
+// LogSink receive the encoded lines of the levels it accepts
+type LogSink interface {
+	Write(lv LogLv, log []byte) error
+	Flush() error
+	Close() error
+}
+
+// LogRecordSink is an optional interface of LogSink,
+// it is written with the record of the line, to use the record time or fields
+type LogRecordSink interface {
+	WriteRecord(r *LogRecord, log []byte) error
+}
+
+type logSinkEntry struct {
+	name    string
+	sink    LogSink
+	level   LogLv
+	encoder LogEncoder // nil to use the default encoder of the logger
+}
+
+func newLogSinkEntry(name string, sink LogSink, lv LogLv, enc LogEncoder) *logSinkEntry {
+	return &logSinkEntry{
+		name:    name,
+		sink:    sink,
+		level:   lv,
+		encoder: enc,
+	}
+}
+
+// AddSink send the logs at or above the level to the sink, a nil encoder uses the default one.
+// The sink with the same name is closed and replaced
+func (l *logger) AddSink(name string, sink LogSink, lv LogLv, enc LogEncoder) {
+	entry := newLogSinkEntry(name, sink, lv, enc)
+
+	l.lckSink.Lock()
+	defer l.lckSink.Unlock()
+
+	for i, e := range l.sinks {
+		if e.name == name {
+			e.sink.Close()
+			l.sinks[i] = entry
+			return
+		}
+	}
+
+	l.sinks = append(l.sinks, entry)
+}
+
+// RemoveSink close and remove the sink
+func (l *logger) RemoveSink(name string) {
+	l.lckSink.Lock()
+	defer l.lckSink.Unlock()
+
+	for i, e := range l.sinks {
+		if e.name == name {
+			e.sink.Flush()
+			e.sink.Close()
+			l.sinks = append(l.sinks[:i], l.sinks[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *logger) GetSink(name string) LogSink {
+	l.lckSink.RLock()
+	defer l.lckSink.RUnlock()
+
+	for _, e := range l.sinks {
+		if e.name == name {
+			return e.sink
+		}
+	}
+
+	return nil
+}
+
+func (l *logger) SetSinkLevel(name string, lv LogLv) error {
+	l.lckSink.Lock()
+	defer l.lckSink.Unlock()
+
+	for _, e := range l.sinks {
+		if e.name == name {
+			e.level = lv
+			return nil
+		}
+	}
+
+	return errors.New("sink not found: " + name)
+}
+
+// writeSinks encode the record once for each encoder and fan it out
+func (l *logger) writeSinks(r *LogRecord) {
+	l.lckSink.RLock()
+	defer l.lckSink.RUnlock()
+
+	var lastEnc LogEncoder = nil
+	var lastLog []byte = nil
+	for _, e := range l.sinks {
+		if r.Level < e.level {
+			continue
+		}
+
+		enc := e.encoder
+		if enc == nil {
+			enc = l.encoder
+		}
+
+		if enc != lastEnc {
+			lastEnc = enc
+			lastLog = enc.Encode(r)
+		}
+
+		var err error = nil
+		if rs, ok := e.sink.(LogRecordSink); ok {
+			err = rs.WriteRecord(r, lastLog)
+		} else {
+			err = e.sink.Write(r.Level, lastLog)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "write log sink", e.name, "error:", err)
+		}
+	}
+}
+
+func (l *logger) flushSinks() {
+	l.lckSink.RLock()
+	defer l.lckSink.RUnlock()
+
+	for _, e := range l.sinks {
+		e.sink.Flush()
+	}
+}
+
+// ConsoleSink write to stdout, stderr or any writer
+type ConsoleSink struct {
+	lck sync.Mutex
+	w   io.Writer
+}
+
+func NewConsoleSink(w io.Writer) *ConsoleSink {
+	return &ConsoleSink{
+		w: w,
+	}
+}
+
+func (s *ConsoleSink) Write(lv LogLv, log []byte) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	_, err := s.w.Write(log)
+	return err
+}
+
+func (s *ConsoleSink) Flush() error {
+	return nil
+}
+
+func (s *ConsoleSink) Close() error {
+	return nil
+}
+
+// LogRotatePeriod rotate the file at the start of every calendar period
+type LogRotatePeriod int
+
+const (
+	LOG_ROTATE_NONE   LogRotatePeriod = 0
+	LOG_ROTATE_HOURLY LogRotatePeriod = 1
+	LOG_ROTATE_DAILY  LogRotatePeriod = 2
+)
+
+// FileSink append to a file with a stable name, and rename it to name_YYYYMMDD_HHMMSS.ext
+// when it reaches maxSize or a new period begins.
+// The rotated files can be gzipped and pruned in the background
+type FileSink struct {
+	lck       sync.Mutex
+	file      string
+	maxSize   int
+	period    LogRotatePeriod
+	maxFiles  int
+	maxBytes  int64
+	compress  bool
+	f         *os.File
+	size      int
+	periodEnd time.Time
+	clock     Clock
+	wgBg      sync.WaitGroup
+	lckBg     sync.Mutex
+}
+
+// NewFileSink create a file sink, a maxSize <= 0 never rotates by size
+func NewFileSink(file string, maxSize int) *FileSink {
+	return &FileSink{
+		file:     file,
+		maxSize:  maxSize,
+		period:   LOG_ROTATE_NONE,
+		maxFiles: 0,
+		maxBytes: 0,
+		compress: false,
+		f:        nil,
+		size:     0,
+		clock:    nil,
+	}
+}
+
+// SetPeriod rotate the file hourly or daily as well
+func (s *FileSink) SetPeriod(period LogRotatePeriod) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.period = period
+	s.periodEnd = s.getPeriodEnd(s.getClock().Now())
+}
+
+// SetClock set the clock of the periods and the rotated names, the clock set by SetClock of the package by default
+func (s *FileSink) SetClock(c Clock) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.clock = c
+	s.periodEnd = s.getPeriodEnd(s.getClock().Now())
+}
+
+// SetRetention keep at most maxFiles rotated files of at most maxBytes in total,
+// the oldest ones are removed first, a limit <= 0 means unlimited
+func (s *FileSink) SetRetention(maxFiles int, maxBytes int64) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.maxFiles = maxFiles
+	s.maxBytes = maxBytes
+}
+
+// SetCompress gzip the rotated files in the background
+func (s *FileSink) SetCompress(compress bool) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.compress = compress
+}
+
+func (s *FileSink) Write(lv LogLv, log []byte) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if s.period != LOG_ROTATE_NONE && s.f != nil && !s.getClock().Now().Before(s.periodEnd) {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.f == nil {
+		err := s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(log)
+	s.size += n
+	if err != nil {
+		return err
+	}
+
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		return s.rotate()
+	}
+
+	return nil
+}
+
+func (s *FileSink) Flush() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+
+	return s.f.Sync()
+}
+
+// Close close the file and wait for the background compression
+func (s *FileSink) Close() error {
+	s.lck.Lock()
+	var err error = nil
+	if s.f != nil {
+		err = s.f.Close()
+		s.f = nil
+	}
+	s.lck.Unlock()
+
+	s.wgBg.Wait()
+	return err
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	fs, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.size = int(fs.Size())
+
+	// the file left by the last run belongs to an older period
+	now := s.getClock().Now()
+	s.periodEnd = s.getPeriodEnd(now)
+	if s.period != LOG_ROTATE_NONE && s.size > 0 && s.getPeriodEnd(fs.ModTime()).Before(s.periodEnd) {
+		return s.rotate()
+	}
+
+	return nil
+}
+
+func (s *FileSink) getClock() Clock {
+	if s.clock != nil {
+		return s.clock
+	}
+
+	return GetClock()
+}
+
+func (s *FileSink) getPeriodEnd(t time.Time) time.Time {
+	switch s.period {
+	case LOG_ROTATE_HOURLY:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+	case LOG_ROTATE_DAILY:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	}
+
+	return time.Time{}
+}
+
+func (s *FileSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+
+	newName, err := renameDumpFile(s.file, s.getClock().Now())
+	if err != nil {
+		return err
+	}
+
+	if s.compress || s.maxFiles > 0 || s.maxBytes > 0 {
+		s.wgBg.Add(1)
+		go s.afterRotate(newName, s.compress, s.maxFiles, s.maxBytes)
+	}
+
+	return nil
+}
+
+// afterRotate compress the rotated file and prune the old ones
+func (s *FileSink) afterRotate(rotated string, compress bool, maxFiles int, maxBytes int64) {
+	defer s.wgBg.Done()
+
+	s.lckBg.Lock()
+	defer s.lckBg.Unlock()
+
+	if compress {
+		err := GzipFile(rotated)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "compress log file", rotated, "error:", err)
+		}
+	}
+
+	if maxFiles > 0 || maxBytes > 0 {
+		err := pruneDumpFiles(s.file, maxFiles, maxBytes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "prune log files error:", err)
+		}
+	}
+}
+
+// renameDumpFile rename the file to name_YYYYMMDD_HHMMSS.ext by the time now,
+// a number is appended if the name is taken
+func renameDumpFile(file string, now time.Time) (string, error) {
+	dir := path.Dir(file)
+	name := path.Base(file)
+	ext := path.Ext(name)
+	nameOnly := strings.TrimSuffix(name, ext)
+	timeStr := FormatFullTime(now, "_%s%s%s_%s%s%s")
+	newName := path.Join(dir, nameOnly+timeStr+ext)
+	for i := 1; isFileExist(newName) || isFileExist(newName+".gz"); i++ {
+		newName = path.Join(dir, nameOnly+timeStr+"_"+strconv.Itoa(i)+ext)
+	}
+
+	return newName, os.Rename(file, newName)
+}
+
+// GetDumpFiles get the rotated files of the dump file, from the oldest to the newest.
+// Only the names made by the rotation match, name_YYYYMMDD_HHMMSS[_N].ext[.gz],
+// so the sibling logs like name_access.ext are left alone
+func GetDumpFiles(file string) ([]string, error) {
+	dir := path.Dir(file)
+	name := path.Base(file)
+	ext := path.Ext(name)
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(strings.TrimSuffix(name, ext)) +
+		`_(\d{8}_\d{6})(?:_(\d+))?` + regexp.QuoteMeta(ext) + `(?:\.gz)?$`)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type dumpFile struct {
+		path    string
+		timeStr string
+		no      int
+	}
+
+	dumps := make([]dumpFile, 0)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		m := re.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+
+		no, _ := strconv.Atoi(m[2])
+		dumps = append(dumps, dumpFile{
+			path:    path.Join(dir, e.Name()),
+			timeStr: m[1],
+			no:      no,
+		})
+	}
+
+	// the names begin with the rotating time, so they sort by time
+	sort.Slice(dumps, func(i, j int) bool {
+		if dumps[i].timeStr != dumps[j].timeStr {
+			return dumps[i].timeStr < dumps[j].timeStr
+		}
+
+		return dumps[i].no < dumps[j].no
+	})
+
+	files := make([]string, 0, len(dumps))
+	for _, d := range dumps {
+		files = append(files, d.path)
+	}
+
+	return files, nil
+}
+
+func pruneDumpFiles(file string, maxFiles int, maxBytes int64) error {
+	files, err := GetDumpFiles(file)
+	if err != nil {
+		return err
+	}
+
+	var total int64 = 0
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		fs, err := os.Stat(f)
+		if err == nil {
+			sizes[i] = fs.Size()
+			total += fs.Size()
+		}
+	}
+
+	for i := 0; i < len(files); i++ {
+		cnt := len(files) - i
+		if (maxFiles <= 0 || cnt <= maxFiles) && (maxBytes <= 0 || total <= maxBytes) {
+			break
+		}
+
+		err = os.Remove(files[i])
+		if err != nil {
+			return err
+		}
+
+		total -= sizes[i]
+	}
+
+	return nil
+}
+
+// GzipFile compress the file to file.gz and remove it
+func GzipFile(file string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpName := file + ".gz.tmp"
+	dst, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(dst)
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	err = os.Rename(tmpName, file+".gz")
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(file)
+}
+
+func isFileExist(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// SyslogSink send RFC 3164 messages to the local syslog over a unix socket,
+// the messages on a stream socket are framed by octet counting (RFC 6587)
+type SyslogSink struct {
+	lck    sync.Mutex
+	addr   string
+	tag    string
+	conn   net.Conn
+	stream bool
+}
+
+var mapLogLvSeverity = map[LogLv]int{
+	LOG_LV_DEBUG: 7,
+	LOG_LV_INFO:  6,
+	LOG_LV_WARN:  4,
+	LOG_LV_ERROR: 3,
+}
+
+// NewSyslogSink connect to the syslog socket, an empty addr tries /dev/log and /var/run/syslog
+func NewSyslogSink(addr string, tag string) (*SyslogSink, error) {
+	s := &SyslogSink{
+		addr:   addr,
+		tag:    tag,
+		conn:   nil,
+		stream: false,
+	}
+
+	err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Write send the line stamped with the time of the package clock,
+// the logger calls WriteRecord with the record time instead
+func (s *SyslogSink) Write(lv LogLv, log []byte) error {
+	return s.write(lv, GetClock().Now(), log)
+}
+
+func (s *SyslogSink) WriteRecord(r *LogRecord, log []byte) error {
+	return s.write(r.Level, r.Time, log)
+}
+
+func (s *SyslogSink) write(lv LogLv, t time.Time, log []byte) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	// facility user(1)
+	pri := 1*8 + mapLogLvSeverity[lv]
+	msg := fmt.Sprintf("<%d>%s %s[%d]: %s", pri, t.Format(time.Stamp), s.tag, os.Getpid(), strings.TrimRight(string(log), "\n"))
+
+	if s.conn == nil {
+		err := s.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.conn.Write(s.frame(msg))
+	if err != nil {
+		// reconnect once, the syslog daemon may have restarted
+		s.conn.Close()
+		s.conn = nil
+		err = s.connect()
+		if err == nil {
+			_, err = s.conn.Write(s.frame(msg))
+		}
+	}
+
+	return err
+}
+
+// frame prefix the length of the msg on a stream socket, where the msgs would run together
+func (s *SyslogSink) frame(msg string) []byte {
+	if !s.stream {
+		return []byte(msg)
+	}
+
+	return []byte(strconv.Itoa(len(msg)) + " " + msg)
+}
+
+func (s *SyslogSink) Flush() error {
+	return nil
+}
+
+func (s *SyslogSink) Close() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *SyslogSink) connect() error {
+	addrs := []string{s.addr}
+	if s.addr == "" {
+		addrs = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+	}
+
+	var err error = nil
+	for _, addr := range addrs {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			conn, err = net.Dial(network, addr)
+			if err == nil {
+				s.conn = conn
+				s.stream = network == "unix"
+				return nil
+			}
+		}
+	}
+
+	return err
+}
+
+// RingSink keep the last lines in memory
+type RingSink struct {
+	lck   sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func NewRingSink(size int) *RingSink {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &RingSink{
+		lines: make([]string, size),
+		next:  0,
+		full:  false,
+	}
+}
+
+func (s *RingSink) Write(lv LogLv, log []byte) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.lines[s.next] = string(log)
+	s.next++
+	if s.next == len(s.lines) {
+		s.next = 0
+		s.full = true
+	}
+
+	return nil
+}
+
+// Lines get the kept lines from the oldest to the newest
+func (s *RingSink) Lines() []string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	lines := make([]string, 0, len(s.lines))
+	if s.full {
+		lines = append(lines, s.lines[s.next:]...)
+	}
+
+	lines = append(lines, s.lines[:s.next]...)
+	return lines
+}
+
+func (s *RingSink) Flush() error {
+	return nil
+}
+
+func (s *RingSink) Close() error {
+	return nil
+}
@@ -1,11 +1,14 @@
 package util
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"os"
-	"path"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type LogLv int
@@ -18,170 +21,243 @@ const (
 )
 
 type logger struct {
-	level        LogLv
-	dumpOpen     bool
-	dumpFile     string
-	dumpFileSize int
-	logs         chan string
+	level        int32
+	dumpOpen     int32        // 1 while the dump goroutine writes the logs
+	dumpExitEvt  atomic.Value // chan bool, closed when the dump goroutine exits
+	logs         chan *LogRecord
 	stopDumpEvt  chan bool
 	stopSuccEvt  chan bool
+	encoder      LogEncoder
+	caller       bool
+	lckSink      sync.RWMutex
+	sinks        []*logSinkEntry
+	lckTagLevel  sync.Mutex
+	tagLevels    atomic.Value
+	levelSigChan chan os.Signal
+	queuePolicy  LogQueuePolicy
+	reportIntv   time.Duration
+	dropped      uint64
+	droppedDebug uint64
+	clock        atomic.Value // clockHolder, the clock of the package if not set
 }
 
 var Logger *logger = &logger{
-	level:        LOG_LV_DEBUG,
-	dumpOpen:     false,
-	dumpFile:     "",
-	dumpFileSize: 0,
-	logs:         make(chan string, 1024),
-	stopDumpEvt:  make(chan bool, 1),
-	stopSuccEvt:  make(chan bool),
+	level:       int32(LOG_LV_DEBUG),
+	dumpOpen:    0,
+	logs:        make(chan *LogRecord, LOG_QUEUE_SIZE),
+	stopDumpEvt: make(chan bool, 1),
+	stopSuccEvt: make(chan bool),
+	encoder:     &TextEncoder{},
+	caller:      true,
+	sinks: []*logSinkEntry{
+		newLogSinkEntry(LOG_SINK_CONSOLE, NewConsoleSink(os.Stdout), LOG_LV_DEBUG, nil),
+	},
+	queuePolicy:  LOG_QUEUE_POLICY_BLOCK,
+	reportIntv:   LOG_DROP_REPORT_INTV,
+	dropped:      0,
+	droppedDebug: 0,
+}
+
+var mapLogLvName = map[LogLv]string{
+	LOG_LV_DEBUG: "debug",
+	LOG_LV_INFO:  "info",
+	LOG_LV_WARN:  "warn",
+	LOG_LV_ERROR: "error",
+}
+
+// ParseLogLv get the level of the name: debug, info, warn or error
+func ParseLogLv(name string) (LogLv, error) {
+	for lv, lvName := range mapLogLvName {
+		if strings.EqualFold(name, lvName) {
+			return lv, nil
+		}
+	}
+
+	return LOG_LV_DEBUG, errors.New("unknown log level: " + name)
+}
+
+func (lv LogLv) String() string {
+	return mapLogLvName[lv]
 }
 
 func (l *logger) SetLevel(lv LogLv) {
-	l.level = lv
+	atomic.StoreInt32(&l.level, int32(lv))
+}
+
+func (l *logger) GetLevel() LogLv {
+	return LogLv(atomic.LoadInt32(&l.level))
 }
 
 func (l *logger) D(tag string, a ...interface{}) {
-	if l.level > LOG_LV_DEBUG {
+	if !l.IsEnabled(LOG_LV_DEBUG, tag) {
 		return
 	}
 
-	l.doLog(tag, "[DEBUG]", a...)
+	l.doLog(LOG_LV_DEBUG, tag, nil, a...)
 }
 
 func (l *logger) I(tag string, a ...interface{}) {
-	if l.level > LOG_LV_INFO {
+	if !l.IsEnabled(LOG_LV_INFO, tag) {
 		return
 	}
 
-	l.doLog(tag, "[INFO ]", a...)
+	l.doLog(LOG_LV_INFO, tag, nil, a...)
 }
 
 func (l *logger) W(tag string, a ...interface{}) {
-	if l.level > LOG_LV_WARN {
+	if !l.IsEnabled(LOG_LV_WARN, tag) {
 		return
 	}
 
-	l.doLog(tag, "[WARN ]", a...)
+	l.doLog(LOG_LV_WARN, tag, nil, a...)
 }
 
 func (l *logger) E(tag string, a ...interface{}) {
-	if l.level > LOG_LV_ERROR {
+	if !l.IsEnabled(LOG_LV_ERROR, tag) {
 		return
 	}
 
-	l.doLog(tag, "[ERROR]", a...)
+	l.doLog(LOG_LV_ERROR, tag, nil, a...)
 }
 
-func (l *logger) doLog(tag string, lv string, a ...interface{}) {
-	timeStr := GetFullTimeString("[%s/%s/%s %s:%s:%s]")
-	msg := fmt.Sprint(a...)
+// SetEncoder choose the default line format of the sinks, TextEncoder by default
+func (l *logger) SetEncoder(enc LogEncoder) {
+	l.lckSink.Lock()
+	defer l.lckSink.Unlock()
+
+	l.encoder = enc
+}
+
+// SetClock set the clock of the log time, the clock set by SetClock of the package by default
+func (l *logger) SetClock(c Clock) {
+	l.clock.Store(clockHolder{c: c})
+}
+
+func (l *logger) getClock() Clock {
+	h, ok := l.clock.Load().(clockHolder)
+	if ok && h.c != nil {
+		return h.c
+	}
+
+	return GetClock()
+}
+
+// SetCaller turn on or off the file and line of the caller
+func (l *logger) SetCaller(enable bool) {
+	l.lckSink.Lock()
+	defer l.lckSink.Unlock()
+
+	l.caller = enable
+}
+
+func (l *logger) isCaller() bool {
+	l.lckSink.RLock()
+	defer l.lckSink.RUnlock()
+
+	return l.caller
+}
 
-	if !l.dumpOpen {
-		fmt.Println(timeStr, "[", tag, "]", lv, msg)
+// doLog must be called by the exported log functions directly, to get the right caller
+func (l *logger) doLog(lv LogLv, tag string, fields []Field, a ...interface{}) {
+	r := &LogRecord{
+		Time:   l.getClock().Now(),
+		Level:  lv,
+		Tag:    tag,
+		Msg:    fmt.Sprint(a...),
+		Fields: fields,
+		File:   "",
+		Line:   0,
+	}
+
+	if l.isCaller() {
+		_, file, line, ok := runtime.Caller(2)
+		if ok {
+			r.File = file
+			r.Line = line
+		}
+	}
+
+	if !l.isDumpOpen() {
+		l.writeSinks(r)
 	} else {
-		log := fmt.Sprintln(timeStr, "[", tag, "]", lv, msg)
-		l.logs <- log
+		l.enqueue(r)
 	}
 }
 
+// StartDump write the logs only to the file from now on, the file is rotated by size.
+// The logs are written by a background goroutine
 func (l *logger) StartDump(file string, dumpFileSize int) {
-	l.dumpFile = file
-	l.dumpFileSize = dumpFileSize
-	l.dumpOpen = true
-	go l.dump()
+	l.StartDumpSink(NewFileSink(file, dumpFileSize))
+}
+
+// StartDumpSink same as StartDump, with a file sink set up for rotating by time,
+// retention and compression
+func (l *logger) StartDumpSink(sink *FileSink) {
+	l.RemoveSink(LOG_SINK_CONSOLE)
+	l.AddSink(LOG_SINK_DUMP, sink, LOG_LV_DEBUG, nil)
+	exitEvt := make(chan bool)
+	l.dumpExitEvt.Store(exitEvt)
+	atomic.StoreInt32(&l.dumpOpen, 1)
+	go l.dump(exitEvt)
 }
 
+// StopDump write all the logs left to the file, and go back to the console
 func (l *logger) StopDump() {
-	l.dumpOpen = false
+	atomic.StoreInt32(&l.dumpOpen, 0)
 	l.stopDumpEvt <- true
 	<-l.stopSuccEvt
-	l.dumpFile = ""
+	l.RemoveSink(LOG_SINK_DUMP)
+	l.AddSink(LOG_SINK_CONSOLE, NewConsoleSink(os.Stdout), LOG_LV_DEBUG, nil)
 }
 
-func (l *logger) dump() {
-	for {
-		bEnd, err := l.dumpToFile()
-		if err != nil {
-			fmt.Println("dump log to file error: ", err)
-		}
-
-		err = l.renameDumpFile()
-		if err != nil {
-			fmt.Println("rename dump file error: ", err)
-		}
+func (l *logger) isDumpOpen() bool {
+	return atomic.LoadInt32(&l.dumpOpen) == 1
+}
 
-		if bEnd {
-			l.stopSuccEvt <- true
-			break
-		}
-	}
+// getDumpExitEvt get the event closed when the dump goroutine exits
+func (l *logger) getDumpExitEvt() chan bool {
+	exitEvt, _ := l.dumpExitEvt.Load().(chan bool)
+	return exitEvt
 }
 
-func (l *logger) dumpToFile() (bool, error) {
-	f, err := os.OpenFile(l.dumpFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
-	if err != nil {
-		return true, err
+func (l *logger) dump(exitEvt chan bool) {
+	var reportChan <-chan time.Time = nil
+	if l.reportIntv > 0 {
+		ticker := l.getClock().NewTicker(l.reportIntv)
+		defer ticker.Stop()
+		reportChan = ticker.C()
 	}
 
-	defer f.Close()
-
-	bEnd := false
-	w := bufio.NewWriter(f)
-
+	var lastDropped uint64 = 0
+	var lastDroppedDebug uint64 = 0
 	for {
 		select {
-		case log := <-l.logs:
-			_, err := w.WriteString(log)
-			if err != nil {
-				fmt.Println("dumpToFile WriteString error: ", err)
-			}
-			w.Flush()
-
-			fs, err := os.Stat(l.dumpFile)
-			if err != nil {
-				fmt.Println("dumpToFile wos.Stat error: ", err)
-			} else if fs.Size() >= int64(l.dumpFileSize) {
-				goto Exit0
-			}
+		case r := <-l.logs:
+			l.writeRecord(r)
+
+		case <-reportChan:
+			lastDropped, lastDroppedDebug = l.reportDropped(lastDropped, lastDroppedDebug)
 
 		case <-l.stopDumpEvt:
-			bEnd = true
-			l.dumpAll(w)
-			goto Exit0
+			l.dumpAll()
+			l.reportDropped(lastDropped, lastDroppedDebug)
+			l.flushSinks()
+			close(exitEvt)
+			l.stopSuccEvt <- true
+			return
 		}
 	}
-
-Exit0:
-	return bEnd, nil
 }
 
-func (l *logger) dumpAll(w *bufio.Writer) {
-	defer w.Flush()
-
+func (l *logger) dumpAll() {
 	for {
 		select {
-		case log := <-l.logs:
-			_, err := w.WriteString(log)
-			if err != nil {
-				fmt.Println("dumpAll WriteString error: ", err)
-			}
+		case r := <-l.logs:
+			l.writeRecord(r)
 
 		default:
-			goto Exit0
+			l.flushSinks()
+			return
 		}
 	}
-
-Exit0:
-	return
-}
-
-func (l *logger) renameDumpFile() error {
-	dir := path.Dir(l.dumpFile)
-	name := path.Base(l.dumpFile)
-	ext := path.Ext(name)
-	nameOnly := strings.TrimSuffix(name, ext)
-	timeStr := GetFullTimeString("_%s%s%s_%s%s%s")
-	newName := path.Join(dir, nameOnly+timeStr+ext)
-	return os.Rename(l.dumpFile, newName)
 }
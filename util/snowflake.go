@@ -0,0 +1,185 @@
+package util
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClockRollback         error = errors.New("clock moved backwards")
+	ErrSnowflakeTimeOverflow error = errors.New("snowflake time overflow")
+	ErrSnowflakeEndOverflow  error = errors.New("end type or end no too big for the layout")
+	ErrSnowflakeLayout       error = errors.New("bad snowflake layout")
+)
+
+const (
+	SNOWFLAKE_MAX_ROLLBACK_WAIT = 10 * time.Millisecond
+)
+
+// SnowflakeLayout how the 63 bits of an id are used, from the highest:
+// the milliseconds since Epoch, the end type, the end no and the sequence.
+// The time takes the bits left by the others
+type SnowflakeLayout struct {
+	Epoch       time.Time
+	EndTypeBits uint
+	EndNoBits   uint
+	SeqBits     uint
+}
+
+// defaultSnowflakeLayout 41 bits of time for about 69 years, 16 end types,
+// 256 end nos and 1024 ids per millisecond per end
+var defaultSnowflakeLayout = SnowflakeLayout{
+	Epoch:       time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	EndTypeBits: 4,
+	EndNoBits:   8,
+	SeqBits:     10,
+}
+
+// GetDefaultSnowflakeLayout get a copy of the layout used by NewSnowflake
+func GetDefaultSnowflakeLayout() SnowflakeLayout {
+	return defaultSnowflakeLayout
+}
+
+// SnowflakeId the parts of an id
+type SnowflakeId struct {
+	Time    time.Time
+	EndType uint8
+	EndNo   uint16
+	Seq     uint64
+}
+
+func (l *SnowflakeLayout) getTimeBits() uint {
+	return 63 - l.EndTypeBits - l.EndNoBits - l.SeqBits
+}
+
+func (l *SnowflakeLayout) check() error {
+	if l.EndTypeBits > 8 || l.EndNoBits > 16 || l.SeqBits == 0 || l.EndTypeBits+l.EndNoBits+l.SeqBits >= 63 {
+		return ErrSnowflakeLayout
+	}
+
+	return nil
+}
+
+// Decode split the id into its parts
+func (l *SnowflakeLayout) Decode(id uint64) SnowflakeId {
+	seq := id & (1<<l.SeqBits - 1)
+	id >>= l.SeqBits
+	endNo := id & (1<<l.EndNoBits - 1)
+	id >>= l.EndNoBits
+	endType := id & (1<<l.EndTypeBits - 1)
+	id >>= l.EndTypeBits
+
+	return SnowflakeId{
+		Time:    l.Epoch.Add(time.Duration(id) * time.Millisecond),
+		EndType: uint8(endType),
+		EndNo:   uint16(endNo),
+		Seq:     seq,
+	}
+}
+
+// Snowflake make unique ids ordered by time, it is safe for concurrent use
+type Snowflake struct {
+	lck         sync.Mutex
+	layout      SnowflakeLayout
+	endBits     uint64 // the end type and the end no in place
+	lastMs      int64
+	seq         uint64
+	maxRollback time.Duration
+	clock       Clock
+}
+
+func NewSnowflake(endType uint8, endNo uint16) (*Snowflake, error) {
+	return NewSnowflakeWithLayout(defaultSnowflakeLayout, endType, endNo)
+}
+
+func NewSnowflakeWithLayout(layout SnowflakeLayout, endType uint8, endNo uint16) (*Snowflake, error) {
+	err := layout.check()
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(endType) >= 1<<layout.EndTypeBits || uint64(endNo) >= 1<<layout.EndNoBits {
+		return nil, ErrSnowflakeEndOverflow
+	}
+
+	return &Snowflake{
+		layout:      layout,
+		endBits:     (uint64(endType)<<layout.EndNoBits | uint64(endNo)) << layout.SeqBits,
+		lastMs:      -1,
+		seq:         0,
+		maxRollback: SNOWFLAKE_MAX_ROLLBACK_WAIT,
+		clock:       RealClock,
+	}, nil
+}
+
+// SetClock set the clock of the id time and the waits
+func (s *Snowflake) SetClock(c Clock) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.clock = c
+}
+
+// SetMaxRollbackWait wait for the clock to catch up if it moves backwards no more than d,
+// or NextId returns ErrClockRollback
+func (s *Snowflake) SetMaxRollbackWait(d time.Duration) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.maxRollback = d
+}
+
+// NextId get a new id, it waits for the next millisecond if the sequence runs out
+func (s *Snowflake) NextId() (uint64, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	ms := s.getMs()
+	if ms < s.lastMs {
+		back := time.Duration(s.lastMs-ms) * time.Millisecond
+		if back > s.maxRollback {
+			return 0, ErrClockRollback
+		}
+
+		s.clock.Sleep(back)
+		ms = s.waitAfter(s.lastMs - 1)
+	}
+
+	if ms == s.lastMs {
+		s.seq = (s.seq + 1) & (1<<s.layout.SeqBits - 1)
+		if s.seq == 0 {
+			ms = s.waitAfter(s.lastMs)
+		}
+	} else {
+		s.seq = 0
+	}
+
+	if uint64(ms) >= 1<<s.layout.getTimeBits() {
+		return 0, ErrSnowflakeTimeOverflow
+	}
+
+	s.lastMs = ms
+	return uint64(ms)<<(63-s.layout.getTimeBits()) | s.endBits | s.seq, nil
+}
+
+// Decode split the id into its parts
+func (s *Snowflake) Decode(id uint64) SnowflakeId {
+	return s.layout.Decode(id)
+}
+
+// getMs get the milliseconds since the epoch
+func (s *Snowflake) getMs() int64 {
+	return int64(s.clock.Since(s.layout.Epoch) / time.Millisecond)
+}
+
+// waitAfter wait until the millisecond after ms
+func (s *Snowflake) waitAfter(ms int64) int64 {
+	cur := s.getMs()
+	for cur <= ms {
+		s.clock.Sleep(100 * time.Microsecond)
+		cur = s.getMs()
+	}
+
+	return cur
+}
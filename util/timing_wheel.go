@@ -0,0 +1,321 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	TIMING_WHEEL_SLOT_BITS = 6
+	TIMING_WHEEL_LEVELS    = 4
+)
+
+// WheelTimer is a timer of the TimingWheel
+type WheelTimer struct {
+	w      *TimingWheel
+	expire uint64 // the tick to fire
+	period uint64 // the ticks between the fires of Every, 0 for AfterFunc
+	f      func()
+	slot   *list.List
+	elem   *list.Element
+}
+
+// Stop cancel the timer, return false if it has fired or been stopped.
+// A running callback is not waited for
+func (t *WheelTimer) Stop() bool {
+	t.w.lck.Lock()
+	defer t.w.lck.Unlock()
+
+	return t.w.remove(t)
+}
+
+// Reset reschedule the timer to fire after d, and keep the period of Every.
+// Return true if the timer was pending
+func (t *WheelTimer) Reset(d time.Duration) bool {
+	t.w.lck.Lock()
+	defer t.w.lck.Unlock()
+
+	pending := t.w.remove(t)
+	t.expire = t.w.curTick + t.w.toTicks(d)
+	t.w.add(t)
+	return pending
+}
+
+// TimingWheel is a hierarchical timing wheel, it keeps a large number of timers
+// at a fixed resolution with O(1) adding and cancelling.
+// Every level has 2^TIMING_WHEEL_SLOT_BITS slots, a slot of a level spans a whole
+// round of the level below. The timers beyond the top level wait in an overflow list
+type TimingWheel struct {
+	lck       sync.Mutex
+	tick      time.Duration
+	levels    [TIMING_WHEEL_LEVELS][]*list.List
+	overflow  *list.List
+	curTick   uint64
+	startTime time.Time
+	exec      func(f func())
+	clock     Clock
+	crash     *CrashHandler
+	stopEvt   chan bool // closed to stop the current run
+	exitEvt   chan bool // closed when the current run returns
+	running   bool
+}
+
+// NewTimingWheel create a wheel with the resolution tick, it must be started to fire the timers
+func NewTimingWheel(tick time.Duration) *TimingWheel {
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+
+	w := &TimingWheel{
+		tick:     tick,
+		overflow: list.New(),
+		curTick:  0,
+		exec:     nil,
+		clock:    RealClock,
+		crash:    nil,
+		stopEvt:  nil,
+		exitEvt:  nil,
+		running:  false,
+	}
+
+	for i := range w.levels {
+		w.levels[i] = make([]*list.List, 1<<TIMING_WHEEL_SLOT_BITS)
+		for j := range w.levels[i] {
+			w.levels[i][j] = list.New()
+		}
+	}
+
+	return w
+}
+
+// SetExecutor choose where the callbacks run, the wheel goroutine by default.
+// The callbacks on the wheel goroutine should be short
+func (w *TimingWheel) SetExecutor(exec func(f func())) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	w.exec = exec
+}
+
+// SetClock set the clock driving the wheel, it must be set before Start
+func (w *TimingWheel) SetClock(c Clock) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	w.clock = c
+}
+
+// SetCrashHandler write a crash file when a callback panics on the wheel goroutine,
+// it must be set before Start
+func (w *TimingWheel) SetCrashHandler(h *CrashHandler) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	w.crash = h
+}
+
+func (w *TimingWheel) Start() {
+	w.lck.Lock()
+	if w.running {
+		w.lck.Unlock()
+		return
+	}
+
+	w.running = true
+	w.startTime = w.clock.Now().Add(-time.Duration(w.curTick) * w.tick)
+	w.stopEvt = make(chan bool)
+	w.exitEvt = make(chan bool)
+	go w.run(w.clock, w.crash, w.startTime, w.stopEvt, w.exitEvt)
+	w.lck.Unlock()
+}
+
+// Stop stop firing the timers and wait for the wheel goroutine to exit, the pending ones are kept.
+// It must not be called by a callback on the wheel goroutine
+func (w *TimingWheel) Stop() {
+	w.lck.Lock()
+	if !w.running {
+		w.lck.Unlock()
+		return
+	}
+
+	w.running = false
+	close(w.stopEvt)
+	exitEvt := w.exitEvt
+	w.lck.Unlock()
+
+	<-exitEvt
+}
+
+// AfterFunc call f once after d
+func (w *TimingWheel) AfterFunc(d time.Duration, f func()) *WheelTimer {
+	return w.newTimer(d, 0, f)
+}
+
+// Every call f every d, the first call is after d
+func (w *TimingWheel) Every(d time.Duration, f func()) *WheelTimer {
+	w.lck.Lock()
+	period := w.toTicks(d)
+	w.lck.Unlock()
+
+	return w.newTimer(d, period, f)
+}
+
+// GetPending get the number of the pending timers
+func (w *TimingWheel) GetPending() int {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	cnt := w.overflow.Len()
+	for i := range w.levels {
+		for _, slot := range w.levels[i] {
+			cnt += slot.Len()
+		}
+	}
+
+	return cnt
+}
+
+func (w *TimingWheel) newTimer(d time.Duration, period uint64, f func()) *WheelTimer {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	t := &WheelTimer{
+		w:      w,
+		expire: w.curTick + w.toTicks(d),
+		period: period,
+		f:      f,
+	}
+
+	w.add(t)
+	return t
+}
+
+// toTicks round d up to ticks, at least 1
+func (w *TimingWheel) toTicks(d time.Duration) uint64 {
+	ticks := uint64((d + w.tick - 1) / w.tick)
+	if d <= 0 || ticks == 0 {
+		return 1
+	}
+
+	return ticks
+}
+
+// add put the timer in the slot by how far it is, the lock must be held.
+// A timer due at the current tick goes to the slot about to fire
+func (w *TimingWheel) add(t *WheelTimer) {
+	if t.expire < w.curTick {
+		t.expire = w.curTick
+	}
+
+	diff := t.expire - w.curTick
+	var slot *list.List = nil
+	for i := 0; i < TIMING_WHEEL_LEVELS; i++ {
+		shift := uint(TIMING_WHEEL_SLOT_BITS * i)
+		if diff < 1<<(shift+TIMING_WHEEL_SLOT_BITS) {
+			slot = w.levels[i][(t.expire>>shift)&(1<<TIMING_WHEEL_SLOT_BITS-1)]
+			break
+		}
+	}
+
+	if slot == nil {
+		slot = w.overflow
+	}
+
+	t.slot = slot
+	t.elem = slot.PushBack(t)
+}
+
+// remove take the timer out of its slot, the lock must be held
+func (w *TimingWheel) remove(t *WheelTimer) bool {
+	if t.slot == nil {
+		return false
+	}
+
+	t.slot.Remove(t.elem)
+	t.slot = nil
+	t.elem = nil
+	return true
+}
+
+func (w *TimingWheel) run(clock Clock, crash *CrashHandler, startTime time.Time, stopEvt chan bool, exitEvt chan bool) {
+	defer close(exitEvt)
+	if crash != nil {
+		defer crash.Recover()
+	}
+
+	ticker := clock.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			w.advance(uint64(clock.Since(startTime) / w.tick))
+
+		case <-stopEvt:
+			return
+		}
+	}
+}
+
+// advance move the wheel to the tick, and fire the timers due
+func (w *TimingWheel) advance(target uint64) {
+	var fired []func() = nil
+
+	w.lck.Lock()
+	for w.curTick < target {
+		w.curTick++
+		w.cascade()
+
+		slot := w.levels[0][w.curTick&(1<<TIMING_WHEEL_SLOT_BITS-1)]
+		for slot.Len() > 0 {
+			t := slot.Remove(slot.Front()).(*WheelTimer)
+			t.slot = nil
+			t.elem = nil
+			fired = append(fired, t.f)
+
+			if t.period > 0 {
+				t.expire = w.curTick + t.period
+				w.add(t)
+			}
+		}
+	}
+
+	exec := w.exec
+	w.lck.Unlock()
+
+	for _, f := range fired {
+		if exec != nil {
+			exec(f)
+		} else {
+			f()
+		}
+	}
+}
+
+// cascade move the timers of the upper levels down when a lower level finishes a round,
+// the lock must be held
+func (w *TimingWheel) cascade() {
+	for i := 1; i < TIMING_WHEEL_LEVELS; i++ {
+		shift := uint(TIMING_WHEEL_SLOT_BITS * i)
+		if w.curTick&(1<<shift-1) != 0 {
+			return
+		}
+
+		w.readd(w.levels[i][(w.curTick>>shift)&(1<<TIMING_WHEEL_SLOT_BITS-1)])
+		if i == TIMING_WHEEL_LEVELS-1 {
+			w.readd(w.overflow)
+		}
+	}
+}
+
+func (w *TimingWheel) readd(slot *list.List) {
+	timers := make([]*WheelTimer, 0, slot.Len())
+	for slot.Len() > 0 {
+		timers = append(timers, slot.Remove(slot.Front()).(*WheelTimer))
+	}
+
+	for _, t := range timers {
+		w.add(t)
+	}
+}
@@ -0,0 +1,119 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket refill rate tokens per second up to burst.
+// Take may borrow tokens, the debt delays the later takers.
+// A request larger than burst is admitted by a full bucket and leaves the rest as debt
+type TokenBucket struct {
+	lck      sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastTime time.Time
+	clock    Clock
+}
+
+// NewTokenBucket a burst <= 0 means one second of the rate
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		rate:     rate,
+		burst:    burst,
+		tokens:   burst,
+		lastTime: RealClock.Now(),
+		clock:    RealClock,
+	}
+}
+
+// SetClock set the clock of the refill
+func (b *TokenBucket) SetClock(c Clock) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	b.clock = c
+	b.lastTime = c.Now()
+}
+
+// Wait get the time until n tokens are available, 0 if they are available now
+func (b *TokenBucket) Wait(n float64) time.Duration {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	b.refill()
+	need := b.capNeed(n)
+	if b.tokens >= need {
+		return 0
+	}
+
+	if b.rate <= 0 {
+		return time.Duration(1<<63 - 1)
+	}
+
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Take consume n tokens, the tokens may go negative
+func (b *TokenBucket) Take(n float64) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	b.refill()
+	b.tokens -= n
+}
+
+// Allow consume n tokens if they are available now
+func (b *TokenBucket) Allow(n float64) bool {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	b.refill()
+	if b.tokens < b.capNeed(n) {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// IsFull return true if the bucket has not been used for a full refill
+func (b *TokenBucket) IsFull() bool {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// capNeed the tokens needed before n can be taken, never more than a full bucket
+func (b *TokenBucket) capNeed(n float64) float64 {
+	if n > b.burst {
+		return b.burst
+	}
+
+	return n
+}
+
+func (b *TokenBucket) refill() {
+	now := b.clock.Now()
+	elapsed := now.Sub(b.lastTime).Seconds()
+	b.lastTime = now
+	if elapsed <= 0 {
+		return
+	}
+
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
@@ -7,7 +7,11 @@ import (
 )
 
 func GetFullTimeString(format string) string {
-	timeObj := time.Now()
+	return FormatFullTime(GetClock().Now(), format)
+}
+
+// FormatFullTime format the time with the zero padded year, month, day, hour, minute and second strings
+func FormatFullTime(timeObj time.Time, format string) string {
 
 	yy := timeObj.Year()
 	yyStr := strconv.Itoa(yy)
@@ -46,7 +50,7 @@ func GetFullTimeString(format string) string {
 }
 
 func GetDateString(format string) string {
-	timeObj := time.Now()
+	timeObj := GetClock().Now()
 
 	yy := timeObj.Year()
 	yyStr := strconv.Itoa(yy)
@@ -67,7 +71,7 @@ func GetDateString(format string) string {
 }
 
 func GetTimeString(format string) string {
-	timeObj := time.Now()
+	timeObj := GetClock().Now()
 
 	h := timeObj.Hour()
 	hStr := strconv.Itoa(h)
@@ -1,7 +1,18 @@
 package util
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,3 +32,752 @@ func TestLog(t *testing.T) {
 	Logger.StopDump()
 	fmt.Println("the log result is ok")
 }
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10, 5)
+	for i := 0; i < 5; i++ {
+		if !b.Allow(1) {
+			t.Fatal("expect allow at", i)
+		}
+	}
+
+	if b.Allow(1) {
+		t.Fatal("expect deny when empty")
+	}
+
+	b.Take(1)
+	wait := b.Wait(1)
+	if wait < 150*time.Millisecond || wait > 200*time.Millisecond {
+		t.Fatal("unexpect wait:", wait)
+	}
+
+	// the burst defaults to the rate, and a full bucket admits more than the burst
+	b = NewTokenBucket(100, 0)
+	if !b.Allow(150) || b.Wait(1) < 400*time.Millisecond {
+		t.Fatal("expect a large request to borrow from a full bucket")
+	}
+
+	// the refill follows the clock
+	clock := NewFakeClock(time.Now())
+	b = NewTokenBucket(10, 1)
+	b.SetClock(clock)
+	if !b.Allow(1) || b.Allow(1) {
+		t.Fatal("expect one token")
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	if !b.Allow(1) {
+		t.Fatal("expect refilled by the clock")
+	}
+}
+
+func TestLogEncoder(t *testing.T) {
+	r := &LogRecord{
+		Time:   time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local),
+		Level:  LOG_LV_WARN,
+		Tag:    "test",
+		Msg:    "hello",
+		Fields: makeFields([]interface{}{"conn", 3, FieldStr("addr", "a b"), FieldErr(errors.New("eof"))}),
+		File:   "/src/util_test.go",
+		Line:   9,
+	}
+
+	text := string((&TextEncoder{}).Encode(r))
+	expect := "[2021/03/04 05:06:07] [ test ] [WARN ] hello conn=3 addr=\"a b\" error=eof (util_test.go:9)\n"
+	if text != expect {
+		t.Fatal("unexpect text:", text)
+	}
+
+	line := (&JsonEncoder{}).Encode(r)
+	obj := make(map[string]interface{})
+	err := json.Unmarshal(line, &obj)
+	if err != nil {
+		t.Fatal("invalid json:", string(line))
+	}
+
+	if obj["level"] != "warn" || obj["conn"] != float64(3) || obj["error"] != "eof" || obj["caller"] != "util_test.go:9" {
+		t.Fatal("unexpect json:", string(line))
+	}
+}
+
+func TestLogSinks(t *testing.T) {
+	ring := NewRingSink(2)
+	var buff bytes.Buffer
+	Logger.AddSink("test_ring", ring, LOG_LV_WARN, nil)
+	Logger.AddSink("test_json", NewConsoleSink(&buff), LOG_LV_DEBUG, &JsonEncoder{})
+	defer Logger.RemoveSink("test_ring")
+	defer Logger.RemoveSink("test_json")
+
+	Logger.D("test", "debug line")
+	Logger.W("test", "warn line 1")
+	Logger.E("test", "error line 2")
+	Logger.E("test", "error line 3")
+
+	lines := ring.Lines()
+	if len(lines) != 2 || !strings.Contains(lines[0], "line 2") || !strings.Contains(lines[1], "line 3") {
+		t.Fatal("unexpect ring lines:", lines)
+	}
+
+	if strings.Count(buff.String(), "\n") != 4 || !strings.HasPrefix(buff.String(), "{") {
+		t.Fatal("unexpect json lines:", buff.String())
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	addr := path.Join(t.TempDir(), "log.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	sink, err := NewSyslogSink(addr, "yx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+	Logger.SetClock(NewFakeClock(time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)))
+	defer Logger.SetClock(nil)
+	Logger.AddSink("test_syslog", sink, LOG_LV_WARN, nil)
+	Logger.W("test", "syslog line 1")
+	Logger.E("test", "syslog line 2")
+	Logger.RemoveSink("test_syslog")
+
+	// the stream socket gets the msgs framed by their lengths, stamped with the log time
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		sp := bytes.IndexByte(data, ' ')
+		n, err := strconv.Atoi(string(data[:sp]))
+		if err != nil || len(data) < sp+1+n {
+			t.Fatal("wrong frame:", string(data))
+		}
+
+		msg := string(data[sp+1 : sp+1+n])
+		if !strings.Contains(msg, "Mar  4 05:06:07 yx[") || !strings.Contains(msg, "syslog line "+strconv.Itoa(i)) {
+			t.Fatal("wrong msg:", msg)
+		}
+
+		data = data[sp+1+n:]
+	}
+
+	if len(data) != 0 {
+		t.Fatal("unexpect data:", string(data))
+	}
+}
+
+func TestFileSinkRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yxlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the sibling logs look like rotated files, they must be neither listed nor pruned
+	siblings := []string{"test_access.log", "test_access_20210304_050607.log", "test_20210304_0506.log"}
+	for _, name := range siblings {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte("sibling\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := path.Join(dir, "test.log")
+	sink := NewFileSink(file, 100)
+	sink.SetRetention(3, 0)
+	sink.SetCompress(true)
+	for i := 0; i < 50; i++ {
+		sink.Write(LOG_LV_INFO, []byte("a line of 32 bytes for rotating\n"))
+	}
+
+	sink.Close()
+
+	files, err := GetDumpFiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 3 {
+		t.Fatal("unexpect rotated files:", files)
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f, ".log.gz") {
+			t.Fatal("not compressed:", f)
+		}
+	}
+
+	if !isFileExist(file) {
+		t.Fatal("current file not found")
+	}
+
+	for _, name := range siblings {
+		if !isFileExist(path.Join(dir, name)) {
+			t.Fatal("sibling pruned:", name)
+		}
+	}
+
+	// the same second is ordered by the number
+	for _, name := range []string{"test_20210304_050607_10.log", "test_20210304_050607_2.log.gz", "test_20210304_050607.log"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err = GetDumpFiles(file)
+	if err != nil || len(files) != 6 {
+		t.Fatal("unexpect rotated files:", files, err)
+	}
+
+	if path.Base(files[0]) != "test_20210304_050607.log" || path.Base(files[1]) != "test_20210304_050607_2.log.gz" ||
+		path.Base(files[2]) != "test_20210304_050607_10.log" {
+		t.Fatal("wrong order:", files)
+	}
+}
+
+func TestFileSinkPeriod(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFakeClock(time.Date(2021, 3, 4, 23, 59, 0, 0, time.Local))
+	file := path.Join(dir, "daily.log")
+	sink := NewFileSink(file, 0)
+	sink.SetClock(c)
+	sink.SetPeriod(LOG_ROTATE_DAILY)
+	sink.Write(LOG_LV_INFO, []byte("day 1\n"))
+	c.Advance(2 * time.Minute)
+	sink.Write(LOG_LV_INFO, []byte("day 2\n"))
+	sink.Close()
+
+	files, err := GetDumpFiles(file)
+	if err != nil || len(files) != 1 || path.Base(files[0]) != "daily_20210305_000100.log" {
+		t.Fatal("not rotated at the day rollover:", files, err)
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != "day 2\n" {
+		t.Fatal("wrong current file:", string(data))
+	}
+}
+
+func TestTagLevel(t *testing.T) {
+	Logger.SetLevel(LOG_LV_WARN)
+	defer Logger.SetLevel(LOG_LV_DEBUG)
+	defer Logger.ClearTagLevels()
+
+	Logger.SetTagLevel("Sock*", LOG_LV_DEBUG)
+	Logger.SetTagLevel("SockMgr", LOG_LV_ERROR)
+	if !Logger.IsEnabled(LOG_LV_DEBUG, "SockConn") || Logger.IsEnabled(LOG_LV_WARN, "SockMgr") || Logger.IsEnabled(LOG_LV_INFO, "Server") {
+		t.Fatal("wrong tag levels")
+	}
+
+	if Logger.SetTagLevel("[", LOG_LV_DEBUG) == nil {
+		t.Fatal("bad pattern accepted")
+	}
+
+	err := Logger.ApplyLevelConfig(&LogLevelConfig{Level: "info", Tags: map[string]string{"Serv*": "error"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Logger.GetLevel() != LOG_LV_INFO || Logger.GetTagLevel("Server") != LOG_LV_ERROR || Logger.GetTagLevel("SockConn") != LOG_LV_INFO {
+		t.Fatal("level config not applied")
+	}
+}
+
+type testPlugLogger struct {
+	lines []string
+}
+
+func (l *testPlugLogger) D(tag string, a ...interface{}) {
+	l.lines = append(l.lines, tag+" "+fmt.Sprint(a...))
+}
+func (l *testPlugLogger) I(tag string, a ...interface{}) {
+	l.lines = append(l.lines, tag+" "+fmt.Sprint(a...))
+}
+func (l *testPlugLogger) W(tag string, a ...interface{}) {
+	l.lines = append(l.lines, tag+" "+fmt.Sprint(a...))
+}
+func (l *testPlugLogger) E(tag string, a ...interface{}) {
+	l.lines = append(l.lines, tag+" "+fmt.Sprint(a...))
+}
+
+func TestLoggerWith(t *testing.T) {
+	plug := &testPlugLogger{}
+	l := LoggerWith(LoggerWith(plug, "conn", 1), "addr", "pipe")
+	l.W("SockConn", "read error: ", errors.New("eof"))
+	if len(plug.lines) != 1 || plug.lines[0] != "SockConn read error: eof conn=1 addr=pipe" {
+		t.Fatal("unexpect plugged lines:", plug.lines)
+	}
+
+	if _, ok := LoggerWith(Logger, "conn", 1).(*logEntry); !ok {
+		t.Fatal("built-in logger not kept")
+	}
+}
+
+type testBlockSink struct {
+	evt chan bool
+}
+
+func (s *testBlockSink) Write(lv LogLv, log []byte) error {
+	<-s.evt
+	return nil
+}
+
+func (s *testBlockSink) Flush() error { return nil }
+func (s *testBlockSink) Close() error { return nil }
+
+func TestLogQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yxlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Logger.SetQueue(4, LOG_QUEUE_POLICY_DROP_DEBUG)
+	defer Logger.SetQueue(LOG_QUEUE_SIZE, LOG_QUEUE_POLICY_BLOCK)
+
+	block := &testBlockSink{evt: make(chan bool)}
+	ring := NewRingSink(100)
+	Logger.StartDumpSink(NewFileSink(path.Join(dir, "queue.log"), 0))
+	Logger.AddSink("test_block", block, LOG_LV_DEBUG, nil)
+	Logger.AddSink("test_ring", ring, LOG_LV_DEBUG, nil)
+
+	for i := 0; i < 20; i++ {
+		Logger.D("test", "debug ", i)
+		Logger.E("test", "error ", i)
+	}
+
+	close(block.evt)
+	Logger.Flush()
+
+	dropped, droppedDebug := Logger.GetDropped()
+	if dropped == 0 || droppedDebug == 0 || droppedDebug > dropped {
+		t.Fatal("unexpect dropped:", dropped, droppedDebug)
+	}
+
+	Logger.StopDump()
+	Logger.RemoveSink("test_block")
+	Logger.RemoveSink("test_ring")
+
+	lines := ring.Lines()
+	if !strings.Contains(lines[len(lines)-1], "dropped_total="+fmt.Sprint(dropped)) {
+		t.Fatal("drop report not found:", lines[len(lines)-1])
+	}
+}
+
+// TestCrashWheel run itself in a child process, where a timer callback panics on the wheel goroutine
+func TestCrashWheel(t *testing.T) {
+	if dir := os.Getenv("YX_CRASH_DIR"); dir != "" {
+		w := NewTimingWheel(time.Millisecond)
+		w.SetCrashHandler(NewCrashHandler(dir, 0))
+		w.AfterFunc(time.Millisecond, func() { panic("wheel crash") })
+		w.Start()
+		time.Sleep(5 * time.Second)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "yxcrash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashWheel$")
+	cmd.Env = append(os.Environ(), "YX_CRASH_DIR="+dir)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatal("expect the child to crash")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || !strings.Contains(string(out), "wheel crash") {
+		t.Fatal("crash file not written:", len(files), string(out))
+	}
+}
+
+func TestLogFlushStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yxlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Logger.SetQueue(2, LOG_QUEUE_POLICY_BLOCK)
+	defer Logger.SetQueue(LOG_QUEUE_SIZE, LOG_QUEUE_POLICY_BLOCK)
+
+	// the flushes and the blocked logs racing with StopDump must all return
+	Logger.StartDumpSink(NewFileSink(path.Join(dir, "flush.log"), 0))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				Logger.I("test", "flush ", i, " ", j)
+				Logger.Flush()
+			}
+		}(i)
+	}
+
+	time.Sleep(time.Millisecond)
+	Logger.StopDump()
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush blocked by StopDump")
+	}
+}
+
+func TestCrashHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yxcrash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := NewCrashHandler(dir, 10)
+	defer h.Close()
+
+	Logger.I("test", "the line before crash")
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic not passed on")
+			}
+		}()
+		defer h.Recover()
+
+		panic("test crash")
+	}()
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || !strings.HasPrefix(files[0].Name(), "crash_") {
+		t.Fatal("crash file not found")
+	}
+
+	data, _ := ioutil.ReadFile(path.Join(dir, files[0].Name()))
+	content := string(data)
+	if !strings.Contains(content, "panic: test crash") || !strings.Contains(content, "the line before crash") || !strings.Contains(content, "goroutines:") {
+		t.Fatal("unexpect crash file:", content)
+	}
+
+	if strings.Contains(content, "%s") || !strings.Contains(content, "time:        ["+time.Now().Format("2006/01/02")) {
+		t.Fatal("wrong crash time:", content)
+	}
+
+	file, err := h.DumpGoroutines()
+	if err != nil || !strings.HasPrefix(path.Base(file), "goroutine_") {
+		t.Fatal("dump goroutines error:", file, err)
+	}
+}
+
+func TestDecodeLogLine(t *testing.T) {
+	r := &LogRecord{
+		Time:   time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local),
+		Level:  LOG_LV_WARN,
+		Tag:    "SockConn",
+		Msg:    "read data error: eof",
+		Fields: []Field{FieldInt("conn", 3)},
+		File:   "/src/sock_conn.go",
+		Line:   42,
+	}
+
+	for _, enc := range []LogEncoder{&TextEncoder{}, &JsonEncoder{}} {
+		d, err := DecodeLogLine(string(enc.Encode(r)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !d.Time.Equal(r.Time) || d.Level != r.Level || d.Tag != r.Tag || d.File != "sock_conn.go" || d.Line != 42 || !strings.HasPrefix(d.Msg, r.Msg) {
+			t.Fatal("unexpect decoded log:", d)
+		}
+	}
+
+	_, err := DecodeLogLine("goroutine 1 [running]:")
+	if err != ErrLogFormat {
+		t.Fatal("bad line decoded")
+	}
+}
+
+func TestSnowflake(t *testing.T) {
+	s, err := NewSnowflake(3, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lck sync.Mutex
+	ids := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3000; j++ {
+				id, err := s.NextId()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				lck.Lock()
+				ids[id] = true
+				lck.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	if len(ids) != 12000 {
+		t.Fatal("duplicate ids:", 12000-len(ids))
+	}
+
+	id, _ := s.NextId()
+	parts := s.Decode(id)
+	if parts.EndType != 3 || parts.EndNo != 200 || time.Since(parts.Time) > time.Second {
+		t.Fatal("unexpect id parts:", parts)
+	}
+
+	s.lastMs = s.getMs() + 1000
+	_, err = s.NextId()
+	if err != ErrClockRollback {
+		t.Fatal("clock rollback not detected")
+	}
+
+	// a small rollback is waited out
+	c := &rollbackClock{FakeClock: NewFakeClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))}
+	s, _ = NewSnowflake(3, 200)
+	s.SetClock(c)
+	start := c.Now()
+	id1, _ := s.NextId()
+	c.back = 5 * time.Millisecond
+	id2, err := s.NextId()
+	if err != nil || id2 <= id1 || c.FakeClock.Since(start) < 5*time.Millisecond {
+		t.Fatal("small rollback not waited:", err, id1, id2)
+	}
+
+	c.back += 20 * time.Millisecond
+	_, err = s.NextId()
+	if err != ErrClockRollback {
+		t.Fatal("clock rollback not detected")
+	}
+
+	_, err = NewSnowflake(16, 0)
+	if err != ErrSnowflakeEndOverflow {
+		t.Fatal("end type overflow not detected")
+	}
+}
+
+// rollbackClock is back behind the fake clock, and its Sleep moves the fake clock
+type rollbackClock struct {
+	*FakeClock
+	back time.Duration
+}
+
+func (c *rollbackClock) Now() time.Time {
+	return c.FakeClock.Now().Add(-c.back)
+}
+
+func (c *rollbackClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *rollbackClock) Sleep(d time.Duration) {
+	c.FakeClock.Advance(d)
+}
+
+func TestIdGenerator(t *testing.T) {
+	g := NewIdGenerator(1, 3)
+	g.SetQuarantine(50 * time.Millisecond)
+	if g.GetId() != 1 || g.GetId() != 2 || g.GetInUseCount() != 2 {
+		t.Fatal("wrong ids")
+	}
+
+	if g.ReuseId(1) != nil || g.ReuseId(1) != ErrIdNotInUse || g.ReuseId(4) != ErrIdOutOfRange {
+		t.Fatal("bad free not detected")
+	}
+
+	// 1 is in quarantine
+	if g.GetId() != 3 || g.GetId() != 0 || g.GetQuarantineCount() != 1 {
+		t.Fatal("id reused in quarantine")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if g.GetId() != 1 || g.GetInUseCount() != 3 {
+		t.Fatal("id not reused after quarantine")
+	}
+
+	// the fresh ids go first even without the quarantine
+	g = NewIdGenerator(1, 3)
+	if g.GetId() != 1 || g.ReuseId(1) != nil || g.GetId() != 2 || g.GetId() != 3 {
+		t.Fatal("freed id reused before the fresh ids")
+	}
+
+	if g.ReuseId(3) != nil || g.GetId() != 1 || g.GetId() != 3 || g.GetId() != 0 {
+		t.Fatal("freed ids not reused in order")
+	}
+	// the sweep of the ids freed before the exhaustion skips the ones queued after
+	clock := NewFakeClock(time.Now())
+	g = NewIdGenerator(1, 5)
+	g.SetClock(clock)
+	g.SetQuarantine(10 * time.Second)
+	for i := 1; i <= 5; i++ {
+		g.GetId()
+	}
+
+	g.ReuseId(2)
+	g.ReuseId(4)
+	if g.GetId() != 0 || g.ReuseId(1) != nil || g.GetQuarantineCount() != 3 {
+		t.Fatal("wrong quarantine:", g.GetQuarantineCount())
+	}
+
+	clock.Advance(10 * time.Second)
+	if g.GetId() != 2 || g.GetId() != 4 || g.GetId() != 1 || g.GetId() != 0 || g.GetInUseCount() != 5 {
+		t.Fatal("freed ids not swept in order")
+	}
+}
+
+func TestTimingWheel(t *testing.T) {
+	w := NewTimingWheel(time.Millisecond)
+	delays := []uint64{1, 63, 64, 65, 4095, 4096, 5000, 1<<24 + 5}
+	fired := make(map[uint64]uint64)
+	for _, d := range delays {
+		d := d
+		w.AfterFunc(time.Duration(d)*time.Millisecond, func() { fired[d] = w.curTick })
+	}
+
+	cnt := 0
+	every := w.Every(100*time.Millisecond, func() { cnt++ })
+	canceled := w.AfterFunc(10*time.Millisecond, func() { t.Fatal("canceled timer fired") })
+	if !canceled.Stop() || canceled.Stop() {
+		t.Fatal("wrong stop result")
+	}
+
+	moved := w.AfterFunc(10*time.Millisecond, func() { fired[0] = w.curTick })
+	moved.Reset(20 * time.Millisecond)
+
+	for w.curTick < 1<<24+10 {
+		w.advance(w.curTick + 1)
+	}
+	for _, d := range delays {
+		if fired[d] != d {
+			t.Fatal("timer of", d, "fired at", fired[d])
+		}
+	}
+
+	if fired[0] != 20 || cnt != (1<<24+10)/100 {
+		t.Fatal("unexpect reset or every:", fired[0], cnt)
+	}
+
+	every.Stop()
+	if w.GetPending() != 0 {
+		t.Fatal("timers left:", w.GetPending())
+	}
+
+	// a stopped Every keeps its period when reset
+	cnt = 0
+	every.Reset(10 * time.Millisecond)
+	w.advance(w.curTick + 1000)
+	if cnt != 10 || !every.Stop() {
+		t.Fatal("period lost after reset:", cnt)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	c := NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local))
+	timer := c.NewTimer(time.Second)
+	ticker := c.NewTicker(300 * time.Millisecond)
+	defer ticker.Stop()
+
+	order := make([]string, 0)
+	c.AfterFunc(500*time.Millisecond, func() { order = append(order, "func") })
+	stopped := c.AfterFunc(700*time.Millisecond, func() { order = append(order, "stopped") })
+	stopped.Stop()
+
+	c.Advance(999 * time.Millisecond)
+	if len(timer.C()) != 0 || len(order) != 1 || len(ticker.C()) != 1 {
+		t.Fatal("wrong fire before 1s:", order)
+	}
+
+	c.Advance(time.Millisecond)
+	tm := <-timer.C()
+	if !tm.Equal(c.Now()) || c.Now().Format("15:04:05") != "00:00:01" {
+		t.Fatal("wrong timer time:", tm)
+	}
+
+	SetClock(c)
+	defer SetClock(nil)
+	if GetDateString("%s-%s-%s") != "2021-01-01" {
+		t.Fatal("time helpers not using the clock")
+	}
+
+	// the clocks can be set while the others read them
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			GetDateString("%s-%s-%s")
+			Logger.getClock().Now()
+		}
+
+		close(done)
+	}()
+
+	for i := 0; i < 100; i++ {
+		SetClock(c)
+		Logger.SetClock(c)
+		Logger.SetClock(nil)
+	}
+
+	<-done
+
+	// the wheel fires after the fake clock moves
+	w := NewTimingWheel(10 * time.Millisecond)
+	w.SetClock(c)
+	fired := make(chan bool, 1)
+	w.AfterFunc(50*time.Millisecond, func() { fired <- true })
+	w.Start()
+
+	for c.GetTimerCount() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Advance(60 * time.Millisecond)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("wheel timer not fired")
+	}
+
+	// every Stop waits for its run to exit, so a restart never blocks
+	wheelStopped := make(chan bool)
+	go func() {
+		w.Stop()
+		w.Start()
+		w.Stop()
+		w.Stop()
+		close(wheelStopped)
+	}()
+
+	select {
+	case <-wheelStopped:
+	case <-time.After(time.Second):
+		t.Fatal("wheel stop blocked")
+	}
+
+	if c.GetTimerCount() != 1 {
+		t.Fatal("wheel ticker left:", c.GetTimerCount())
+	}
+}